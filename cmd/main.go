@@ -4,10 +4,16 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/pkkulhari/backme/internal/backup"
 	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/destination"
 	"github.com/pkkulhari/backme/internal/s3"
+	"github.com/pkkulhari/backme/internal/storage"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -43,18 +49,21 @@ var rootCmd = &cobra.Command{
 			return fmt.Errorf("failed to load config: %w", err)
 		}
 
-		// Set log level from config
-		level, err := zerolog.ParseLevel(cfg.LogLevel)
-		if err != nil {
-			log.Warn().Msgf("Invalid log level %q, using info level", cfg.LogLevel)
-			level = zerolog.InfoLevel
-		}
-		zerolog.SetGlobalLevel(level)
-
+		setLogLevel(cfg.LogLevel)
 		return nil
 	},
 }
 
+// setLogLevel sets the log level from the config
+func setLogLevel(logLevel string) {
+	level, err := zerolog.ParseLevel(logLevel)
+	if err != nil {
+		log.Warn().Msgf("Invalid log level %q, using info level", logLevel)
+		level = zerolog.InfoLevel
+	}
+	zerolog.SetGlobalLevel(level)
+}
+
 var dbCmd = &cobra.Command{
 	Use:   "db",
 	Short: "Database backup commands",
@@ -69,19 +78,51 @@ var dbBackupCmd = &cobra.Command{
 			return err
 		}
 
-		s3Client, err := s3.New(cfg, nil)
+		store, err := destination.Open(cfg)
 		if err != nil {
 			return err
 		}
 
-		backupSvc := backup.New(cfg, s3Client)
+		dedup, _ := cmd.Flags().GetBool("dedup")
+
+		backupSvc := backup.New(cfg, store)
 		dbConfig := &config.DatabaseConfig{
-			Name: dbName,
+			Name:  dbName,
+			Dedup: dedup,
 		}
 		return backupSvc.BackupDatabase(context.Background(), dbConfig, nil)
 	},
 }
 
+var dbDownloadCmd = &cobra.Command{
+	Use:   "download",
+	Short: "Download a database dump from S3",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := cmd.Flags().GetString("key")
+		if err != nil {
+			return err
+		}
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+
+		store, err := destination.Open(cfg)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer file.Close()
+
+		backupSvc := backup.New(cfg, store)
+		return backupSvc.DownloadDatabaseBackup(context.Background(), key, file, nil)
+	},
+}
+
 var dirCmd = &cobra.Command{
 	Use:   "dir",
 	Short: "Directory backup commands",
@@ -96,67 +137,362 @@ var dirBackupCmd = &cobra.Command{
 			return err
 		}
 
-		s3Client, err := s3.New(cfg, nil)
+		store, err := destination.Open(cfg)
 		if err != nil {
 			return err
 		}
 
-		backupSvc := backup.New(cfg, s3Client)
+		backupSvc := backup.New(cfg, store)
 		sync, _ := cmd.Flags().GetBool("sync")
 		delete, _ := cmd.Flags().GetBool("delete")
+		mode, _ := cmd.Flags().GetString("mode")
+		symlinks, _ := cmd.Flags().GetString("symlinks")
+		specialFiles, _ := cmd.Flags().GetString("special-files")
+		dedup, _ := cmd.Flags().GetBool("dedup")
+		keyFile, _ := cmd.Flags().GetString("encryption-key-file")
+
+		dirConfig := &config.DirectoryConfig{
+			SourcePath:        source,
+			Mode:              mode,
+			Sync:              sync,
+			Delete:            delete,
+			Symlinks:          symlinks,
+			SpecialFiles:      specialFiles,
+			Dedup:             dedup,
+			EncryptionKeyFile: keyFile,
+		}
+		return backupSvc.BackupDirectory(context.Background(), dirConfig, nil)
+	},
+}
+
+var dirRestoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore a directory archive, snapshot or files backup from S3",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, _ := cmd.Flags().GetString("key")
+		snapshot, _ := cmd.Flags().GetString("snapshot")
+		asOfFlag, _ := cmd.Flags().GetString("as-of")
+		target, err := cmd.Flags().GetString("target")
+		if err != nil {
+			return err
+		}
+		if key != "" && snapshot != "" {
+			return fmt.Errorf("only one of --key or --snapshot can be used")
+		}
+		if asOfFlag != "" && (key != "" || snapshot != "") {
+			return fmt.Errorf("--as-of can only be used to restore files mode backups")
+		}
+
+		store, err := destination.Open(cfg)
+		if err != nil {
+			return err
+		}
+
+		backupSvc := backup.New(cfg, store)
+		switch {
+		case snapshot != "":
+			return backupSvc.RestoreSnapshot(context.Background(), snapshot, target, nil)
+		case key != "":
+			keyFile, _ := cmd.Flags().GetString("encryption-key-file")
+			return backupSvc.RestoreArchive(context.Background(), key, target, keyFile, nil)
+		}
+
+		// Without an archive or snapshot, restore the objects of a files mode backup
+		prefix := cfg.AWS.DirectoryPrefix
+		if cmd.Flags().Changed("prefix") {
+			prefix, _ = cmd.Flags().GetString("prefix")
+		}
+
+		var asOf time.Time
+		if asOfFlag != "" {
+			asOf, err = time.Parse(time.RFC3339, asOfFlag)
+			if err != nil {
+				return fmt.Errorf("invalid --as-of time, expected RFC 3339 like 2006-01-02T15:04:05Z: %w", err)
+			}
+		}
+
+		return backupSvc.RestoreFiles(context.Background(), prefix, target, asOf, nil)
+	},
+}
+
+var dirSnapshotsCmd = &cobra.Command{
+	Use:   "snapshots",
+	Short: "List directory snapshots stored in S3",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, _ := cmd.Flags().GetString("name")
+
+		store, err := destination.Open(cfg)
+		if err != nil {
+			return err
+		}
+
+		backupSvc := backup.New(cfg, store)
+		keys, err := backupSvc.ListSnapshots(context.Background(), name, nil)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			fmt.Println(key)
+		}
+		return nil
+	},
+}
+
+var dirDiffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Show the differences between two directory snapshots",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		from, err := cmd.Flags().GetString("from")
+		if err != nil {
+			return err
+		}
+		to, err := cmd.Flags().GetString("to")
+		if err != nil {
+			return err
+		}
+
+		store, err := destination.Open(cfg)
+		if err != nil {
+			return err
+		}
+
+		backupSvc := backup.New(cfg, store)
+		changes, err := backupSvc.DiffSnapshots(context.Background(), from, to, nil)
+		if err != nil {
+			return err
+		}
+
+		for _, change := range changes {
+			fmt.Printf("%-8s %s\n", change.Change, change.Path)
+		}
+		return nil
+	},
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List backup objects stored in S3",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		prefix, _ := cmd.Flags().GetString("prefix")
+		details, _ := cmd.Flags().GetBool("details")
+
+		store, err := destination.Open(cfg)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+		if versions, _ := cmd.Flags().GetBool("versions"); versions {
+			versioned, ok := store.(storage.Versioned)
+			if !ok {
+				return fmt.Errorf("listing versions requires a versioned S3 bucket")
+			}
+			objectVersions, err := versioned.ListVersions(ctx, prefix)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintln(w, "KEY\tVERSION\tSIZE\tLAST MODIFIED\tLATEST\tDELETE MARKER")
+			for _, v := range objectVersions {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%t\t%t\n", v.Key, v.VersionID, v.Size, v.LastModified.Format(time.RFC3339), v.IsLatest, v.DeleteMarker)
+			}
+			return w.Flush()
+		}
+
+		objects, err := store.List(ctx, prefix)
+		if err != nil {
+			return err
+		}
+
+		if details {
+			fmt.Fprintln(w, "KEY\tSIZE\tLAST MODIFIED\tSTORAGE CLASS\tENCRYPTION\tRETAIN UNTIL\tLEGAL HOLD\tTAGS\tMETADATA")
+		} else {
+			fmt.Fprintln(w, "KEY\tSIZE\tLAST MODIFIED\tSTORAGE CLASS")
+		}
+
+		for _, obj := range objects {
+			if !details {
+				fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", obj.Key, obj.Size, obj.LastModified.Format(time.RFC3339), obj.StorageClass)
+				continue
+			}
+
+			info, err := store.GetObjectMetadata(ctx, obj.Key)
+			if err != nil {
+				return err
+			}
+			var tags map[string]string
+			if tagged, ok := store.(storage.Tagged); ok {
+				if tags, err = tagged.GetObjectTags(ctx, obj.Key); err != nil {
+					return err
+				}
+			}
+			retainUntil := ""
+			if !info.RetainUntil.IsZero() {
+				retainUntil = info.RetainUntil.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%t\t%s\t%s\n", info.Key, info.Size, info.LastModified.Format(time.RFC3339),
+				info.StorageClass, info.Encryption, retainUntil, info.LegalHold, formatPairs(tags), formatPairs(info.Metadata))
+		}
+
+		return w.Flush()
+	},
+}
+
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check that the S3 bucket has Object Lock enabled",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := destination.Open(cfg)
+		if err != nil {
+			return err
+		}
+
+		client, ok := store.(*s3.Client)
+		if !ok {
+			return fmt.Errorf("object lock is only supported by S3 destinations")
+		}
 
-		return backupSvc.BackupDirectory(context.Background(), source, sync, delete, nil)
+		status, err := client.GetObjectLockStatus(context.Background())
+		if err != nil {
+			return err
+		}
+		if !status.Enabled {
+			return fmt.Errorf("object lock is not enabled on the bucket")
+		}
+
+		fmt.Println("Object Lock is enabled")
+		if status.DefaultMode != "" {
+			fmt.Printf("Default retention: %s, %s\n", status.DefaultMode, status.DefaultRetention)
+		} else if cfg.AWS.ObjectLockMode == "" {
+			log.Warn().Msg("The bucket has no default retention and object_lock_mode is not set, backups will not be locked")
+		}
+		return nil
 	},
 }
 
+// formatPairs formats a map as sorted key=value pairs
+func formatPairs(m map[string]string) string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
 func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is /etc/backme/config.yaml)")
 
 	// Add command flags
 	dbBackupCmd.Flags().String("db-name", "", "name of the database to backup")
+	dbBackupCmd.Flags().Bool("dedup", false, "store the dump as deduplicated chunks")
 	_ = dbBackupCmd.MarkFlagRequired("db-name")
 
+	dbDownloadCmd.Flags().String("key", "", "S3 key of the dump to download")
+	dbDownloadCmd.Flags().String("output", "", "file to write the dump to")
+	_ = dbDownloadCmd.MarkFlagRequired("key")
+	_ = dbDownloadCmd.MarkFlagRequired("output")
+
 	dirBackupCmd.Flags().String("source", "", "source directory path")
+	dirBackupCmd.Flags().String("mode", config.DirectoryModeFiles, "backup mode: files (one object per file), archive (one tar.gz per run) or snapshot (content addressed with a manifest per run)")
 	dirBackupCmd.Flags().Bool("sync", false, "sync with S3 (only upload new or modified files)")
 	dirBackupCmd.Flags().Bool("delete", false, "delete files from S3 that don't exist locally (only works with --sync)")
+	dirBackupCmd.Flags().String("symlinks", config.SymlinksFollow, "how to handle symlinks: skip, preserve or follow")
+	dirBackupCmd.Flags().String("special-files", config.SpecialFilesSkip, "how to handle sockets, devices and FIFOs: skip or record")
+	dirBackupCmd.Flags().Bool("dedup", false, "store file content as deduplicated chunks (only works with --mode snapshot)")
+	dirBackupCmd.Flags().String("encryption-key-file", "", "file with the passphrase to encrypt the archive with (only works with --mode archive)")
 	_ = dirBackupCmd.MarkFlagRequired("source")
 
+	dirRestoreCmd.Flags().String("key", "", "S3 key of the archive to restore")
+	dirRestoreCmd.Flags().String("snapshot", "", "S3 key of the snapshot manifest to restore")
+	dirRestoreCmd.Flags().String("encryption-key-file", "", "file with the passphrase of an encrypted archive")
+	dirRestoreCmd.Flags().String("prefix", "", "S3 prefix of a files mode backup to restore (default is the directory prefix)")
+	dirRestoreCmd.Flags().String("as-of", "", "restore files mode backups as they were at this time (RFC 3339, requires a versioned bucket)")
+	dirRestoreCmd.Flags().String("target", "", "directory to restore into")
+	_ = dirRestoreCmd.MarkFlagRequired("target")
+
+	dirSnapshotsCmd.Flags().String("name", "", "only list snapshots of source directories with this name")
+
+	dirDiffCmd.Flags().String("from", "", "S3 key of the older snapshot manifest")
+	dirDiffCmd.Flags().String("to", "", "S3 key of the newer snapshot manifest")
+	_ = dirDiffCmd.MarkFlagRequired("from")
+	_ = dirDiffCmd.MarkFlagRequired("to")
+
+	listCmd.Flags().String("prefix", "", "only list objects whose key starts with this prefix")
+	listCmd.Flags().Bool("versions", false, "list every version and delete marker of versioned objects")
+	listCmd.Flags().Bool("details", false, "also show encryption, object lock, tags and metadata of every object")
+
 	// Add commands to root
 	rootCmd.AddCommand(dbCmd)
 	dbCmd.AddCommand(dbBackupCmd)
+	dbCmd.AddCommand(dbDownloadCmd)
 
 	rootCmd.AddCommand(dirCmd)
 	dirCmd.AddCommand(dirBackupCmd)
+	dirCmd.AddCommand(dirRestoreCmd)
+	dirCmd.AddCommand(dirSnapshotsCmd)
+	dirCmd.AddCommand(dirDiffCmd)
+
+	rootCmd.AddCommand(listCmd)
+	rootCmd.AddCommand(checkCmd)
 }
 
 func initConfig() error {
+	if err := configureViper(viper.GetViper()); err != nil {
+		return err
+	}
+
+	var err error
+	cfg, err = loadConfig(viper.GetViper())
+	return err
+}
+
+// configureViper points v at the config file and the environment
+func configureViper(v *viper.Viper) error {
 	if cfgFile != "" {
-		viper.SetConfigFile(cfgFile)
+		v.SetConfigFile(cfgFile)
 	} else {
 		configDir := "/etc/backme"
 		if err := os.MkdirAll(configDir, 0755); err != nil {
 			return fmt.Errorf("failed to create config directory: %w", err)
 		}
 
-		viper.AddConfigPath(configDir)
-		viper.SetConfigName("config")
-		viper.SetConfigType("yaml")
+		v.AddConfigPath(configDir)
+		v.SetConfigName("config")
+		v.SetConfigType("yaml")
 	}
 
-	viper.SetEnvPrefix("BACKUP_ME")
-	viper.AutomaticEnv()
+	v.SetEnvPrefix("BACKUP_ME")
+	v.AutomaticEnv()
+	return nil
+}
 
-	cfg = config.New()
+// loadConfig reads the config file into a new configuration
+func loadConfig(v *viper.Viper) (*config.Config, error) {
+	newCfg := config.New()
 
-	if err := viper.ReadInConfig(); err != nil {
+	if err := v.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
-			return fmt.Errorf("failed to read config file: %w", err)
+			return nil, fmt.Errorf("failed to read config file: %w", err)
 		}
 	}
 
-	if err := viper.Unmarshal(cfg); err != nil {
-		return fmt.Errorf("failed to unmarshal config: %w", err)
+	if err := v.Unmarshal(newCfg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 
-	return nil
+	return newCfg, nil
+}
+
+// reloadConfigFile reads the config file again with a viper instance of its
+// own, so that it doesn't share state with other users of the global one
+func reloadConfigFile() (*config.Config, error) {
+	v := viper.New()
+	if err := configureViper(v); err != nil {
+		return nil, err
+	}
+	return loadConfig(v)
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkkulhari/backme/internal/backup"
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/destination"
+	"github.com/pkkulhari/backme/internal/scheduler"
+	"github.com/spf13/cobra"
+)
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune <schedule>",
+	Short: "Delete the backups of a schedule that its retention doesn't keep",
+	Long: `Delete the database dumps or directory archives of a schedule that its retention doesn't keep, and print their keys.
+Backups are also pruned after every backup of a schedule with a retention.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		kind, _ := cmd.Flags().GetString("type")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		kind, err := scheduleKind(name, kind)
+		if err != nil {
+			return err
+		}
+
+		store, err := destination.Open(cfg)
+		if err != nil {
+			return err
+		}
+		backupSvc := backup.New(cfg, store)
+		manager := scheduler.NewScheduleManager(cfg)
+
+		var keys []string
+		switch kind {
+		case "database":
+			schedule, found := manager.GetDatabaseSchedule(name)
+			if !found {
+				return fmt.Errorf("database schedule '%s' not found", name)
+			}
+			keys, err = backupSvc.PruneDatabase(context.Background(), &schedule.Database, schedule.AWS, dryRun)
+		case "directory":
+			schedule, found := manager.GetDirectorySchedule(name)
+			if !found {
+				return fmt.Errorf("directory schedule '%s' not found", name)
+			}
+			if schedule.Mode != config.DirectoryModeArchive {
+				return fmt.Errorf("retention only applies to archive mode directory schedules")
+			}
+			keys, err = backupSvc.PruneArchives(context.Background(), &schedule.DirectoryConfig, schedule.AWS, dryRun)
+		default:
+			return fmt.Errorf("invalid schedule type: %s", kind)
+		}
+
+		for _, key := range keys {
+			fmt.Println(key)
+		}
+		return err
+	},
+}
+
+func init() {
+	pruneCmd.Flags().String("type", "", "schedule type if the name is ambiguous: database or directory")
+	pruneCmd.Flags().Bool("dry-run", false, "only print the backups that would be deleted")
+
+	rootCmd.AddCommand(pruneCmd)
+}
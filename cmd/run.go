@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/backup"
+	"github.com/pkkulhari/backme/internal/destination"
+	"github.com/pkkulhari/backme/internal/scheduler"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var runCmd = &cobra.Command{
+	Use:   "run <schedule>",
+	Short: "Run a configured schedule once",
+	Long: `Run a configured schedule once, with all of its settings.
+By default the backup runs in this process. With --worker, the running worker is asked to start it instead.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		kind, _ := cmd.Flags().GetString("type")
+		kind, err := scheduleKind(name, kind)
+		if err != nil {
+			return err
+		}
+
+		if useWorker, _ := cmd.Flags().GetBool("worker"); useWorker {
+			pidFile, _ := cmd.Flags().GetString("pidfile")
+			return requestWorkerRun(pidFile, kind, name)
+		}
+
+		// Interrupted backups clean up their temporary files and uploads
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		store, err := destination.Open(cfg)
+		if err != nil {
+			return err
+		}
+
+		backupSvcs := newBackupServices(backup.New(cfg, store))
+		defer backupSvcs.close()
+		dbBackupFunc, dirBackupFunc := backupFuncs(backupSvcs)
+
+		log.Info().Str("name", name).Msgf("Running %s backup", kind)
+		if err := scheduler.New(cfg).Run(ctx, kind, name, dbBackupFunc, dirBackupFunc); err != nil {
+			return err
+		}
+		log.Info().Str("name", name).Msgf("Completed %s backup", kind)
+		return nil
+	},
+}
+
+// runRequestWait is how long the worker may take to pick up a run request
+const runRequestWait = 10 * time.Second
+
+// requestWorkerRun asks the running worker to run a schedule
+func requestWorkerRun(pidFile, kind, name string) error {
+	running, err := signalWorker(pidFile, 0)
+	if err != nil {
+		return err
+	}
+	if !running {
+		return fmt.Errorf("no running worker found, run without --worker to run the backup here")
+	}
+
+	if err := scheduler.RequestRun(cfg.StateDir, kind, name); err != nil {
+		return fmt.Errorf("failed to request run: %w", err)
+	}
+	if _, err := signalWorker(pidFile, syscall.SIGUSR1); err != nil {
+		return err
+	}
+	if err := scheduler.AwaitRunRequest(context.Background(), cfg.StateDir, kind, name, runRequestWait); err != nil {
+		return err
+	}
+
+	log.Info().Str("name", name).Msg("Asked the running worker to run the backup, follow it with backme history")
+	return nil
+}
+
+func init() {
+	runCmd.Flags().String("type", "", "schedule type if the name is ambiguous: database or directory")
+	runCmd.Flags().Bool("worker", false, "ask the running worker to run the backup")
+	runCmd.Flags().String("pidfile", defaultPidFile, "PID file of the worker to ask with --worker")
+
+	rootCmd.AddCommand(runCmd)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunWithAWSOverrides(t *testing.T) {
+	global, override := t.TempDir(), t.TempDir()
+	source := filepath.Join(t.TempDir(), "docs")
+	require.NoError(t, os.MkdirAll(source, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(source, "notes.txt"), []byte("notes"), 0644))
+
+	// An archive left by an earlier run, which the schedule's retention prunes
+	old := filepath.Join(override, "documents", "docs_2020-01-01_00-00-00.tar.gz")
+	require.NoError(t, os.MkdirAll(filepath.Dir(old), 0755))
+	require.NoError(t, os.WriteFile(old, []byte("old"), 0644))
+
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte(fmt.Sprintf(`state_dir: %s
+aws:
+  destination: file://%s
+  directory_prefix: directory
+schedules:
+  directories:
+    - name: docs
+      expression: daily
+      source_path: %s
+      mode: archive
+      aws:
+        destination: file://%s
+        directory_prefix: documents
+        retention:
+          keep_last: 1
+`, t.TempDir(), global, source, override)), 0644))
+
+	rootCmd.SetArgs([]string{"run", "docs", "--config", configFile})
+	require.NoError(t, rootCmd.Execute())
+
+	archives, err := filepath.Glob(filepath.Join(override, "documents", "docs_*.tar.gz"))
+	require.NoError(t, err)
+	require.Len(t, archives, 1)
+	assert.NotEqual(t, old, archives[0])
+
+	entries, err := os.ReadDir(global)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
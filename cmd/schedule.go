@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/scheduler"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var scheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "Manage scheduled backups",
+	Long: `Manage the scheduled backups in the config file.
+A running worker is told to reload its configuration after every change.`,
+}
+
+var scheduleAddDBCmd = &cobra.Command{
+	Use:   "add-db",
+	Short: "Add or replace a database backup schedule",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		schedule, err := scheduleFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		flags := cmd.Flags()
+		schedule.Database.Host, _ = flags.GetString("db-host")
+		schedule.Database.Port, _ = flags.GetInt("db-port")
+		schedule.Database.User, _ = flags.GetString("db-user")
+		if schedule.Database.Password, err = dbPassword(cmd); err != nil {
+			return err
+		}
+		schedule.Database.Name, _ = flags.GetString("db-name")
+		schedule.Database.Dedup, _ = flags.GetBool("dedup")
+		if schedule.AWS != nil && flags.Changed("prefix") {
+			schedule.AWS.DatabasePrefix, _ = flags.GetString("prefix")
+		}
+
+		if err := scheduler.Validate(&config.Config{Schedules: config.Schedules{Databases: []config.DatabaseSchedule{schedule}}}); err != nil {
+			return err
+		}
+		if err := scheduler.NewScheduleManager(cfg).AddDatabaseSchedule(schedule); err != nil {
+			return err
+		}
+		return reloadWorker(cmd)
+	},
+}
+
+var scheduleAddDirCmd = &cobra.Command{
+	Use:   "add-dir",
+	Short: "Add or replace a directory backup schedule",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		common, err := scheduleFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		schedule := config.DirectorySchedule{
+			Name:       common.Name,
+			Expression: common.Expression,
+			Timezone:   common.Timezone,
+			Jitter:     common.Jitter,
+			CatchUp:    common.CatchUp,
+			Overlap:    common.Overlap,
+			Timeout:    common.Timeout,
+			Priority:   common.Priority,
+			Retry:      common.Retry,
+			AWS:        common.AWS,
+		}
+
+		flags := cmd.Flags()
+		schedule.SourcePath, _ = flags.GetString("source")
+		schedule.Mode, _ = flags.GetString("mode")
+		schedule.Sync, _ = flags.GetBool("sync")
+		schedule.Delete, _ = flags.GetBool("delete")
+		schedule.Symlinks, _ = flags.GetString("symlinks")
+		schedule.SpecialFiles, _ = flags.GetString("special-files")
+		schedule.Dedup, _ = flags.GetBool("dedup")
+		schedule.EncryptionKeyFile, _ = flags.GetString("encryption-key-file")
+		schedule.Debounce, _ = flags.GetDuration("debounce")
+		if schedule.AWS != nil && flags.Changed("prefix") {
+			schedule.AWS.DirectoryPrefix, _ = flags.GetString("prefix")
+		}
+
+		if err := scheduler.Validate(&config.Config{Schedules: config.Schedules{Directories: []config.DirectorySchedule{schedule}}}); err != nil {
+			return err
+		}
+		if err := scheduler.NewScheduleManager(cfg).AddDirectorySchedule(schedule); err != nil {
+			return err
+		}
+		return reloadWorker(cmd)
+	},
+}
+
+var scheduleRemoveCmd = &cobra.Command{
+	Use:   "remove <name>",
+	Short: "Remove a backup schedule",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		kind, _ := cmd.Flags().GetString("type")
+		kind, err := scheduleKind(args[0], kind)
+		if err != nil {
+			return err
+		}
+
+		if err := scheduler.NewScheduleManager(cfg).RemoveSchedule(args[0], kind); err != nil {
+			return err
+		}
+		return reloadWorker(cmd)
+	},
+}
+
+var scheduleListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the backup schedules",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manager := scheduler.NewScheduleManager(cfg)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TYPE\tNAME\tEXPRESSION\tTIMEZONE\tTARGET")
+		for _, s := range manager.ListDatabaseSchedules() {
+			fmt.Fprintf(w, "database\t%s\t%s\t%s\t%s\n", s.Name, s.Expression, s.Timezone, s.Database.Name)
+		}
+		for _, s := range manager.ListDirectorySchedules() {
+			fmt.Fprintf(w, "directory\t%s\t%s\t%s\t%s\n", s.Name, s.Expression, s.Timezone, s.SourcePath)
+		}
+		return w.Flush()
+	},
+}
+
+var scheduleShowCmd = &cobra.Command{
+	Use:   "show <name>",
+	Short: "Show the settings of a backup schedule",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		kind, _ := cmd.Flags().GetString("type")
+		kind, err := scheduleKind(args[0], kind)
+		if err != nil {
+			return err
+		}
+
+		manager := scheduler.NewScheduleManager(cfg)
+		var schedule any
+		var found bool
+		switch kind {
+		case "database":
+			schedule, found = manager.GetDatabaseSchedule(args[0])
+		case "directory":
+			schedule, found = manager.GetDirectorySchedule(args[0])
+		default:
+			return fmt.Errorf("invalid schedule type: %s", kind)
+		}
+		if !found {
+			return fmt.Errorf("schedule '%s' not found", args[0])
+		}
+
+		out, err := yaml.Marshal(redactSecrets(config.Encode(schedule)))
+		if err != nil {
+			return fmt.Errorf("failed to encode schedule: %w", err)
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	},
+}
+
+// scheduleFromFlags returns a database schedule with the settings shared by
+// both schedule types taken from the flags of cmd
+func scheduleFromFlags(cmd *cobra.Command) (config.DatabaseSchedule, error) {
+	flags := cmd.Flags()
+
+	var schedule config.DatabaseSchedule
+	schedule.Name, _ = flags.GetString("name")
+	schedule.Expression, _ = flags.GetString("expression")
+	schedule.Timezone, _ = flags.GetString("timezone")
+	schedule.Jitter, _ = flags.GetDuration("jitter")
+	schedule.CatchUp, _ = flags.GetString("catch-up")
+	schedule.Overlap, _ = flags.GetString("overlap")
+	schedule.Timeout, _ = flags.GetDuration("timeout")
+	schedule.Priority, _ = flags.GetInt("priority")
+
+	if flags.Changed("retry-attempts") || flags.Changed("retry-initial-backoff") || flags.Changed("retry-max-backoff") || flags.Changed("retry-jitter") {
+		schedule.Retry = &config.RetryConfig{}
+		schedule.Retry.MaxAttempts, _ = flags.GetInt("retry-attempts")
+		schedule.Retry.InitialBackoff, _ = flags.GetDuration("retry-initial-backoff")
+		schedule.Retry.MaxBackoff, _ = flags.GetDuration("retry-max-backoff")
+		schedule.Retry.Jitter, _ = flags.GetFloat64("retry-jitter")
+		if schedule.Retry.Jitter < 0 || schedule.Retry.Jitter > 1 {
+			return schedule, fmt.Errorf("--retry-jitter must be between 0 and 1")
+		}
+	}
+
+	// The prefix is set by the caller, as it depends on the schedule type
+	retention := flags.Changed("keep-last") || flags.Changed("max-age")
+	if flags.Changed("destination") || flags.Changed("bucket") || flags.Changed("region") || flags.Changed("prefix") || retention {
+		schedule.AWS = &config.AWSConfig{}
+		schedule.AWS.Destination, _ = flags.GetString("destination")
+		schedule.AWS.Bucket, _ = flags.GetString("bucket")
+		schedule.AWS.Region, _ = flags.GetString("region")
+	}
+	if retention {
+		schedule.AWS.Retention = &config.RetentionConfig{}
+		schedule.AWS.Retention.KeepLast, _ = flags.GetInt("keep-last")
+		schedule.AWS.Retention.MaxAge, _ = flags.GetDuration("max-age")
+	}
+
+	return schedule, nil
+}
+
+// dbPasswordEnv is the environment variable add-db reads the password from
+const dbPasswordEnv = "BACKUP_ME_DB_PASSWORD"
+
+// dbPassword returns the database password for a new schedule, read from
+// stdin with --db-password-stdin or else from the environment. It is never
+// taken from a flag, where it would show up in the process list and the
+// shell history.
+func dbPassword(cmd *cobra.Command) (string, error) {
+	if fromStdin, _ := cmd.Flags().GetBool("db-password-stdin"); !fromStdin {
+		return os.Getenv(dbPasswordEnv), nil
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read password from stdin: %w", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("no password given on stdin")
+	}
+	return password, nil
+}
+
+// secretKeys are the settings show leaves out
+var secretKeys = map[string]bool{
+	"password":          true,
+	"secret_access_key": true,
+	"sse_customer_key":  true,
+}
+
+// redactSecrets replaces passwords and keys in an encoded schedule, and
+// passwords in destination URLs, so that it can be printed
+func redactSecrets(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			switch {
+			case secretKeys[key]:
+				v[key] = "REDACTED"
+			case key == "destination" || key == "destinations":
+				v[key] = redactURLs(value)
+			default:
+				v[key] = redactSecrets(value)
+			}
+		}
+	case []any:
+		for i := range v {
+			v[i] = redactSecrets(v[i])
+		}
+	}
+	return v
+}
+
+func redactURLs(v any) any {
+	switch v := v.(type) {
+	case string:
+		if u, err := url.Parse(v); err == nil {
+			return u.Redacted()
+		}
+		return "REDACTED"
+	case []any:
+		for i := range v {
+			v[i] = redactURLs(v[i])
+		}
+	}
+	return v
+}
+
+// reloadWorker tells a running worker to reload its configuration
+func reloadWorker(cmd *cobra.Command) error {
+	pidFile, _ := cmd.Flags().GetString("pidfile")
+	running, err := signalWorker(pidFile, syscall.SIGHUP)
+	if err != nil {
+		return err
+	}
+	if !running {
+		log.Info().Msg("No running worker found, the change applies when the worker starts")
+		return nil
+	}
+	log.Info().Msg("Told the running worker to reload its configuration")
+	return nil
+}
+
+func addScheduleFlags(cmd *cobra.Command) {
+	cmd.Flags().String("name", "", "name of the schedule, an existing schedule of the same type and name is replaced")
+	cmd.Flags().String("expression", "", "cron expression, descriptor such as @daily, or one of daily, twice_daily or thrice_daily")
+	cmd.Flags().String("timezone", "", "time zone the expression is evaluated in (default is local time)")
+	cmd.Flags().Duration("jitter", 0, "delay each run by a random duration up to this window")
+	cmd.Flags().String("catch-up", "", "run missed by a stopped worker: once (default) or skip")
+	cmd.Flags().String("overlap", "", "run due while the previous one is in progress: skip (default), queue or cancel-previous")
+	cmd.Flags().Duration("timeout", 0, "time limit of each attempt (default is no limit)")
+	cmd.Flags().Int("priority", 0, "jobs with a higher priority start first when the worker limits concurrent jobs")
+
+	cmd.Flags().Int("retry-attempts", 0, "number of attempts of a failed run (default 3 when any retry flag is set)")
+	cmd.Flags().Duration("retry-initial-backoff", 0, "delay before the first retry, doubled after every attempt (default 30s)")
+	cmd.Flags().Duration("retry-max-backoff", 0, "longest delay between retries (default 10m)")
+	cmd.Flags().Float64("retry-jitter", 0, "vary each delay randomly by up to this fraction")
+
+	cmd.Flags().String("destination", "", "destination URL overriding the configured one")
+	cmd.Flags().String("bucket", "", "S3 bucket overriding the configured one")
+	cmd.Flags().String("region", "", "AWS region overriding the configured one")
+	cmd.Flags().String("prefix", "", "key prefix overriding the configured one")
+	cmd.Flags().Int("keep-last", 0, "keep this many of the newest dumps or archives when pruning")
+	cmd.Flags().Duration("max-age", 0, "keep dumps or archives younger than this when pruning")
+
+	_ = cmd.MarkFlagRequired("name")
+	_ = cmd.MarkFlagRequired("expression")
+}
+
+func init() {
+	scheduleCmd.PersistentFlags().String("pidfile", defaultPidFile, "PID file of the worker to reload after changes")
+
+	addScheduleFlags(scheduleAddDBCmd)
+	scheduleAddDBCmd.Flags().String("db-host", "", "database host (default is the configured one)")
+	scheduleAddDBCmd.Flags().Int("db-port", 0, "database port (default is the configured one)")
+	scheduleAddDBCmd.Flags().String("db-user", "", "database user (default is the configured one)")
+	scheduleAddDBCmd.Flags().Bool("db-password-stdin", false, "read the database password from stdin instead of "+dbPasswordEnv+" (default is the configured one)")
+	scheduleAddDBCmd.Flags().String("db-name", "", "name of the database to backup")
+	scheduleAddDBCmd.Flags().Bool("dedup", false, "store the dump as deduplicated chunks")
+	_ = scheduleAddDBCmd.MarkFlagRequired("db-name")
+
+	addScheduleFlags(scheduleAddDirCmd)
+	scheduleAddDirCmd.Flags().String("source", "", "source directory path")
+	scheduleAddDirCmd.Flags().String("mode", config.DirectoryModeFiles, "backup mode: files, archive, snapshot or watch")
+	scheduleAddDirCmd.Flags().Bool("sync", false, "only upload new or modified files")
+	scheduleAddDirCmd.Flags().Bool("delete", false, "delete files from S3 that don't exist locally (only works with --sync or --mode watch)")
+	scheduleAddDirCmd.Flags().String("symlinks", "", "how to handle symlinks: skip, preserve or follow (default follow)")
+	scheduleAddDirCmd.Flags().String("special-files", "", "how to handle sockets, devices and FIFOs: skip (default) or record")
+	scheduleAddDirCmd.Flags().Bool("dedup", false, "store file content as deduplicated chunks (only works with --mode snapshot)")
+	scheduleAddDirCmd.Flags().String("encryption-key-file", "", "file with the passphrase to encrypt archives with (only works with --mode archive)")
+	scheduleAddDirCmd.Flags().Duration("debounce", 0, "quiet period before changes are uploaded in watch mode (default 5s)")
+	_ = scheduleAddDirCmd.MarkFlagRequired("source")
+
+	scheduleRemoveCmd.Flags().String("type", "", "schedule type if the name is ambiguous: database or directory")
+	scheduleShowCmd.Flags().String("type", "", "schedule type if the name is ambiguous: database or directory")
+
+	scheduleCmd.AddCommand(scheduleAddDBCmd)
+	scheduleCmd.AddCommand(scheduleAddDirCmd)
+	scheduleCmd.AddCommand(scheduleRemoveCmd)
+	scheduleCmd.AddCommand(scheduleListCmd)
+	scheduleCmd.AddCommand(scheduleShowCmd)
+	rootCmd.AddCommand(scheduleCmd)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/history"
+	"github.com/pkkulhari/backme/internal/scheduler"
+	"github.com/pkkulhari/backme/internal/state"
+	"github.com/spf13/cobra"
+)
+
+// trendRuns is the number of successful runs the average duration is taken over
+const trendRuns = 10
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the latest runs and the next run of every schedule",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openHistory()
+		if err != nil {
+			return err
+		}
+		sched := scheduler.New(cfg)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SCHEDULE\tTYPE\tLAST SUCCESS\tLAST FAILURE\tNEXT RUN\tLAST DURATION\tAVG DURATION\tTREND")
+
+		for _, s := range scheduleRefs() {
+			runs, err := store.Runs(s.kind, s.name)
+			if err != nil {
+				return err
+			}
+
+			nextRun := "invalid schedule"
+			if next, err := sched.NextRun(s.expression, s.timezone); err == nil {
+				nextRun = next.Format(time.RFC3339)
+			}
+
+			lastSuccess, lastFailure, lastDuration := "never", "never", ""
+			if run := history.LastSuccess(runs); run != nil {
+				lastSuccess = run.End.Format(time.RFC3339)
+				lastDuration = run.Duration().Round(time.Second).String()
+			}
+			if run := history.LastFailure(runs); run != nil {
+				lastFailure = run.End.Format(time.RFC3339)
+			}
+			avgDuration, trend := durationTrend(runs)
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.name, s.kind, lastSuccess, lastFailure, nextRun, lastDuration, avgDuration, trend)
+		}
+
+		return w.Flush()
+	},
+}
+
+var historyCmd = &cobra.Command{
+	Use:   "history <schedule>",
+	Short: "Show the recorded runs of a schedule",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		kind, _ := cmd.Flags().GetString("type")
+		limit, _ := cmd.Flags().GetInt("limit")
+
+		kind, err := scheduleKind(name, kind)
+		if err != nil {
+			return err
+		}
+
+		store, err := openHistory()
+		if err != nil {
+			return err
+		}
+		runs, err := store.Runs(kind, name)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "START\tDURATION\tSTATUS\tFILES\tBYTES\tDETAILS")
+
+		// Newest first
+		slices.Reverse(runs)
+		if limit > 0 && len(runs) > limit {
+			runs = runs[:limit]
+		}
+		for _, run := range runs {
+			status, details := "success", strings.Join(run.Keys, ",")
+			switch {
+			case !run.Succeeded():
+				status, details = "failed", run.Error
+			case run.Partial():
+				status, details = "partial", "failed on "+strings.Join(slices.Sorted(maps.Keys(run.FailedDestinations)), ",")
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", run.Start.Format(time.RFC3339), run.Duration().Round(time.Second), status, run.Files, run.Bytes, details)
+		}
+
+		return w.Flush()
+	},
+}
+
+// scheduleRef identifies a configured schedule of either type
+type scheduleRef struct {
+	kind       string
+	name       string
+	expression string
+	timezone   string
+}
+
+func scheduleRefs() []scheduleRef {
+	var refs []scheduleRef
+	for _, s := range cfg.Schedules.Databases {
+		refs = append(refs, scheduleRef{kind: "database", name: s.Name, expression: s.Expression, timezone: s.Timezone})
+	}
+	for _, s := range cfg.Schedules.Directories {
+		refs = append(refs, scheduleRef{kind: "directory", name: s.Name, expression: s.Expression, timezone: s.Timezone})
+	}
+	return refs
+}
+
+// scheduleKind returns the type of the schedule called name. An empty kind
+// is resolved from the configured schedules.
+func scheduleKind(name, kind string) (string, error) {
+	if kind != "" {
+		return kind, nil
+	}
+
+	var kinds []string
+	for _, s := range scheduleRefs() {
+		if s.name == name {
+			kinds = append(kinds, s.kind)
+		}
+	}
+	switch len(kinds) {
+	case 0:
+		return "", fmt.Errorf("schedule '%s' not found", name)
+	case 1:
+		return kinds[0], nil
+	default:
+		return "", fmt.Errorf("both a database and a directory schedule are named '%s', choose one with --type", name)
+	}
+}
+
+func openHistory() (*history.Store, error) {
+	store, err := state.Open(cfg.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	return history.New(store), nil
+}
+
+// durationTrend returns the average duration of the latest successful runs
+// and how the last of them compares to the ones before
+func durationTrend(runs []history.Run) (string, string) {
+	var durations []time.Duration
+	for i := len(runs) - 1; i >= 0 && len(durations) < trendRuns; i-- {
+		if runs[i].Succeeded() {
+			durations = append(durations, runs[i].Duration())
+		}
+	}
+	if len(durations) == 0 {
+		return "", ""
+	}
+
+	var total time.Duration
+	for _, d := range durations {
+		total += d
+	}
+	avg := (total / time.Duration(len(durations))).Round(time.Second).String()
+	if len(durations) < 2 {
+		return avg, ""
+	}
+
+	previous := (total - durations[0]) / time.Duration(len(durations)-1)
+	if previous <= 0 {
+		return avg, ""
+	}
+	change := float64(durations[0]-previous) / float64(previous) * 100
+	return avg, fmt.Sprintf("%+.0f%%", change)
+}
+
+func init() {
+	historyCmd.Flags().String("type", "", "schedule type if the name is ambiguous: database or directory")
+	historyCmd.Flags().Int("limit", 20, "number of runs to show, newest first (0 shows all)")
+
+	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(historyCmd)
+}
@@ -2,76 +2,444 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/pkkulhari/backme/internal/backup"
 	"github.com/pkkulhari/backme/internal/config"
-	"github.com/pkkulhari/backme/internal/s3"
+	"github.com/pkkulhari/backme/internal/destination"
 	"github.com/pkkulhari/backme/internal/scheduler"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
+// defaultPidFile is where the worker records its PID for commands that
+// notify it of configuration changes
+const defaultPidFile = "/run/backme/backme.pid"
+
 var workerCmd = &cobra.Command{
 	Use:   "worker",
 	Short: "Start the backme worker process",
-	Long:  `Start the backme worker process that runs in the background and executes scheduled backups`,
+	Long: `Start the backme worker process that runs in the background and executes scheduled backups.
+The configuration is reloaded on SIGHUP, and with --watch-config whenever the config file changes.
+On SIGUSR1, the schedules requested with "backme run --worker" are run.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		// Create a background context
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
 
-		s3Client, err := s3.New(cfg, nil)
+		store, err := destination.Open(cfg)
 		if err != nil {
-			return fmt.Errorf("failed to initialize S3 client: %w", err)
+			return fmt.Errorf("failed to initialize storage: %w", err)
 		}
-		backupSvc := backup.New(cfg, s3Client)
+
+		// Runs always use the service of the latest configuration, while
+		// runs in progress keep the one they started with
+		backupSvcs := newBackupServices(backup.New(cfg, store))
+		defer backupSvcs.close()
 
 		sched := scheduler.New(cfg)
 
+		pidFile, _ := cmd.Flags().GetString("pidfile")
+		if err := writePidFile(pidFile); err != nil {
+			log.Warn().Err(err).Msg("Failed to write PID file, the schedule and run commands won't reach this worker")
+		} else {
+			defer os.Remove(pidFile)
+		}
+
 		log.Info().Msg("Starting backme worker process")
-		if err := sched.Start(ctx,
-			func(ctx context.Context, cfg any) error {
-				// Handle database backups
-				dbConfig, ok := cfg.(struct {
-					config.DatabaseConfig
-					AWS *config.AWSConfig
-				})
-				if !ok {
-					return fmt.Errorf("invalid database configuration in scheduler")
-				}
-				return backupSvc.BackupDatabase(ctx, &dbConfig.DatabaseConfig, dbConfig.AWS)
-			},
-			func(ctx context.Context, cfg any) error {
-				// Handle directory backups
-				dirConfig, ok := cfg.(struct {
-					config.DirectorySchedule
-					AWS *config.AWSConfig
-				})
-				if !ok {
-					return fmt.Errorf("invalid directory configuration in scheduler")
-				}
-				return backupSvc.BackupDirectory(ctx, dirConfig.SourcePath, dirConfig.Sync, dirConfig.Delete, dirConfig.AWS)
-			},
-		); err != nil {
+		dbBackupFunc, dirBackupFunc := backupFuncs(backupSvcs)
+		if err := sched.Start(ctx, dbBackupFunc, dirBackupFunc); err != nil {
 			return fmt.Errorf("failed to start scheduler: %w", err)
 		}
 
-		// Setup signal handling for graceful shutdown
+		// Watched directories are kept up to date continuously, their cron
+		// schedule only triggers periodic full reconciliation
+		watchers := &directoryWatchers{ctx: ctx, sched: sched, backupSvcs: backupSvcs, running: make(map[string]*runningWatcher)}
+		watchers.update(cfg.Schedules.Directories, false)
+
+		reloadChan := make(chan struct{}, 1)
+		if watch, _ := cmd.Flags().GetBool("watch-config"); watch {
+			if err := watchConfigFile(ctx, viper.ConfigFileUsed(), reloadChan); err != nil {
+				log.Warn().Err(err).Msg("Failed to watch the config file, reload with SIGHUP instead")
+			}
+		}
+
+		// Setup signal handling for graceful shutdown, reloads and run requests
 		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-		<-sigChan
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+
+	loop:
+		for {
+			select {
+			case sig := <-sigChan:
+				switch sig {
+				case syscall.SIGHUP:
+					reloadConfig(sched, backupSvcs, watchers)
+				case syscall.SIGUSR1:
+					sched.RunRequested()
+				default:
+					break loop
+				}
+			case <-reloadChan:
+				reloadConfig(sched, backupSvcs, watchers)
+			}
+		}
 
 		log.Info().Msg("Stopping backme worker process")
+		cancel()
 		sched.Stop()
 		return nil
 	},
 }
 
+// backupFuncs returns the functions running the backups of database and
+// directory schedules with the current backup service
+func backupFuncs(backupSvcs *backupServices) (scheduler.BackupFunc, scheduler.BackupFunc) {
+	dbBackupFunc := func(ctx context.Context, cfg any) error {
+		// Handle database backups
+		dbConfig, ok := cfg.(struct {
+			config.DatabaseConfig
+			AWS *config.AWSConfig
+		})
+		if !ok {
+			return fmt.Errorf("invalid database configuration in scheduler")
+		}
+		backupSvc, release := backupSvcs.acquire()
+		defer release()
+		return backupSvc.BackupDatabase(ctx, &dbConfig.DatabaseConfig, dbConfig.AWS)
+	}
+	dirBackupFunc := func(ctx context.Context, cfg any) error {
+		// Handle directory backups
+		dirConfig, ok := cfg.(struct {
+			config.DirectorySchedule
+			AWS *config.AWSConfig
+		})
+		if !ok {
+			return fmt.Errorf("invalid directory configuration in scheduler")
+		}
+		backupSvc, release := backupSvcs.acquire()
+		defer release()
+		return backupSvc.BackupDirectory(ctx, &dirConfig.DirectoryConfig, dirConfig.AWS)
+	}
+	return dbBackupFunc, dirBackupFunc
+}
+
+// backupServices hands out the backup service of the latest configuration.
+// A replaced service is closed once the runs and watchers using it finished.
+type backupServices struct {
+	mu      sync.Mutex
+	current *backup.Service
+	users   map[*backup.Service]int
+}
+
+func newBackupServices(backupSvc *backup.Service) *backupServices {
+	return &backupServices{current: backupSvc, users: make(map[*backup.Service]int)}
+}
+
+// acquire returns the current service and a function to call once it is no
+// longer used
+func (s *backupServices) acquire() (*backup.Service, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	backupSvc := s.current
+	s.users[backupSvc]++
+	var once sync.Once
+	return backupSvc, func() { once.Do(func() { s.release(backupSvc) }) }
+}
+
+func (s *backupServices) release(backupSvc *backup.Service) {
+	s.mu.Lock()
+	s.users[backupSvc]--
+	unused := s.users[backupSvc] == 0
+	if unused {
+		delete(s.users, backupSvc)
+	}
+	replaced := backupSvc != s.current
+	s.mu.Unlock()
+
+	if unused && replaced {
+		closeService(backupSvc)
+	}
+}
+
+// replace makes backupSvc the current service. With a nil backupSvc, as
+// when the worker stops, no service is handed out anymore.
+func (s *backupServices) replace(backupSvc *backup.Service) {
+	s.mu.Lock()
+	old := s.current
+	s.current = backupSvc
+	unused := s.users[old] == 0
+	s.mu.Unlock()
+
+	if unused {
+		closeService(old)
+	}
+}
+
+// close closes the current service once the runs using it finished
+func (s *backupServices) close() {
+	s.replace(nil)
+}
+
+func closeService(backupSvc *backup.Service) {
+	if backupSvc == nil {
+		return
+	}
+	if err := backupSvc.Close(); err != nil {
+		log.Warn().Err(err).Msg("Failed to close storage")
+	}
+}
+
+// reloadConfig re-reads the config file and applies it to the running
+// worker. An invalid configuration is rejected and the current one is kept.
+func reloadConfig(sched *scheduler.Scheduler, backupSvcs *backupServices, watchers *directoryWatchers) {
+	log.Info().Msg("Reloading configuration")
+
+	newCfg, err := reloadConfigFile()
+	if err == nil {
+		err = scheduler.Validate(newCfg)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid configuration, keeping the current one")
+		return
+	}
+
+	store, err := destination.Open(newCfg)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to initialize storage, keeping the current configuration")
+		return
+	}
+
+	backupSvc := backup.New(newCfg, store)
+	if err := sched.Reload(newCfg); err != nil {
+		log.Error().Err(err).Msg("Invalid configuration, keeping the current one")
+		closeService(backupSvc)
+		return
+	}
+	backupSvcs.replace(backupSvc)
+
+	// Watchers keep the service they started with, so they are restarted
+	// when settings outside the schedules changed
+	oldGlobals, newGlobals := *cfg, *newCfg
+	oldGlobals.Schedules, newGlobals.Schedules = config.Schedules{}, config.Schedules{}
+	watchers.update(newCfg.Schedules.Directories, !reflect.DeepEqual(oldGlobals, newGlobals))
+
+	cfg = newCfg
+	setLogLevel(cfg.LogLevel)
+	log.Info().Msg("Reloaded configuration")
+}
+
+func writePidFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write PID file: %w", err)
+	}
+	return nil
+}
+
+// signalWorker sends sig to the worker whose PID is recorded in pidFile. It
+// returns false if no worker is running.
+func signalWorker(pidFile string, sig syscall.Signal) (bool, error) {
+	data, err := os.ReadFile(pidFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read PID file: %w", err)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return false, fmt.Errorf("invalid PID file %s: %w", pidFile, err)
+	}
+
+	// A stale PID file is left behind if the worker was killed
+	if err := syscall.Kill(pid, sig); err != nil {
+		if err == syscall.ESRCH {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to signal worker: %w", err)
+	}
+	return true, nil
+}
+
+// watchConfigFile sends to changed whenever the config file at path is
+// written or replaced, until ctx is done. The directory is watched, since
+// editors and configuration management often replace the file.
+func watchConfigFile(ctx context.Context, path string, changed chan<- struct{}) error {
+	if path == "" {
+		return fmt.Errorf("no config file in use")
+	}
+	path = filepath.Clean(path)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch config directory: %w", err)
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event := <-watcher.Events:
+				if filepath.Clean(event.Name) != path || !event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+					continue
+				}
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			case err := <-watcher.Errors:
+				log.Warn().Err(err).Msg("Error watching the config file")
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Backoff between restarts of a failed directory watcher
+const (
+	watchRestartDelay    = 5 * time.Second
+	maxWatchRestartDelay = 5 * time.Minute
+)
+
+// directoryWatchers runs a watcher for every directory schedule in watch mode
+type directoryWatchers struct {
+	ctx        context.Context
+	sched      *scheduler.Scheduler
+	backupSvcs *backupServices
+
+	// restartDelay replaces watchRestartDelay if set
+	restartDelay time.Duration
+
+	mu      sync.Mutex
+	running map[string]*runningWatcher
+}
+
+type runningWatcher struct {
+	schedule config.DirectorySchedule
+	cancel   context.CancelFunc
+}
+
+// update starts watchers for new schedules and restarts those whose schedule
+// changed. With restartAll, every watcher is restarted.
+func (w *directoryWatchers) update(schedules []config.DirectorySchedule, restartAll bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	desired := make(map[string]config.DirectorySchedule)
+	for _, schedule := range schedules {
+		if schedule.Mode == config.DirectoryModeWatch {
+			desired[schedule.Name] = schedule
+		}
+	}
+
+	for name, watcher := range w.running {
+		if schedule, ok := desired[name]; ok && !restartAll && reflect.DeepEqual(schedule, watcher.schedule) {
+			continue
+		}
+		watcher.cancel()
+		delete(w.running, name)
+	}
+
+	for name, schedule := range desired {
+		if _, ok := w.running[name]; ok {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(w.ctx)
+		watcher := &runningWatcher{schedule: schedule, cancel: cancel}
+		w.running[name] = watcher
+		go w.watch(ctx, watcher)
+	}
+}
+
+// watch runs the watcher of a schedule until ctx is cancelled. Its syncs
+// share the schedule's run guard with the scheduled full syncs. A watcher
+// that fails is restarted with backoff, unless its configuration is invalid,
+// in which case it is removed until the configuration is reloaded.
+func (w *directoryWatchers) watch(ctx context.Context, watcher *runningWatcher) {
+	schedule := watcher.schedule
+	guard := func(ctx context.Context, fn func(ctx context.Context)) {
+		w.sched.RunGuarded(ctx, "directory", schedule.Name, "sync of changed files", fn)
+	}
+
+	initialDelay := w.restartDelay
+	if initialDelay <= 0 {
+		initialDelay = watchRestartDelay
+	}
+	delay := initialDelay
+
+	for {
+		backupSvc, release := w.backupSvcs.acquire()
+		started := time.Now()
+		err := backupSvc.WatchDirectory(ctx, &schedule.DirectoryConfig, schedule.AWS, guard)
+		release()
+		if ctx.Err() != nil {
+			return
+		}
+
+		if errors.Is(err, config.ErrInvalid) {
+			log.Error().Err(err).
+				Str("name", schedule.Name).
+				Str("source", schedule.SourcePath).
+				Msg("Failed to watch directory, stopping until the configuration is reloaded")
+			w.remove(schedule.Name, watcher)
+			return
+		}
+
+		// A watcher that ran for a while failed for a new reason
+		if time.Since(started) > maxWatchRestartDelay {
+			delay = initialDelay
+		}
+		log.Error().Err(err).
+			Str("name", schedule.Name).
+			Str("source", schedule.SourcePath).
+			Msgf("Failed to watch directory, restarting in %s", delay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxWatchRestartDelay)
+	}
+}
+
+// remove stops watcher unless it was already replaced by update
+func (w *directoryWatchers) remove(name string, watcher *runningWatcher) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.running[name] == watcher {
+		watcher.cancel()
+		delete(w.running, name)
+	}
+}
+
 func init() {
-	workerCmd.Flags().String("pidfile", "/var/run/backme.pid", "Path to PID file")
+	workerCmd.Flags().String("pidfile", defaultPidFile, "Path to PID file")
+	workerCmd.Flags().Bool("watch-config", false, "reload the configuration whenever the config file changes")
 	rootCmd.AddCommand(workerCmd)
 }
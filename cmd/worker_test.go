@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/backup"
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/destination"
+	"github.com/pkkulhari/backme/internal/scheduler"
+	"github.com/pkkulhari/backme/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// closingStorage records whether it was closed
+type closingStorage struct {
+	storage.Storage
+	closed bool
+}
+
+func (c *closingStorage) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestBackupServicesCloseReplaced(t *testing.T) {
+	oldStore, newStore := &closingStorage{}, &closingStorage{}
+	backupSvcs := newBackupServices(backup.New(&config.Config{}, oldStore))
+
+	// A run in progress keeps the replaced service open until it finished
+	_, release := backupSvcs.acquire()
+	backupSvcs.replace(backup.New(&config.Config{}, newStore))
+	assert.False(t, oldStore.closed)
+
+	release()
+	release()
+	assert.True(t, oldStore.closed)
+
+	// The current service isn't closed when its last run finished
+	_, release = backupSvcs.acquire()
+	release()
+	assert.False(t, newStore.closed)
+
+	_, release = backupSvcs.acquire()
+	backupSvcs.close()
+	assert.False(t, newStore.closed)
+	release()
+	assert.True(t, newStore.closed)
+}
+
+func TestDirectoryWatcherRestarts(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "docs")
+	dest := t.TempDir()
+	cfg := &config.Config{StateDir: t.TempDir(), AWS: config.AWSConfig{Destination: "file://" + dest, DirectoryPrefix: "docs"}}
+	store, err := destination.Open(cfg)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watchers := &directoryWatchers{
+		ctx:          ctx,
+		sched:        scheduler.New(cfg),
+		backupSvcs:   newBackupServices(backup.New(cfg, store)),
+		restartDelay: 10 * time.Millisecond,
+		running:      make(map[string]*runningWatcher),
+	}
+
+	// The source directory doesn't exist yet, for example because it is
+	// mounted later, so the watcher is restarted until it does
+	watchers.update([]config.DirectorySchedule{{Name: "docs", DirectoryConfig: config.DirectoryConfig{SourcePath: source, Mode: config.DirectoryModeWatch}}}, false)
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, os.MkdirAll(source, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(source, "notes.txt"), []byte("notes"), 0644))
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dest, "docs", "notes.txt"))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A watcher with an invalid configuration is removed
+	watchers.update([]config.DirectorySchedule{{Name: "docs", DirectoryConfig: config.DirectoryConfig{SourcePath: source, Mode: config.DirectoryModeWatch, Symlinks: "bogus"}}}, false)
+	require.Eventually(t, func() bool {
+		watchers.mu.Lock()
+		defer watchers.mu.Unlock()
+		return len(watchers.running) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -132,6 +132,9 @@ Type=simple
 User=backme
 Group=backme
 ExecStart=$INSTALL_DIR/backme worker
+ExecReload=/bin/kill -HUP \$MAINPID
+StateDirectory=backme
+RuntimeDirectory=backme
 Restart=always
 RestartSec=3
 
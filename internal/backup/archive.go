@@ -0,0 +1,313 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/encryption"
+	"github.com/pkkulhari/backme/internal/history"
+	"github.com/pkkulhari/backme/internal/s3"
+	"github.com/rs/zerolog/log"
+)
+
+// backupDirectoryArchive writes the whole directory as a single gzip
+// compressed tar archive, optionally encrypted, and uploads it as one
+// timestamped object
+func (s *Service) backupDirectoryArchive(ctx context.Context, targets []target, dirCfg *config.DirectoryConfig, awsCfg *config.AWSConfig) error {
+	sourcePath := dirCfg.SourcePath
+
+	var passphrase []byte
+	if dirCfg.EncryptionKeyFile != "" {
+		var err error
+		if passphrase, err = encryption.ReadKeyFile(dirCfg.EncryptionKeyFile); err != nil {
+			return config.Invalid(err)
+		}
+	}
+
+	// Create a temporary file for the archive
+	tmpFile, err := os.CreateTemp("", "backme_archive_*.tar.gz")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	name := archiveName(sourcePath)
+	prefix := s.directoryPrefix(awsCfg)
+	key := s3.GetObjectKey(prefix, fmt.Sprintf("%s_%s.tar.gz", name, time.Now().Format(backupTimeFormat)))
+
+	if passphrase == nil {
+		err = writeArchive(ctx, tmpFile, dirCfg)
+	} else {
+		key += encryption.Extension
+		err = writeEncryptedArchive(ctx, tmpFile, passphrase, dirCfg)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %w", err)
+	}
+	err = s.replicate(ctx, awsCfg, targets, func(t target) error {
+		if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind archive file: %w", err)
+		}
+		if err := t.storage.Upload(ctx, key, tmpFile); err != nil {
+			return fmt.Errorf("failed to upload archive to S3: %w", err)
+		}
+		if info, err := tmpFile.Stat(); err == nil {
+			history.StatsFrom(ctx).AddFile(key, info.Size())
+		}
+		history.StatsFrom(ctx).AddKey(key)
+		s.applyRetention(ctx, t.storage, awsCfg, prefix, name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Successfully backed up directory %s to S3 as %s", sourcePath, key)
+	return nil
+}
+
+func writeArchive(ctx context.Context, w io.Writer, dirCfg *config.DirectoryConfig) error {
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+
+	err := walkDirectory(dirCfg.SourcePath, dirCfg.Symlinks, dirCfg.SpecialFiles, func(entry walkEntry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return writeArchiveEntry(tw, entry)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gzw.Close()
+}
+
+func writeEncryptedArchive(ctx context.Context, w io.Writer, passphrase []byte, dirCfg *config.DirectoryConfig) error {
+	ew, err := encryption.NewWriter(w, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := writeArchive(ctx, ew, dirCfg); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+func writeArchiveEntry(tw *tar.Writer, entry walkEntry) error {
+	if entry.kind == entrySpecial && entry.info.Mode()&os.ModeSocket != 0 {
+		log.Debug().Msgf("Skipping socket in archive: %s", entry.relPath)
+		return nil
+	}
+
+	hdr, err := tar.FileInfoHeader(entry.info, entry.linkTarget)
+	if err != nil {
+		return fmt.Errorf("failed to create tar header for %s: %w", entry.path, err)
+	}
+	hdr.Name = filepath.ToSlash(entry.relPath)
+
+	if entry.kind == entryHardlink {
+		hdr.Typeflag = tar.TypeLink
+		hdr.Linkname = filepath.ToSlash(entry.linkTarget)
+		hdr.Size = 0
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write tar header for %s: %w", entry.path, err)
+	}
+
+	if entry.kind != entryFile {
+		return nil
+	}
+
+	file, err := os.Open(entry.path)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", entry.path, err)
+	}
+	defer file.Close()
+
+	if _, err := io.CopyN(tw, file, hdr.Size); err != nil {
+		return fmt.Errorf("failed to add file %s to archive: %w", entry.path, err)
+	}
+
+	log.Debug().Msgf("Archived file: %s", entry.relPath)
+	return nil
+}
+
+// RestoreArchive downloads a directory archive and extracts it into
+// targetPath. Encrypted archives are decrypted with the passphrase in keyFile.
+func (s *Service) RestoreArchive(ctx context.Context, key string, targetPath string, keyFile string, awsCfg *config.AWSConfig) error {
+	log.Info().Msgf("Restoring archive %s to %s", key, targetPath)
+
+	var passphrase []byte
+	if strings.HasSuffix(key, encryption.Extension) {
+		if keyFile == "" {
+			return fmt.Errorf("archive %s is encrypted, an encryption key file is required", key)
+		}
+		var err error
+		if passphrase, err = encryption.ReadKeyFile(keyFile); err != nil {
+			return err
+		}
+	}
+
+	backend, err := s.getStorageForConfig(awsCfg)
+	if err != nil {
+		return fmt.Errorf("failed to open storage: %w", err)
+	}
+	defer s.releaseStorage(backend)
+
+	body, err := backend.Download(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to download archive: %w", err)
+	}
+	defer body.Close()
+
+	var r io.Reader = body
+	if passphrase != nil {
+		if r, err = encryption.NewReader(body, passphrase); err != nil {
+			return fmt.Errorf("failed to decrypt archive: %w", err)
+		}
+	}
+
+	if err := extractArchive(r, targetPath); err != nil {
+		return fmt.Errorf("failed to extract archive: %w", err)
+	}
+
+	log.Info().Msgf("Successfully restored archive %s to %s", key, targetPath)
+	return nil
+}
+
+func extractArchive(r io.Reader, targetPath string) error {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		path, err := restorePath(targetPath, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", path, err)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, hdr.FileInfo().Mode().Perm()); err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", path, err)
+			}
+
+		case tar.TypeReg:
+			if err := extractFile(tr, path, hdr); err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			os.Remove(path)
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return fmt.Errorf("failed to create symlink %s: %w", path, err)
+			}
+
+		case tar.TypeLink:
+			target, err := restorePath(targetPath, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			os.Remove(path)
+			if err := os.Link(target, path); err != nil {
+				return fmt.Errorf("failed to create hardlink %s: %w", path, err)
+			}
+
+		case tar.TypeFifo:
+			os.Remove(path)
+			if err := syscall.Mkfifo(path, uint32(hdr.Mode&0777)); err != nil {
+				return fmt.Errorf("failed to create FIFO %s: %w", path, err)
+			}
+
+		default:
+			log.Warn().Msgf("Skipping unsupported archive entry %s", hdr.Name)
+		}
+	}
+}
+
+func extractFile(r io.Reader, path string, hdr *tar.Header) error {
+	file, err := createFile(path, hdr.FileInfo().Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", path, err)
+	}
+
+	if err := os.Chtimes(path, hdr.ModTime, hdr.ModTime); err != nil {
+		return fmt.Errorf("failed to set modification time of %s: %w", path, err)
+	}
+
+	log.Debug().Msgf("Restored file: %s", hdr.Name)
+	return nil
+}
+
+// restorePath joins name onto targetPath and rejects names escaping it,
+// either by their path or through a symlink restored earlier. Symlinks are
+// restored with any target, but nothing is ever written through them.
+func restorePath(targetPath, name string) (string, error) {
+	path := filepath.Join(targetPath, filepath.FromSlash(name))
+	rel, err := filepath.Rel(targetPath, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("refusing to restore %s outside of %s", name, targetPath)
+	}
+
+	dir := targetPath
+	for _, part := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if err != nil {
+			// Missing directories are created by the caller
+			break
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to restore %s through symlink %s", name, dir)
+		}
+	}
+	return path, nil
+}
+
+// createFile creates or truncates the regular file at path. A symlink at
+// path is replaced instead of being followed.
+func createFile(path string, perm os.FileMode) (*os.File, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|syscall.O_NOFOLLOW, perm)
+}
@@ -0,0 +1,104 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/encryption"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tarball returns a gzip compressed tar of the given headers, where regular
+// files contain their name
+func tarball(t *testing.T, headers ...*tar.Header) *bytes.Buffer {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for _, hdr := range headers {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(hdr.Name))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gzw.Close())
+	return &buf
+}
+
+func TestExtractArchiveSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	secret := filepath.Join(outside, "secret")
+	require.NoError(t, os.WriteFile(secret, []byte("keep"), 0644))
+
+	t.Run("write through directory symlink", func(t *testing.T) {
+		archive := tarball(t,
+			&tar.Header{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: outside},
+			&tar.Header{Name: "escape/pwned", Typeflag: tar.TypeReg, Mode: 0644},
+		)
+		err := extractArchive(archive, t.TempDir())
+		assert.ErrorContains(t, err, "through symlink")
+		assert.NoFileExists(t, filepath.Join(outside, "pwned"))
+	})
+
+	t.Run("write to file symlink", func(t *testing.T) {
+		target := t.TempDir()
+		archive := tarball(t,
+			&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: secret},
+			&tar.Header{Name: "link", Typeflag: tar.TypeReg, Mode: 0644},
+		)
+		require.NoError(t, extractArchive(archive, target))
+
+		content, err := os.ReadFile(secret)
+		require.NoError(t, err)
+		assert.Equal(t, "keep", string(content))
+		info, err := os.Lstat(filepath.Join(target, "link"))
+		require.NoError(t, err)
+		assert.True(t, info.Mode().IsRegular())
+	})
+
+	t.Run("symlink outside is restored", func(t *testing.T) {
+		target := t.TempDir()
+		require.NoError(t, extractArchive(tarball(t, &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: secret}), target))
+		link, err := os.Readlink(filepath.Join(target, "link"))
+		require.NoError(t, err)
+		assert.Equal(t, secret, link)
+	})
+}
+
+func TestEncryptedArchive(t *testing.T) {
+	ctx := context.Background()
+	backend := newMemoryStorage()
+	s := New(&config.Config{StateDir: t.TempDir()}, backend)
+
+	keyFile := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(keyFile, []byte("passphrase\n"), 0600))
+
+	source := t.TempDir()
+	writeFiles(t, source, map[string]string{"a.txt": "a", "sub/b.txt": "b"})
+	dirCfg := &config.DirectoryConfig{SourcePath: source, Mode: config.DirectoryModeArchive, EncryptionKeyFile: keyFile}
+	require.NoError(t, s.BackupDirectory(ctx, dirCfg, nil))
+
+	keys := backend.keys()
+	require.Len(t, keys, 1)
+	assert.True(t, strings.HasSuffix(keys[0], ".tar.gz"+encryption.Extension))
+
+	assert.ErrorContains(t, s.RestoreArchive(ctx, keys[0], t.TempDir(), "", nil), "encryption key file is required")
+
+	target := t.TempDir()
+	require.NoError(t, s.RestoreArchive(ctx, keys[0], target, keyFile, nil))
+	content, err := os.ReadFile(filepath.Join(target, "sub/b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(content))
+}
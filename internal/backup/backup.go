@@ -2,43 +2,79 @@ package backup
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/destination"
+	"github.com/pkkulhari/backme/internal/history"
 	"github.com/pkkulhari/backme/internal/s3"
+	"github.com/pkkulhari/backme/internal/state"
+	"github.com/pkkulhari/backme/internal/storage"
 	"github.com/rs/zerolog/log"
 )
 
+// pgDumpStopTimeout is how long a cancelled pg_dump may take to exit
+const pgDumpStopTimeout = 10 * time.Second
+
+// Object metadata keys describing the entries of files mode backups
+const (
+	metaType       = "backme-type"
+	metaLinkTarget = "backme-link-target"
+	metaMode       = "backme-mode"
+	metaModTime    = "backme-mtime"
+)
+
 type Service struct {
-	cfg      *config.Config
-	s3Client *s3.Client
+	cfg     *config.Config
+	storage storage.Storage
+
+	stateOnce  sync.Once
+	stateStore *state.Store
 }
 
-func New(cfg *config.Config, s3Client *s3.Client) *Service {
+func New(cfg *config.Config, storage storage.Storage) *Service {
 	return &Service{
-		cfg:      cfg,
-		s3Client: s3Client,
+		cfg:     cfg,
+		storage: storage,
+	}
+}
+
+// Close closes the service's storage, such as the connection to an SFTP
+// server. Backups must not use the service afterwards.
+func (s *Service) Close() error {
+	if closer, ok := s.storage.(io.Closer); ok {
+		return closer.Close()
 	}
+	return nil
 }
 
-func (s *Service) getS3ClientForConfig(awsCfg *config.AWSConfig) (*s3.Client, error) {
+func (s *Service) getStorageForConfig(awsCfg *config.AWSConfig) (storage.Storage, error) {
 	if awsCfg == nil {
-		return s.s3Client, nil
+		return s.storage, nil
 	}
+	return destination.Open(s.getAWSConfigForConfig(awsCfg))
+}
 
+// getAWSConfigForConfig returns the global configuration with the AWS
+// settings of awsCfg applied on top
+func (s *Service) getAWSConfigForConfig(awsCfg *config.AWSConfig) *config.Config {
 	newCfg := &config.Config{
-		AWS: config.AWSConfig{
-			Region:          s.cfg.AWS.Region,
-			AccessKeyID:     s.cfg.AWS.AccessKeyID,
-			SecretAccessKey: s.cfg.AWS.SecretAccessKey,
-			Bucket:          s.cfg.AWS.Bucket,
-			DatabasePrefix:  s.cfg.AWS.DatabasePrefix,
-			DirectoryPrefix: s.cfg.AWS.DirectoryPrefix,
-		},
+		StateDir: s.cfg.StateDir,
+		AWS:      s.cfg.AWS,
+	}
+	if awsCfg == nil {
+		return newCfg
 	}
 
 	// Override only the properties that are set in awsCfg
@@ -51,8 +87,12 @@ func (s *Service) getS3ClientForConfig(awsCfg *config.AWSConfig) (*s3.Client, er
 	if awsCfg.SecretAccessKey != "" {
 		newCfg.AWS.SecretAccessKey = awsCfg.SecretAccessKey
 	}
+	// A schedule's bucket takes precedence over global destinations, which
+	// may name a bucket of their own
 	if awsCfg.Bucket != "" {
 		newCfg.AWS.Bucket = awsCfg.Bucket
+		newCfg.AWS.Destination = ""
+		newCfg.AWS.Destinations = nil
 	}
 	if awsCfg.DatabasePrefix != "" {
 		newCfg.AWS.DatabasePrefix = awsCfg.DatabasePrefix
@@ -60,8 +100,103 @@ func (s *Service) getS3ClientForConfig(awsCfg *config.AWSConfig) (*s3.Client, er
 	if awsCfg.DirectoryPrefix != "" {
 		newCfg.AWS.DirectoryPrefix = awsCfg.DirectoryPrefix
 	}
+	// A schedule's destination replaces all global destinations and vice versa
+	if awsCfg.Destination != "" {
+		newCfg.AWS.Destination = awsCfg.Destination
+		newCfg.AWS.Destinations = nil
+	}
+	if len(awsCfg.Destinations) > 0 {
+		newCfg.AWS.Destination = ""
+		newCfg.AWS.Destinations = awsCfg.Destinations
+	}
+	if awsCfg.ReplicationPolicy != "" {
+		newCfg.AWS.ReplicationPolicy = awsCfg.ReplicationPolicy
+	}
+	// Static keys take precedence over profiles and roles, so global keys
+	// must not be inherited by a schedule with credentials of its own
+	if (awsCfg.Profile != "" || awsCfg.RoleARN != "") && awsCfg.AccessKeyID == "" {
+		newCfg.AWS.AccessKeyID = ""
+		newCfg.AWS.SecretAccessKey = ""
+	}
+	if awsCfg.Profile != "" {
+		newCfg.AWS.Profile = awsCfg.Profile
+	}
+	if awsCfg.RoleARN != "" {
+		newCfg.AWS.RoleARN = awsCfg.RoleARN
+	}
+	if awsCfg.ExternalID != "" {
+		newCfg.AWS.ExternalID = awsCfg.ExternalID
+	}
+	if awsCfg.SessionDuration != 0 {
+		newCfg.AWS.SessionDuration = awsCfg.SessionDuration
+	}
+	if awsCfg.Endpoint != "" {
+		newCfg.AWS.Endpoint = awsCfg.Endpoint
+	}
+	if awsCfg.ForcePathStyle {
+		newCfg.AWS.ForcePathStyle = true
+	}
+	if awsCfg.CABundle != "" {
+		newCfg.AWS.CABundle = awsCfg.CABundle
+	}
+	if awsCfg.InsecureSkipVerify {
+		newCfg.AWS.InsecureSkipVerify = true
+	}
+	if awsCfg.UnsignedPayload {
+		newCfg.AWS.UnsignedPayload = true
+	}
+	if awsCfg.DisableChecksums {
+		newCfg.AWS.DisableChecksums = true
+	}
+	if awsCfg.ServerSideEncryption != "" {
+		newCfg.AWS.ServerSideEncryption = awsCfg.ServerSideEncryption
+		newCfg.AWS.SSEKMSKeyID = awsCfg.SSEKMSKeyID
+		newCfg.AWS.SSECustomerKey = awsCfg.SSECustomerKey
+	}
+	if awsCfg.StorageClass != "" {
+		newCfg.AWS.StorageClass = awsCfg.StorageClass
+	}
+	if awsCfg.ObjectLockMode != "" {
+		newCfg.AWS.ObjectLockMode = awsCfg.ObjectLockMode
+	}
+	if awsCfg.ObjectLockRetention != 0 {
+		newCfg.AWS.ObjectLockRetention = awsCfg.ObjectLockRetention
+	}
+	if awsCfg.LegalHold {
+		newCfg.AWS.LegalHold = true
+	}
+	if awsCfg.Retention != nil {
+		newCfg.AWS.Retention = awsCfg.Retention
+	}
+	// Tags and metadata are merged, with the schedule's values taking precedence
+	if len(awsCfg.Tags) > 0 {
+		newCfg.AWS.Tags = mergeMaps(s.cfg.AWS.Tags, awsCfg.Tags)
+	}
+	if len(awsCfg.Metadata) > 0 {
+		newCfg.AWS.Metadata = mergeMaps(s.cfg.AWS.Metadata, awsCfg.Metadata)
+	}
+
+	return newCfg
+}
 
-	return s3.New(newCfg, nil)
+func mergeMaps(base, override map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(override))
+	maps.Copy(merged, base)
+	maps.Copy(merged, override)
+	return merged
+}
+
+// releaseStorage closes a backend returned by getStorageForConfig if it holds
+// a connection. The service's own backend is left open.
+func (s *Service) releaseStorage(backend storage.Storage) {
+	if backend == s.storage {
+		return
+	}
+	if closer, ok := backend.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Warn().Err(err).Msg("Failed to close storage")
+		}
+	}
 }
 
 func (s *Service) getDatabaseConfigForConfig(dbCfg *config.DatabaseConfig) *config.DatabaseConfig {
@@ -75,6 +210,7 @@ func (s *Service) getDatabaseConfigForConfig(dbCfg *config.DatabaseConfig) *conf
 		User:     s.cfg.Database.User,
 		Password: s.cfg.Database.Password,
 		Name:     s.cfg.Database.Name,
+		Dedup:    s.cfg.Database.Dedup,
 	}
 
 	// Override only the properties that are set in dbCfg
@@ -93,21 +229,41 @@ func (s *Service) getDatabaseConfigForConfig(dbCfg *config.DatabaseConfig) *conf
 	if dbCfg.Name != "" {
 		newCfg.Name = dbCfg.Name
 	}
+	if dbCfg.Dedup {
+		newCfg.Dedup = true
+	}
 
 	return &newCfg
 }
 
+// databasePrefix returns the database prefix of awsCfg, falling back to the global one
+func (s *Service) databasePrefix(awsCfg *config.AWSConfig) string {
+	if awsCfg != nil && awsCfg.DatabasePrefix != "" {
+		return awsCfg.DatabasePrefix
+	}
+	return s.cfg.AWS.DatabasePrefix
+}
+
+// directoryPrefix returns the directory prefix of awsCfg, falling back to the global one
+func (s *Service) directoryPrefix(awsCfg *config.AWSConfig) string {
+	if awsCfg != nil && awsCfg.DirectoryPrefix != "" {
+		return awsCfg.DirectoryPrefix
+	}
+	return s.cfg.AWS.DirectoryPrefix
+}
+
 func (s *Service) BackupDatabase(ctx context.Context, dbCfg *config.DatabaseConfig, awsCfg *config.AWSConfig) error {
 	if dbCfg == nil {
-		return fmt.Errorf("database configuration is required")
+		return config.Invalid(fmt.Errorf("database configuration is required"))
 	}
 
 	log.Info().Msgf("Starting backup of database %s", dbCfg.Name)
 
-	s3Client, err := s.getS3ClientForConfig(awsCfg)
+	targets, err := s.openTargets(awsCfg)
 	if err != nil {
-		return fmt.Errorf("failed to create S3 client: %w", err)
+		return fmt.Errorf("failed to open storage: %w", err)
 	}
+	defer s.releaseTargets(targets)
 	dbConfig := s.getDatabaseConfigForConfig(dbCfg)
 
 	// Create a temporary file for the dump
@@ -119,7 +275,7 @@ func (s *Service) BackupDatabase(ctx context.Context, dbCfg *config.DatabaseConf
 	defer tmpFile.Close()
 
 	// Prepare pg_dump command
-	cmd := exec.Command("pg_dump",
+	cmd := exec.CommandContext(ctx, "pg_dump",
 		"-h", dbConfig.Host,
 		"-p", fmt.Sprintf("%d", dbConfig.Port),
 		"-U", dbConfig.User,
@@ -129,7 +285,16 @@ func (s *Service) BackupDatabase(ctx context.Context, dbCfg *config.DatabaseConf
 	)
 
 	cmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", dbConfig.Password))
+
+	// Let pg_dump exit cleanly when the backup is cancelled, and kill it if
+	// it doesn't stop in time
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = pgDumpStopTimeout
+
 	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("pg_dump was aborted: %w", ctx.Err())
+		}
 		return fmt.Errorf("failed to execute pg_dump: %w", err)
 	}
 
@@ -140,91 +305,150 @@ func (s *Service) BackupDatabase(ctx context.Context, dbCfg *config.DatabaseConf
 	}
 	defer file.Close()
 
-	// Use AWS config from schedule if provided, otherwise use default
-	prefix := s.cfg.AWS.DatabasePrefix
-	if awsCfg != nil {
-		prefix = awsCfg.DatabasePrefix
-	}
+	prefix := s.databasePrefix(awsCfg)
+
+	// The dump is produced once and uploaded to every destination
+	key := s3.GetObjectKey(prefix, fmt.Sprintf("%s_%s.sql", dbConfig.Name, time.Now().Format(backupTimeFormat)))
+	err = s.replicate(ctx, awsCfg, targets, func(t target) error {
+		s.abortStaleUploads(ctx, t.storage, s3.GetObjectKey(prefix, dbConfig.Name+"_"))
 
-	key := s3.GetObjectKey(prefix, fmt.Sprintf("%s_%s.sql", dbConfig.Name, time.Now().Format("2006-01-02_15-04-05")))
-	if err := s3Client.Upload(ctx, key, file); err != nil {
-		return fmt.Errorf("failed to upload dump to S3: %w", err)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind dump file: %w", err)
+		}
+		if dbConfig.Dedup {
+			if err := uploadDeduplicated(ctx, t.storage, prefix, key+chunkedSuffix, file); err != nil {
+				return fmt.Errorf("failed to upload dump to S3: %w", err)
+			}
+			history.StatsFrom(ctx).AddKey(key + chunkedSuffix)
+		} else {
+			if err := t.storage.Upload(ctx, key, file); err != nil {
+				return fmt.Errorf("failed to upload dump to S3: %w", err)
+			}
+			history.StatsFrom(ctx).AddKey(key)
+		}
+		if info, err := file.Stat(); err == nil {
+			history.StatsFrom(ctx).AddFile(key, info.Size())
+		}
+		s.applyRetention(ctx, t.storage, awsCfg, prefix, dbConfig.Name)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	log.Info().Msgf("Successfully backed up database %s to S3", dbConfig.Name)
 	return nil
 }
 
-func (s *Service) BackupDirectory(ctx context.Context, sourcePath string, sync bool, shouldDelete bool, awsCfg *config.AWSConfig) error {
+func (s *Service) BackupDirectory(ctx context.Context, dirCfg *config.DirectoryConfig, awsCfg *config.AWSConfig) error {
+	if dirCfg == nil {
+		return config.Invalid(fmt.Errorf("directory configuration is required"))
+	}
+
+	sourcePath := dirCfg.SourcePath
 	log.Info().Msgf("Starting backup of directory %s", sourcePath)
 
-	// Get appropriate S3 client
-	s3Client, err := s.getS3ClientForConfig(awsCfg)
+	targets, err := s.openTargets(awsCfg)
 	if err != nil {
-		return fmt.Errorf("failed to create S3 client: %w", err)
+		return fmt.Errorf("failed to open storage: %w", err)
 	}
+	defer s.releaseTargets(targets)
 
 	if _, err := os.Stat(sourcePath); os.IsNotExist(err) {
-		return fmt.Errorf("source path does not exist: %s", sourcePath)
+		return config.Invalid(fmt.Errorf("source path does not exist: %s", sourcePath))
 	}
 
+	if dirCfg.Dedup && dirCfg.Mode != config.DirectoryModeSnapshot {
+		return config.Invalid(fmt.Errorf("dedup is only supported in snapshot mode"))
+	}
+	if dirCfg.EncryptionKeyFile != "" && dirCfg.Mode != config.DirectoryModeArchive {
+		return config.Invalid(fmt.Errorf("encryption is only supported in archive mode"))
+	}
+
+	// Clean up after earlier runs that were interrupted and can't be resumed
+	for _, t := range targets {
+		if t.err == nil {
+			s.abortStaleUploads(ctx, t.storage, s.directoryPrefix(awsCfg))
+		}
+	}
+
+	switch dirCfg.Mode {
+	case "", config.DirectoryModeFiles:
+	case config.DirectoryModeArchive:
+		return s.backupDirectoryArchive(ctx, targets, dirCfg, awsCfg)
+	case config.DirectoryModeSnapshot:
+		return s.replicate(ctx, awsCfg, targets, func(t target) error {
+			return s.backupDirectorySnapshot(ctx, t.storage, dirCfg, awsCfg)
+		})
+	case config.DirectoryModeWatch:
+		// Scheduled runs of watched directories reconcile with a full sync
+		syncCfg := *dirCfg
+		syncCfg.Sync = true
+		dirCfg = &syncCfg
+	default:
+		return config.Invalid(fmt.Errorf("invalid directory backup mode: %s", dirCfg.Mode))
+	}
+
+	// Every destination is synced on its own since each may be in a different state
+	err = s.replicate(ctx, awsCfg, targets, func(t target) error {
+		return s.backupDirectoryFiles(ctx, t, dirCfg, awsCfg)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Successfully backed up directory %s to S3", sourcePath)
+	return nil
+}
+
+// backupDirectoryFiles uploads every file as its own object, optionally
+// skipping unchanged files and deleting objects of removed ones
+func (s *Service) backupDirectoryFiles(ctx context.Context, t target, dirCfg *config.DirectoryConfig, awsCfg *config.AWSConfig) error {
+	sourcePath := dirCfg.SourcePath
+	backend := t.storage
+
+	prefix := s.directoryPrefix(awsCfg)
+
 	// Get list of S3 files if sync is enabled
-	var s3FileMap map[string]struct{}
-	if sync {
-		// Use AWS config from schedule if provided, otherwise use default
-		prefix := ""
-		if awsCfg != nil && awsCfg.DirectoryPrefix != "" {
-			prefix = awsCfg.DirectoryPrefix + "/"
-		} else if s.cfg.AWS.DirectoryPrefix != "" {
-			prefix = s.cfg.AWS.DirectoryPrefix + "/"
+	var s3FileMap map[string]time.Time
+	if dirCfg.Sync {
+		listPrefix := ""
+		if prefix != "" {
+			listPrefix = prefix + "/"
 		}
 
-		s3Files, err := s3Client.ListObjects(ctx, prefix)
+		s3Files, err := backend.List(ctx, listPrefix)
 		if err != nil {
 			return fmt.Errorf("failed to list objects in S3: %w", err)
 		}
 
 		// Create a map of S3 files for quick lookup
-		s3FileMap = make(map[string]struct{})
+		s3FileMap = make(map[string]time.Time)
 		for _, file := range s3Files {
-			s3FileMap[file] = struct{}{}
+			s3FileMap[file.Key] = file.LastModified
 		}
 	}
 
-	// Use AWS config from schedule if provided, otherwise use default
-	prefix := s.cfg.AWS.DirectoryPrefix
-	if awsCfg != nil {
-		prefix = awsCfg.DirectoryPrefix
-	}
+	// Files uploaded by an interrupted run don't have to be uploaded again
+	progress := s.loadRunProgress(t.name, prefix, sourcePath)
+	defer progress.save()
 
-	err = filepath.Walk(sourcePath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+	err := walkDirectory(sourcePath, dirCfg.Symlinks, dirCfg.SpecialFiles, func(entry walkEntry) error {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
 
-		if info.IsDir() {
-			return nil
-		}
-
-		// Calculate relative path for S3 key
-		relPath, err := filepath.Rel(sourcePath, path)
-		if err != nil {
-			return fmt.Errorf("failed to get relative path: %w", err)
-		}
-
+		relPath := entry.relPath
 		key := s3.GetObjectKey(prefix, relPath)
-		shouldUpload := true
+		shouldUpload := !progress.done(relPath, entry.info)
 
-		if sync {
+		if dirCfg.Sync {
 			// Check if file exists in S3
-			if _, exists := s3FileMap[key]; exists {
+			if !shouldUpload {
+				log.Debug().Msgf("Already uploaded by interrupted run: %s", relPath)
+			} else if lastModified, exists := s3FileMap[key]; exists {
 				// File exists, check if it's modified
-				metadata, err := s3Client.GetObjectMetadata(ctx, key)
-				if err != nil {
-					return fmt.Errorf("failed to get S3 object metadata for %s: %w", relPath, err)
-				}
-
-				if !info.ModTime().After(*metadata.LastModified) {
+				if !entry.info.ModTime().After(lastModified) {
 					shouldUpload = false
 				} else {
 					log.Debug().Msgf("Modified file detected: %s", relPath)
@@ -237,14 +461,14 @@ func (s *Service) BackupDirectory(ctx context.Context, sourcePath string, sync b
 		}
 
 		if shouldUpload {
-			file, err := os.Open(path)
-			if err != nil {
-				return fmt.Errorf("failed to open file %s: %w", path, err)
+			if err := uploadEntry(ctx, backend, key, entry); err != nil {
+				return err
 			}
-			defer file.Close()
-
-			if err := s3Client.Upload(ctx, key, file); err != nil {
-				return fmt.Errorf("failed to upload file %s to S3: %w", path, err)
+			progress.complete(relPath, entry.info)
+			if entry.kind == entryFile {
+				history.StatsFrom(ctx).AddFile(relPath, entry.info.Size())
+			} else {
+				history.StatsFrom(ctx).AddFile(relPath, 0)
 			}
 
 			log.Debug().Msgf("Uploaded file: %s", relPath)
@@ -258,15 +482,66 @@ func (s *Service) BackupDirectory(ctx context.Context, sourcePath string, sync b
 	}
 
 	// Delete files from S3 that don't exist locally
-	if sync && shouldDelete && len(s3FileMap) > 0 {
+	if dirCfg.Sync && dirCfg.Delete && len(s3FileMap) > 0 {
 		for key := range s3FileMap {
-			if err := s3Client.DeleteObject(ctx, key); err != nil {
+			// Without a directory prefix, snapshots share the listed prefix
+			if strings.HasPrefix(key, s.snapshotRoot(awsCfg)+"/") {
+				continue
+			}
+			if err := backend.DeleteObject(ctx, key); errors.Is(err, storage.ErrLocked) {
+				log.Warn().Err(err).Msgf("Kept locked object of deleted file %s", key)
+				continue
+			} else if err != nil {
 				return fmt.Errorf("failed to delete object %s from S3: %w", key, err)
 			}
 			log.Debug().Msgf("Deleted file from S3: %s", key)
 		}
 	}
 
-	log.Info().Msgf("Successfully backed up directory %s to S3", sourcePath)
+	progress.finish()
+	return nil
+}
+
+// uploadEntry uploads a single walked entry. Regular files are uploaded with
+// their content and their mode and modification time in the metadata,
+// everything else as an empty marker object whose metadata describes the
+// link or special file.
+func uploadEntry(ctx context.Context, backend storage.Storage, key string, entry walkEntry) error {
+	switch entry.kind {
+	case entrySymlink:
+		metadata := map[string]string{metaType: "symlink", metaLinkTarget: entry.linkTarget}
+		if err := backend.UploadWithMetadata(ctx, key, strings.NewReader(""), metadata); err != nil {
+			return fmt.Errorf("failed to upload symlink %s to S3: %w", entry.path, err)
+		}
+
+	case entryHardlink:
+		metadata := map[string]string{metaType: "hardlink", metaLinkTarget: filepath.ToSlash(entry.linkTarget)}
+		if err := backend.UploadWithMetadata(ctx, key, strings.NewReader(""), metadata); err != nil {
+			return fmt.Errorf("failed to upload hardlink %s to S3: %w", entry.path, err)
+		}
+
+	case entrySpecial:
+		metadata := map[string]string{metaType: specialFileType(entry.info.Mode())}
+		if err := backend.UploadWithMetadata(ctx, key, strings.NewReader(""), metadata); err != nil {
+			return fmt.Errorf("failed to upload special file %s to S3: %w", entry.path, err)
+		}
+
+	default:
+		file, err := os.Open(entry.path)
+		if err != nil {
+			return fmt.Errorf("failed to open file %s: %w", entry.path, err)
+		}
+		defer file.Close()
+
+		metadata := map[string]string{
+			metaType:    "file",
+			metaMode:    strconv.FormatUint(uint64(entry.info.Mode().Perm()), 8),
+			metaModTime: entry.info.ModTime().UTC().Format(time.RFC3339Nano),
+		}
+		if err := backend.UploadWithMetadata(ctx, key, storage.ResumableFile{File: file}, metadata); err != nil {
+			return fmt.Errorf("failed to upload file %s to S3: %w", entry.path, err)
+		}
+	}
+
 	return nil
 }
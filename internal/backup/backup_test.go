@@ -0,0 +1,228 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/destination"
+	"github.com/pkkulhari/backme/internal/history"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func TestScheduleAWSConfig(t *testing.T) {
+	s := New(&config.Config{AWS: config.AWSConfig{
+		Bucket:       "global",
+		Destinations: []string{"s3://global-a", "file:///srv/backups"},
+	}}, nil)
+
+	tests := []struct {
+		name   string
+		awsCfg *config.AWSConfig
+		want   []string
+	}{
+		{name: "global", awsCfg: &config.AWSConfig{}, want: []string{"s3://global-a", "file:///srv/backups"}},
+		{name: "bucket", awsCfg: &config.AWSConfig{Bucket: "schedule"}, want: []string{"s3://schedule"}},
+		{name: "destination", awsCfg: &config.AWSConfig{Destination: "s3://other"}, want: []string{"s3://other"}},
+		{name: "bucket and destination", awsCfg: &config.AWSConfig{Bucket: "schedule", Destination: "file:///tmp"}, want: []string{"file:///tmp"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := s.getAWSConfigForConfig(tt.awsCfg)
+			urls, err := destination.URLs(cfg)
+			require.NoError(t, err)
+
+			var names []string
+			for _, u := range urls {
+				names = append(names, destination.Name(cfg, u))
+			}
+			assert.Equal(t, tt.want, names)
+		})
+	}
+}
+
+func TestScheduleCredentials(t *testing.T) {
+	s := New(&config.Config{AWS: config.AWSConfig{AccessKeyID: "global", SecretAccessKey: "secret"}}, nil)
+
+	cfg := s.getAWSConfigForConfig(&config.AWSConfig{RoleARN: "arn:aws:iam::123456789012:role/backme"})
+	assert.Empty(t, cfg.AWS.AccessKeyID)
+	assert.Empty(t, cfg.AWS.SecretAccessKey)
+
+	cfg = s.getAWSConfigForConfig(&config.AWSConfig{Profile: "backup"})
+	assert.Empty(t, cfg.AWS.AccessKeyID)
+	assert.Equal(t, "backup", cfg.AWS.Profile)
+
+	cfg = s.getAWSConfigForConfig(&config.AWSConfig{AccessKeyID: "own", SecretAccessKey: "own-secret", RoleARN: "arn:aws:iam::123456789012:role/backme"})
+	assert.Equal(t, "own", cfg.AWS.AccessKeyID)
+
+	cfg = s.getAWSConfigForConfig(&config.AWSConfig{Region: "eu-west-1"})
+	assert.Equal(t, "global", cfg.AWS.AccessKeyID)
+}
+
+func TestBackupDirectoryFiles(t *testing.T) {
+	ctx := context.Background()
+	backend := newMemoryStorage()
+	s := New(&config.Config{StateDir: t.TempDir()}, backend)
+
+	source := t.TempDir()
+	writeFiles(t, source, map[string]string{"a.txt": "a", "sub/b.txt": "b"})
+	dirCfg := &config.DirectoryConfig{SourcePath: source, Sync: true, Delete: true}
+	require.NoError(t, s.BackupDirectory(ctx, dirCfg, nil))
+	assert.Equal(t, []string{"a.txt", "sub/b.txt"}, backend.keys())
+
+	// Snapshots share the bucket root without a directory prefix and survive --delete
+	require.NoError(t, backend.Upload(ctx, ".snapshots/manifests/docs_2025-01-01_00-00-00.json", strings.NewReader("{}")))
+	require.NoError(t, os.Remove(filepath.Join(source, "a.txt")))
+	require.NoError(t, s.BackupDirectory(ctx, dirCfg, nil))
+	assert.Equal(t, []string{".snapshots/manifests/docs_2025-01-01_00-00-00.json", "sub/b.txt"}, backend.keys())
+
+	target := t.TempDir()
+	require.NoError(t, s.RestoreFiles(ctx, "", target, time.Time{}, nil))
+	content, err := os.ReadFile(filepath.Join(target, "sub/b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(content))
+	assert.NoDirExists(t, filepath.Join(target, ".snapshots"))
+}
+
+func TestStatsAcrossDestinations(t *testing.T) {
+	s := New(&config.Config{StateDir: t.TempDir()}, nil)
+	source := t.TempDir()
+	writeFiles(t, source, map[string]string{"a.txt": "aa", "sub/b.txt": "bbb"})
+
+	awsCfg := &config.AWSConfig{Destinations: []string{"file://" + t.TempDir(), "file://" + t.TempDir()}}
+	for _, mode := range []string{config.DirectoryModeFiles, config.DirectoryModeSnapshot, config.DirectoryModeArchive} {
+		t.Run(mode, func(t *testing.T) {
+			stats := &history.Stats{}
+			ctx := history.WithStats(context.Background(), stats)
+			require.NoError(t, s.BackupDirectory(ctx, &config.DirectoryConfig{SourcePath: source, Mode: mode}, awsCfg))
+
+			var run history.Run
+			stats.Fill(&run)
+			if mode == config.DirectoryModeArchive {
+				assert.Equal(t, 1, run.Files)
+				assert.Len(t, run.Keys, 1)
+				return
+			}
+			assert.Equal(t, 2, run.Files)
+			assert.Equal(t, int64(5), run.Bytes)
+		})
+	}
+}
+
+func TestFailedDestinations(t *testing.T) {
+	s := New(&config.Config{StateDir: t.TempDir()}, nil)
+	source := t.TempDir()
+	writeFiles(t, source, map[string]string{"a.txt": "a"})
+
+	// A file where the destination directory should be can't be written to
+	blocked := filepath.Join(t.TempDir(), "blocked")
+	require.NoError(t, os.WriteFile(blocked, nil, 0644))
+	good, bad := "file://"+t.TempDir(), "file://"+blocked
+
+	for _, policy := range []string{config.ReplicationAll, config.ReplicationAny} {
+		t.Run(policy, func(t *testing.T) {
+			stats := &history.Stats{}
+			ctx := history.WithStats(context.Background(), stats)
+			awsCfg := &config.AWSConfig{Destinations: []string{good, bad}, ReplicationPolicy: policy}
+			err := s.BackupDirectory(ctx, &config.DirectoryConfig{SourcePath: source}, awsCfg)
+
+			var run history.Run
+			stats.Fill(&run)
+			if policy == config.ReplicationAll {
+				var replicationErr *ReplicationError
+				require.ErrorAs(t, err, &replicationErr)
+				assert.NoError(t, replicationErr.Results[0].Err)
+				assert.Error(t, replicationErr.Results[1].Err)
+			} else {
+				require.NoError(t, err)
+				assert.True(t, run.Partial())
+			}
+			assert.Len(t, run.FailedDestinations, 1)
+			assert.Contains(t, run.FailedDestinations, bad)
+		})
+	}
+}
+
+func TestScheduleInheritsPrefix(t *testing.T) {
+	s := New(&config.Config{StateDir: t.TempDir(), AWS: config.AWSConfig{DirectoryPrefix: "global"}}, nil)
+	source := t.TempDir()
+	writeFiles(t, source, map[string]string{"a.txt": "a"})
+
+	// A schedule that only overrides the destination keeps the global prefix
+	dest := t.TempDir()
+	awsCfg := &config.AWSConfig{Destination: "file://" + dest}
+	require.NoError(t, s.BackupDirectory(context.Background(), &config.DirectoryConfig{SourcePath: source}, awsCfg))
+	assert.FileExists(t, filepath.Join(dest, "global", "a.txt"))
+	assert.NoFileExists(t, filepath.Join(dest, "a.txt"))
+	assert.Equal(t, "global", s.directoryPrefix(awsCfg))
+	assert.Equal(t, "", s.databasePrefix(awsCfg))
+
+	s.cfg.AWS.DatabasePrefix = "dumps"
+	assert.Equal(t, "dumps", s.databasePrefix(awsCfg))
+	assert.Equal(t, "own", s.databasePrefix(&config.AWSConfig{DatabasePrefix: "own"}))
+}
+
+func TestBackupDatabaseStopsPgDump(t *testing.T) {
+	// A pg_dump that hangs until it is stopped
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "pg_dump"), []byte("#!/bin/sh\nexec sleep 60\n"), 0755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	backend := newMemoryStorage()
+	s := New(&config.Config{StateDir: t.TempDir()}, backend)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := s.BackupDatabase(ctx, &config.DatabaseConfig{Name: "app"}, nil)
+	assert.ErrorContains(t, err, "pg_dump was aborted")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), pgDumpStopTimeout, "pg_dump was not stopped with SIGTERM")
+
+	keys, err := backend.ListObjects(context.Background(), "")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+// abortingStorage records the prefixes stale uploads are aborted below
+type abortingStorage struct {
+	*memoryStorage
+	prefixes []string
+}
+
+func (a *abortingStorage) AbortStaleUploads(ctx context.Context, prefix string, olderThan time.Duration) (int, error) {
+	a.prefixes = append(a.prefixes, prefix)
+	return 0, nil
+}
+
+func TestAbortStaleUploadsBelowPrefix(t *testing.T) {
+	ctx := context.Background()
+	backend := &abortingStorage{memoryStorage: newMemoryStorage()}
+	s := New(&config.Config{StateDir: t.TempDir()}, backend)
+
+	source := t.TempDir()
+	writeFiles(t, source, map[string]string{"a.txt": "a"})
+	dirCfg := &config.DirectoryConfig{SourcePath: source}
+
+	// Without a prefix the uploads could belong to anyone sharing the bucket
+	require.NoError(t, s.BackupDirectory(ctx, dirCfg, nil))
+	assert.Empty(t, backend.prefixes)
+
+	s.cfg.AWS.DirectoryPrefix = "docs"
+	require.NoError(t, s.BackupDirectory(ctx, dirCfg, nil))
+	assert.Equal(t, []string{"docs"}, backend.prefixes)
+}
@@ -0,0 +1,94 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/pkkulhari/backme/internal/chunkstore"
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/s3"
+	"github.com/pkkulhari/backme/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// chunkedSuffix is appended to the key of backups stored as a chunk recipe
+const chunkedSuffix = ".chunks"
+
+func chunkStorePrefix(prefix string) string {
+	return s3.GetObjectKey(prefix, "chunks")
+}
+
+// uploadDeduplicated stores r in the chunk store below prefix and uploads
+// the recipe needed to reassemble it under key
+func uploadDeduplicated(ctx context.Context, backend storage.Storage, prefix, key string, r io.Reader) error {
+	store, err := chunkstore.Open(ctx, backend, chunkStorePrefix(prefix))
+	if err != nil {
+		return err
+	}
+
+	recipe, err := store.Write(ctx, r)
+	if err != nil {
+		return err
+	}
+	if err := store.Flush(ctx); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(recipe)
+	if err != nil {
+		return fmt.Errorf("failed to encode chunk recipe: %w", err)
+	}
+	if err := backend.Upload(ctx, key, bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	log.Debug().Msgf("Stored %s as %d chunks", key, len(recipe.Chunks))
+	return nil
+}
+
+// DownloadDatabaseBackup writes the dump stored under key to w. Deduplicated
+// dumps are reassembled from their chunks.
+func (s *Service) DownloadDatabaseBackup(ctx context.Context, key string, w io.Writer, awsCfg *config.AWSConfig) error {
+	backend, err := s.getStorageForConfig(awsCfg)
+	if err != nil {
+		return fmt.Errorf("failed to open storage: %w", err)
+	}
+	defer s.releaseStorage(backend)
+
+	body, err := backend.Download(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to download backup: %w", err)
+	}
+	defer body.Close()
+
+	if !strings.HasSuffix(key, chunkedSuffix) {
+		if _, err := io.Copy(w, body); err != nil {
+			return fmt.Errorf("failed to write backup: %w", err)
+		}
+		return nil
+	}
+
+	var recipe chunkstore.Recipe
+	if err := json.NewDecoder(body).Decode(&recipe); err != nil {
+		return fmt.Errorf("failed to decode chunk recipe: %w", err)
+	}
+
+	prefix := path.Dir(key)
+	if prefix == "." {
+		prefix = ""
+	}
+	store, err := chunkstore.Open(ctx, backend, chunkStorePrefix(prefix))
+	if err != nil {
+		return err
+	}
+
+	if err := store.Restore(ctx, &recipe, w); err != nil {
+		return fmt.Errorf("failed to reassemble backup: %w", err)
+	}
+	return nil
+}
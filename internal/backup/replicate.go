@@ -0,0 +1,136 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/destination"
+	"github.com/pkkulhari/backme/internal/history"
+	"github.com/pkkulhari/backme/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// target is one of the destinations a backup is written to. If the
+// destination could not be opened, err is set instead of storage.
+type target struct {
+	name    string
+	storage storage.Storage
+	err     error
+}
+
+// DestinationResult is the outcome of a backup on a single destination
+type DestinationResult struct {
+	Destination string
+	Err         error
+}
+
+// ReplicationError is returned when a backup failed on some or all of its
+// destinations and the replication policy treats this as a failure
+type ReplicationError struct {
+	Results []DestinationResult
+}
+
+func (e *ReplicationError) Error() string {
+	var errs []error
+	for _, result := range e.Results {
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", result.Destination, result.Err))
+		}
+	}
+	return fmt.Sprintf("backup failed on %d of %d destinations: %v", len(errs), len(e.Results), errors.Join(errs...))
+}
+
+func (e *ReplicationError) Unwrap() []error {
+	var errs []error
+	for _, result := range e.Results {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		}
+	}
+	return errs
+}
+
+// openTargets opens every destination a backup with awsCfg is written to.
+// Destinations that fail to open are reported by replicate like any other
+// failed backup. The returned targets must be released with releaseTargets.
+func (s *Service) openTargets(awsCfg *config.AWSConfig) ([]target, error) {
+	cfg := s.getAWSConfigForConfig(awsCfg)
+	urls, err := destination.URLs(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]target, 0, len(urls))
+	for i, u := range urls {
+		name := destination.Name(cfg, u)
+
+		// The service's own storage is the first global destination
+		if awsCfg == nil && i == 0 && s.storage != nil {
+			targets = append(targets, target{name: name, storage: s.storage})
+			continue
+		}
+
+		backend, err := destination.OpenURL(cfg, u)
+		if err != nil {
+			targets = append(targets, target{name: name, err: fmt.Errorf("failed to open storage: %w", err)})
+			continue
+		}
+		targets = append(targets, target{name: name, storage: backend})
+	}
+
+	return targets, nil
+}
+
+func (s *Service) releaseTargets(targets []target) {
+	for _, t := range targets {
+		if t.storage != nil {
+			s.releaseStorage(t.storage)
+		}
+	}
+}
+
+// replicate calls fn for every target and logs the outcome per destination.
+// Failed destinations are also reported to the stats of ctx. With the "any"
+// replication policy the backup succeeds as long as one destination
+// succeeded, otherwise every destination has to succeed.
+func (s *Service) replicate(ctx context.Context, awsCfg *config.AWSConfig, targets []target, fn func(t target) error) error {
+	policy := s.getAWSConfigForConfig(awsCfg).AWS.ReplicationPolicy
+	switch policy {
+	case "", config.ReplicationAll, config.ReplicationAny:
+	default:
+		return config.Invalid(fmt.Errorf("invalid replication policy: %s", policy))
+	}
+
+	results := make([]DestinationResult, 0, len(targets))
+	failed := 0
+	for _, t := range targets {
+		err := t.err
+		if err == nil {
+			err = fn(t)
+		}
+		if err != nil {
+			failed++
+			if len(targets) > 1 {
+				log.Error().Err(err).Str("destination", t.name).Msg("Backup to destination failed")
+				history.StatsFrom(ctx).AddFailedDestination(t.name, err)
+			}
+		} else if len(targets) > 1 {
+			log.Info().Str("destination", t.name).Msg("Backup to destination succeeded")
+		}
+		results = append(results, DestinationResult{Destination: t.name, Err: err})
+	}
+
+	switch {
+	case failed == 0:
+		return nil
+	case len(targets) == 1:
+		return results[0].Err
+	case policy == config.ReplicationAny && failed < len(targets):
+		log.Warn().Msgf("Backup succeeded on %d of %d destinations", len(targets)-failed, len(targets))
+		return nil
+	default:
+		return &ReplicationError{Results: results}
+	}
+}
@@ -0,0 +1,221 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// fileObject is an object of a files mode backup selected for restore
+type fileObject struct {
+	key       string
+	versionID string
+	size      int64
+}
+
+// RestoreFiles restores a directory backed up in files mode from the objects
+// below prefix into targetPath. With a non-zero asOf every key is restored
+// from its latest version not newer than asOf, which requires a versioned
+// bucket. Keys that did not exist at that time are not restored. Without a
+// prefix the bucket may hold other backups too, so only objects marked as
+// files mode entries are restored.
+func (s *Service) RestoreFiles(ctx context.Context, prefix string, targetPath string, asOf time.Time, awsCfg *config.AWSConfig) error {
+	if asOf.IsZero() {
+		log.Info().Msgf("Restoring files below %q to %s", prefix, targetPath)
+	} else {
+		log.Info().Msgf("Restoring files below %q as of %s to %s", prefix, asOf.Format(time.RFC3339), targetPath)
+	}
+
+	backend, err := s.getStorageForConfig(awsCfg)
+	if err != nil {
+		return fmt.Errorf("failed to open storage: %w", err)
+	}
+	defer s.releaseStorage(backend)
+
+	listPrefix := ""
+	if prefix != "" {
+		listPrefix = strings.TrimSuffix(prefix, "/") + "/"
+	}
+
+	var objects []fileObject
+	if asOf.IsZero() {
+		infos, err := backend.List(ctx, listPrefix)
+		if err != nil {
+			return fmt.Errorf("failed to list objects: %w", err)
+		}
+		for _, info := range infos {
+			objects = append(objects, fileObject{key: info.Key, size: info.Size})
+		}
+	} else {
+		versioned, ok := backend.(storage.Versioned)
+		if !ok {
+			return fmt.Errorf("restoring as of a point in time requires a versioned S3 bucket")
+		}
+		versions, err := versioned.ListVersions(ctx, listPrefix)
+		if err != nil {
+			return err
+		}
+		objects = versionsAsOf(versions, asOf)
+	}
+
+	// Hardlinks are created once all other entries exist
+	var hardlinks []storage.ObjectInfo
+	restored, skipped := 0, 0
+	for _, obj := range objects {
+		relPath := strings.TrimPrefix(obj.key, listPrefix)
+		if listPrefix == "" && strings.HasPrefix(obj.key, s.snapshotRoot(awsCfg)+"/") {
+			continue
+		}
+
+		info, err := objectMetadata(ctx, backend, obj)
+		if err != nil {
+			return err
+		}
+		if listPrefix == "" && info.Metadata[metaType] == "" {
+			log.Debug().Msgf("Skipping %s, it was not stored by a files mode backup", obj.key)
+			skipped++
+			continue
+		}
+
+		restored++
+		if info.Metadata[metaType] == "hardlink" {
+			info.Key = relPath
+			hardlinks = append(hardlinks, *info)
+			continue
+		}
+
+		if err := restoreFileObject(ctx, backend, obj, info, targetPath, relPath); err != nil {
+			return err
+		}
+	}
+
+	for _, info := range hardlinks {
+		path, err := restorePath(targetPath, info.Key)
+		if err != nil {
+			return err
+		}
+		target, err := restorePath(targetPath, info.Metadata[metaLinkTarget])
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", path, err)
+		}
+		os.Remove(path)
+		if err := os.Link(target, path); err != nil {
+			return fmt.Errorf("failed to create hardlink %s: %w", path, err)
+		}
+		log.Debug().Msgf("Restored file: %s", info.Key)
+	}
+
+	if skipped > 0 {
+		log.Warn().Msgf("Skipped %d objects without files mode metadata, restore them with a prefix", skipped)
+	}
+	log.Info().Msgf("Successfully restored %d files to %s", restored, targetPath)
+	return nil
+}
+
+// versionsAsOf picks the latest version of every key that is not newer than
+// asOf. Keys whose picked version is a delete marker are left out.
+func versionsAsOf(versions []storage.ObjectVersion, asOf time.Time) []fileObject {
+	var objects []fileObject
+	picked := make(map[string]bool)
+	for _, v := range versions {
+		if picked[v.Key] || v.LastModified.After(asOf) {
+			continue
+		}
+		// Versions are sorted newest first, so the first one found is the latest
+		picked[v.Key] = true
+		if !v.DeleteMarker {
+			objects = append(objects, fileObject{key: v.Key, versionID: v.VersionID, size: v.Size})
+		}
+	}
+	return objects
+}
+
+func objectMetadata(ctx context.Context, backend storage.Storage, obj fileObject) (*storage.ObjectInfo, error) {
+	if obj.versionID != "" {
+		return backend.(storage.Versioned).GetVersionMetadata(ctx, obj.key, obj.versionID)
+	}
+	return backend.GetObjectMetadata(ctx, obj.key)
+}
+
+func downloadObject(ctx context.Context, backend storage.Storage, obj fileObject) (io.ReadCloser, error) {
+	if obj.versionID != "" {
+		return backend.(storage.Versioned).DownloadVersion(ctx, obj.key, obj.versionID)
+	}
+	return backend.Download(ctx, obj.key)
+}
+
+func restoreFileObject(ctx context.Context, backend storage.Storage, obj fileObject, info *storage.ObjectInfo, targetPath, relPath string) error {
+	path, err := restorePath(targetPath, relPath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+
+	kind := info.Metadata[metaType]
+	switch kind {
+	case "", "file":
+		body, err := downloadObject(ctx, backend, obj)
+		if err != nil {
+			return fmt.Errorf("failed to download %s: %w", obj.key, err)
+		}
+		defer body.Close()
+
+		// Objects uploaded before modes were recorded get the former default
+		mode := os.FileMode(0644)
+		if perm, err := strconv.ParseUint(info.Metadata[metaMode], 8, 32); err == nil {
+			mode = os.FileMode(perm).Perm()
+		}
+
+		file, err := createFile(path, mode)
+		if err != nil {
+			return fmt.Errorf("failed to create file %s: %w", path, err)
+		}
+		defer file.Close()
+
+		if _, err := io.Copy(file, body); err != nil {
+			return fmt.Errorf("failed to write file %s: %w", path, err)
+		}
+		if err := file.Chmod(mode); err != nil {
+			return fmt.Errorf("failed to set mode of %s: %w", path, err)
+		}
+		if modTime, err := time.Parse(time.RFC3339Nano, info.Metadata[metaModTime]); err == nil {
+			if err := os.Chtimes(path, modTime, modTime); err != nil {
+				return fmt.Errorf("failed to set modification time of %s: %w", path, err)
+			}
+		}
+
+	case "symlink":
+		os.Remove(path)
+		if err := os.Symlink(info.Metadata[metaLinkTarget], path); err != nil {
+			return fmt.Errorf("failed to create symlink %s: %w", path, err)
+		}
+
+	case "fifo":
+		os.Remove(path)
+		if err := syscall.Mkfifo(path, 0644); err != nil {
+			return fmt.Errorf("failed to create FIFO %s: %w", path, err)
+		}
+
+	default:
+		log.Warn().Msgf("Skipping unsupported entry %s of type %s", relPath, kind)
+		return nil
+	}
+
+	log.Debug().Msgf("Restored file: %s", relPath)
+	return nil
+}
@@ -0,0 +1,161 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/state"
+	"github.com/pkkulhari/backme/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// staleUploadAge is how old an unfinished multipart upload has to be
+	// before it is aborted, unless it can be resumed
+	staleUploadAge = 24 * time.Hour
+	// stateMaxAge is how long the state of interrupted runs and uploads is kept
+	stateMaxAge = 7 * 24 * time.Hour
+	// progressSaveInterval is how often the progress of a run is persisted
+	progressSaveInterval = 5 * time.Second
+)
+
+// staleUploadAborter is implemented by backends with multipart uploads
+type staleUploadAborter interface {
+	AbortStaleUploads(ctx context.Context, prefix string, olderThan time.Duration) (int, error)
+}
+
+// resumeState returns the store for resume state, or nil if it is disabled or
+// its directory cannot be used
+func (s *Service) resumeState() *state.Store {
+	s.stateOnce.Do(func() {
+		if s.cfg.StateDir == "" {
+			return
+		}
+
+		store, err := state.Open(s.cfg.StateDir)
+		if err != nil {
+			log.Warn().Err(err).Msg("Interrupted backups will not be resumed")
+			return
+		}
+		for _, kind := range []string{"run", "upload"} {
+			if err := store.DeleteOlderThan(kind, stateMaxAge); err != nil {
+				log.Warn().Err(err).Msg("Failed to clean up old state")
+			}
+		}
+		s.stateStore = store
+	})
+	return s.stateStore
+}
+
+// abortStaleUploads cleans up multipart uploads below prefix left behind by
+// runs that will not be resumed. Nothing is aborted without a prefix, since
+// the uploads could belong to other hosts or schedules sharing the bucket.
+func (s *Service) abortStaleUploads(ctx context.Context, backend storage.Storage, prefix string) {
+	aborter, ok := backend.(staleUploadAborter)
+	if !ok {
+		return
+	}
+	if prefix == "" {
+		log.Debug().Msg("Not aborting stale uploads without a prefix")
+		return
+	}
+
+	// Make sure old upload state is cleaned up before it is consulted
+	s.resumeState()
+
+	aborted, err := aborter.AbortStaleUploads(ctx, prefix, staleUploadAge)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to abort stale uploads")
+	}
+	if aborted > 0 {
+		log.Info().Msgf("Aborted %d stale uploads", aborted)
+	}
+}
+
+type fileStamp struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// runProgress records the files uploaded by a run so that a run interrupted
+// by a restart can skip them. All methods do nothing if state is disabled.
+type runProgress struct {
+	store     *state.Store
+	name      string
+	Completed map[string]fileStamp `json:"completed"`
+	dirty     bool
+	lastSave  time.Time
+}
+
+// loadRunProgress returns the progress of an interrupted run identified by
+// parts, or an empty progress if there is none
+func (s *Service) loadRunProgress(parts ...string) *runProgress {
+	progress := &runProgress{
+		Completed: make(map[string]fileStamp),
+		lastSave:  time.Now(),
+	}
+
+	store := s.resumeState()
+	if store == nil {
+		return progress
+	}
+	progress.store = store
+	progress.name = state.Name("run", parts...)
+
+	found, err := store.Load(progress.name, progress)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load progress of interrupted run")
+	} else if found {
+		log.Info().Msgf("Resuming interrupted run with %d files already uploaded", len(progress.Completed))
+	}
+	if progress.Completed == nil {
+		progress.Completed = make(map[string]fileStamp)
+	}
+	return progress
+}
+
+// done reports whether relPath was uploaded by the interrupted run and has
+// not changed since
+func (p *runProgress) done(relPath string, info os.FileInfo) bool {
+	stamp, ok := p.Completed[relPath]
+	return ok && stamp.Size == info.Size() && stamp.ModTime.Equal(info.ModTime())
+}
+
+// complete records that relPath was uploaded
+func (p *runProgress) complete(relPath string, info os.FileInfo) {
+	if p.store == nil {
+		return
+	}
+
+	p.Completed[relPath] = fileStamp{Size: info.Size(), ModTime: info.ModTime()}
+	p.dirty = true
+	if time.Since(p.lastSave) >= progressSaveInterval {
+		p.save()
+	}
+}
+
+// save persists the progress if it changed since it was last saved
+func (p *runProgress) save() {
+	if p.store == nil || !p.dirty {
+		return
+	}
+
+	if err := p.store.Save(p.name, p); err != nil {
+		log.Warn().Err(err).Msg("Failed to save run progress")
+	}
+	p.dirty = false
+	p.lastSave = time.Now()
+}
+
+// finish discards the progress once the run completed
+func (p *runProgress) finish() {
+	if p.store == nil {
+		return
+	}
+
+	if err := p.store.Delete(p.name); err != nil {
+		log.Warn().Err(err).Msg("Failed to delete run progress")
+	}
+	p.store = nil
+}
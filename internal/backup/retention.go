@@ -0,0 +1,190 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/encryption"
+	"github.com/pkkulhari/backme/internal/s3"
+	"github.com/pkkulhari/backme/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// backupTimeFormat is the timestamp in the keys of database dumps and
+// directory archives
+const backupTimeFormat = "2006-01-02_15-04-05"
+
+// retainedSuffixes are the extensions of the backups retention applies to
+var retainedSuffixes = []string{".sql", ".sql" + chunkedSuffix, ".tar.gz", ".tar.gz" + encryption.Extension}
+
+// timestampedBackup is a database dump or directory archive of a single run
+type timestampedBackup struct {
+	key  string
+	time time.Time
+}
+
+// archiveName returns the name archives of sourcePath are stored under
+func archiveName(sourcePath string) string {
+	return filepath.Base(filepath.Clean(sourcePath))
+}
+
+// listBackups returns the dumps or archives of name below prefix, newest
+// first. Backups of other names sharing name as a prefix are left out.
+func listBackups(ctx context.Context, backend storage.Storage, prefix, name string) ([]timestampedBackup, error) {
+	listPrefix := s3.GetObjectKey(prefix, name+"_")
+	keys, err := backend.ListObjects(ctx, listPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	var backups []timestampedBackup
+	for _, key := range keys {
+		rest := strings.TrimPrefix(key, listPrefix)
+		if len(rest) < len(backupTimeFormat) || !slices.Contains(retainedSuffixes, rest[len(backupTimeFormat):]) {
+			continue
+		}
+		t, err := time.ParseInLocation(backupTimeFormat, rest[:len(backupTimeFormat)], time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, timestampedBackup{key: key, time: t})
+	}
+
+	slices.SortFunc(backups, func(a, b timestampedBackup) int {
+		if c := b.time.Compare(a.time); c != 0 {
+			return c
+		}
+		return strings.Compare(b.key, a.key)
+	})
+	return backups, nil
+}
+
+// expiredBackups returns the backups retention doesn't keep, given backups
+// sorted newest first
+func expiredBackups(backups []timestampedBackup, retention *config.RetentionConfig, now time.Time) []timestampedBackup {
+	if retention == nil || (retention.KeepLast <= 0 && retention.MaxAge <= 0) {
+		return nil
+	}
+
+	var expired []timestampedBackup
+	for i, backup := range backups {
+		if i == 0 || i < retention.KeepLast || (retention.MaxAge > 0 && now.Sub(backup.time) < retention.MaxAge) {
+			continue
+		}
+		expired = append(expired, backup)
+	}
+	return expired
+}
+
+// PruneDatabase deletes the dumps of a database that the retention of
+// awsCfg doesn't keep from every destination and returns their keys. With
+// dryRun the dumps are only returned.
+func (s *Service) PruneDatabase(ctx context.Context, dbCfg *config.DatabaseConfig, awsCfg *config.AWSConfig, dryRun bool) ([]string, error) {
+	name := s.getDatabaseConfigForConfig(dbCfg).Name
+	return s.prune(ctx, awsCfg, s.databasePrefix(awsCfg), name, dryRun)
+}
+
+// PruneArchives is like PruneDatabase for the archives of a directory
+func (s *Service) PruneArchives(ctx context.Context, dirCfg *config.DirectoryConfig, awsCfg *config.AWSConfig, dryRun bool) ([]string, error) {
+	if dirCfg == nil {
+		return nil, fmt.Errorf("directory configuration is required")
+	}
+	return s.prune(ctx, awsCfg, s.directoryPrefix(awsCfg), archiveName(dirCfg.SourcePath), dryRun)
+}
+
+func (s *Service) prune(ctx context.Context, awsCfg *config.AWSConfig, prefix, name string, dryRun bool) ([]string, error) {
+	retention := s.getAWSConfigForConfig(awsCfg).AWS.Retention
+	if retention == nil {
+		return nil, fmt.Errorf("no retention is configured")
+	}
+
+	targets, err := s.openTargets(awsCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage: %w", err)
+	}
+	defer s.releaseTargets(targets)
+
+	var pruned []string
+	var errs []error
+	for _, t := range targets {
+		if t.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", t.name, t.err))
+			continue
+		}
+		keys, err := pruneBackups(ctx, t.storage, retention, prefix, name, dryRun)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", t.name, err))
+		}
+		for _, key := range keys {
+			if !slices.Contains(pruned, key) {
+				pruned = append(pruned, key)
+			}
+		}
+	}
+	return pruned, errors.Join(errs...)
+}
+
+// applyRetention prunes the dumps or archives of name after a backup to
+// backend. Failures are logged, since the backup itself succeeded.
+func (s *Service) applyRetention(ctx context.Context, backend storage.Storage, awsCfg *config.AWSConfig, prefix, name string) {
+	retention := s.getAWSConfigForConfig(awsCfg).AWS.Retention
+	if retention == nil {
+		return
+	}
+	if _, err := pruneBackups(ctx, backend, retention, prefix, name, false); err != nil {
+		log.Error().Err(err).Str("name", name).Msg("Failed to prune old backups")
+	}
+}
+
+// pruneBackups deletes the backups of name below prefix that retention
+// doesn't keep and returns their keys
+func pruneBackups(ctx context.Context, backend storage.Storage, retention *config.RetentionConfig, prefix, name string, dryRun bool) ([]string, error) {
+	backups, err := listBackups(ctx, backend, prefix, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var pruned []string
+	for _, backup := range expiredBackups(backups, retention, time.Now()) {
+		if locked, err := isLocked(ctx, backend, backup.key); err != nil {
+			return pruned, err
+		} else if locked {
+			continue
+		}
+		if !dryRun {
+			if err := backend.DeleteObject(ctx, backup.key); errors.Is(err, storage.ErrLocked) {
+				log.Warn().Err(err).Msgf("Kept locked backup %s", backup.key)
+				continue
+			} else if err != nil {
+				return pruned, fmt.Errorf("failed to delete backup %s: %w", backup.key, err)
+			}
+			log.Info().Msgf("Pruned backup %s", backup.key)
+		}
+		pruned = append(pruned, backup.key)
+	}
+	return pruned, nil
+}
+
+// isLocked reports whether a retention date or legal hold keeps key from
+// being deleted, and logs why
+func isLocked(ctx context.Context, backend storage.Storage, key string) (bool, error) {
+	info, err := backend.GetObjectMetadata(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to get metadata of backup %s: %w", key, err)
+	}
+	switch {
+	case info.LegalHold:
+		log.Warn().Msgf("Kept backup %s with a legal hold", key)
+		return true, nil
+	case info.RetainUntil.After(time.Now()):
+		log.Warn().Msgf("Kept backup %s locked until %s", key, info.RetainUntil.Format(time.RFC3339))
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,158 @@
+package backup
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// uploadBackups stores empty objects under keys
+func uploadBackups(t *testing.T, backend *memoryStorage, keys ...string) {
+	for _, key := range keys {
+		require.NoError(t, backend.Upload(context.Background(), key, strings.NewReader("")))
+	}
+}
+
+func TestListBackups(t *testing.T) {
+	backend := newMemoryStorage()
+	uploadBackups(t, backend,
+		"database/app_2025-01-01_00-00-00.sql",
+		"database/app_2025-01-03_00-00-00.sql.chunks",
+		"database/app_2025-01-02_00-00-00.tar.gz.enc",
+		"database/app_old_2025-01-01_00-00-00.sql",
+		"database/app_2025-01-04_00-00-00.sql.tmp",
+		"database/app_latest.sql",
+	)
+
+	backups, err := listBackups(context.Background(), backend, "database", "app")
+	require.NoError(t, err)
+
+	var keys []string
+	for _, backup := range backups {
+		keys = append(keys, backup.key)
+	}
+	assert.Equal(t, []string{
+		"database/app_2025-01-03_00-00-00.sql.chunks",
+		"database/app_2025-01-02_00-00-00.tar.gz.enc",
+		"database/app_2025-01-01_00-00-00.sql",
+	}, keys)
+}
+
+func TestExpiredBackups(t *testing.T) {
+	now := time.Now()
+	var backups []timestampedBackup
+	for _, age := range []time.Duration{0, 24 * time.Hour, 48 * time.Hour, 72 * time.Hour} {
+		backups = append(backups, timestampedBackup{key: age.String(), time: now.Add(-age)})
+	}
+
+	tests := []struct {
+		name      string
+		retention *config.RetentionConfig
+		want      []string
+	}{
+		{name: "no retention", retention: nil},
+		{name: "keep last", retention: &config.RetentionConfig{KeepLast: 2}, want: []string{"48h0m0s", "72h0m0s"}},
+		{name: "max age", retention: &config.RetentionConfig{MaxAge: 36 * time.Hour}, want: []string{"48h0m0s", "72h0m0s"}},
+		{name: "either keeps", retention: &config.RetentionConfig{KeepLast: 3, MaxAge: 36 * time.Hour}, want: []string{"72h0m0s"}},
+		{name: "newest is always kept", retention: &config.RetentionConfig{MaxAge: time.Nanosecond}, want: []string{"24h0m0s", "48h0m0s", "72h0m0s"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, backup := range expiredBackups(backups, tt.retention, now) {
+				got = append(got, backup.key)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestArchiveRetention(t *testing.T) {
+	ctx := context.Background()
+	backend := newMemoryStorage()
+	retention := &config.RetentionConfig{KeepLast: 2}
+	s := New(&config.Config{StateDir: t.TempDir(), AWS: config.AWSConfig{DirectoryPrefix: "archives", Retention: retention}}, backend)
+
+	source := t.TempDir()
+	writeFiles(t, source, map[string]string{"a.txt": "a"})
+	name := archiveName(source)
+	uploadBackups(t, backend,
+		"archives/"+name+"_2025-01-01_00-00-00.tar.gz",
+		"archives/"+name+"_2025-01-02_00-00-00.tar.gz",
+	)
+
+	dirCfg := &config.DirectoryConfig{SourcePath: source, Mode: config.DirectoryModeArchive}
+
+	pruned, err := s.PruneArchives(ctx, dirCfg, nil, true)
+	require.NoError(t, err)
+	assert.Empty(t, pruned)
+
+	// The new archive is kept along with the newest of the earlier ones
+	require.NoError(t, s.BackupDirectory(ctx, dirCfg, nil))
+	keys := backend.keys()
+	require.Len(t, keys, 2)
+	assert.Equal(t, "archives/"+name+"_2025-01-02_00-00-00.tar.gz", keys[0])
+
+	retention.KeepLast = 1
+	pruned, err = s.PruneArchives(ctx, dirCfg, nil, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"archives/" + name + "_2025-01-02_00-00-00.tar.gz"}, pruned)
+	assert.Len(t, backend.keys(), 2)
+
+	pruned, err = s.PruneArchives(ctx, dirCfg, nil, false)
+	require.NoError(t, err)
+	assert.Len(t, pruned, 1)
+	assert.Equal(t, []string{keys[1]}, backend.keys())
+
+	s.cfg.AWS.Retention = nil
+	_, err = s.PruneArchives(ctx, dirCfg, nil, false)
+	assert.ErrorContains(t, err, "no retention is configured")
+}
+
+// lockingStorage reports a retention date on the objects in locked
+type lockingStorage struct {
+	*memoryStorage
+	locked map[string]time.Time
+}
+
+func (l *lockingStorage) GetObjectMetadata(ctx context.Context, key string) (*storage.ObjectInfo, error) {
+	info, err := l.memoryStorage.GetObjectMetadata(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	info.RetainUntil = l.locked[key]
+	return info, nil
+}
+
+func TestPruneKeepsLockedBackups(t *testing.T) {
+	ctx := context.Background()
+	backend := &lockingStorage{memoryStorage: newMemoryStorage(), locked: map[string]time.Time{
+		"database/app_2025-01-01_00-00-00.sql": time.Now().Add(time.Hour),
+		"database/app_2025-01-02_00-00-00.sql": time.Now().Add(-time.Hour),
+	}}
+	uploadBackups(t, backend.memoryStorage,
+		"database/app_2025-01-01_00-00-00.sql",
+		"database/app_2025-01-02_00-00-00.sql",
+		"database/app_2025-01-03_00-00-00.sql",
+	)
+
+	retention := &config.RetentionConfig{KeepLast: 1}
+	pruned, err := pruneBackups(ctx, backend, retention, "database", "app", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"database/app_2025-01-02_00-00-00.sql"}, pruned)
+
+	pruned, err = pruneBackups(ctx, backend, retention, "database", "app", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"database/app_2025-01-02_00-00-00.sql"}, pruned)
+
+	keys, err := backend.ListObjects(ctx, "database/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"database/app_2025-01-01_00-00-00.sql", "database/app_2025-01-03_00-00-00.sql"}, keys)
+}
@@ -0,0 +1,497 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/chunkstore"
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/history"
+	"github.com/pkkulhari/backme/internal/s3"
+	"github.com/pkkulhari/backme/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// Manifest describes a single directory snapshot
+type Manifest struct {
+	Source  string          `json:"source"`
+	Time    time.Time       `json:"time"`
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// ManifestEntry is a single path in a snapshot. Regular files reference
+// their content by hash, links and special files only carry metadata.
+type ManifestEntry struct {
+	Path       string      `json:"path"`
+	Type       string      `json:"type"`
+	Hash       string      `json:"hash,omitempty"`
+	Size       int64       `json:"size"`
+	Mode       os.FileMode `json:"mode"`
+	ModTime    time.Time   `json:"mod_time"`
+	LinkTarget string      `json:"link_target,omitempty"`
+	Chunks     []string    `json:"chunks,omitempty"`
+}
+
+// SnapshotChange is a difference between two snapshots
+type SnapshotChange struct {
+	Path   string
+	Change string // added, removed or modified
+}
+
+// snapshotTimeFormat is the timestamp format in manifest keys. It includes
+// nanoseconds so that snapshots taken within the same second don't
+// overwrite each other.
+const snapshotTimeFormat = "2006-01-02_15-04-05.000000000"
+
+// legacySnapshotTimeFormat is the timestamp format in manifest keys written
+// by earlier versions
+const legacySnapshotTimeFormat = "2006-01-02_15-04-05"
+
+// snapshotRoot returns the prefix of manifests, content and chunks of
+// snapshots. It is kept apart from the directory prefix, below which files
+// mode backups with --delete remove everything they don't know.
+func (s *Service) snapshotRoot(awsCfg *config.AWSConfig) string {
+	return s.directoryPrefix(awsCfg) + ".snapshots"
+}
+
+func (s *Service) snapshotPrefix(awsCfg *config.AWSConfig) string {
+	return s3.GetObjectKey(s.snapshotRoot(awsCfg), "manifests")
+}
+
+func (s *Service) contentKey(awsCfg *config.AWSConfig, hash string) string {
+	return s3.GetObjectKey(s.snapshotRoot(awsCfg), "objects", hash[:2], hash)
+}
+
+// backupDirectorySnapshot uploads the content of every changed file once
+// under its content hash and writes a manifest describing the whole tree
+func (s *Service) backupDirectorySnapshot(ctx context.Context, backend storage.Storage, dirCfg *config.DirectoryConfig, awsCfg *config.AWSConfig) error {
+	sourcePath := dirCfg.SourcePath
+	name := filepath.Base(filepath.Clean(sourcePath))
+
+	// Content that is already stored does not need to be uploaded again. With
+	// dedup enabled, file content goes to the chunk store instead.
+	var store *chunkstore.Store
+	stored := make(map[string]struct{})
+	if dirCfg.Dedup {
+		var err error
+		store, err = chunkstore.Open(ctx, backend, chunkStorePrefix(s.snapshotRoot(awsCfg)))
+		if err != nil {
+			return err
+		}
+	} else {
+		objectsPrefix := s3.GetObjectKey(s.snapshotRoot(awsCfg), "objects") + "/"
+		objects, err := backend.ListObjects(ctx, objectsPrefix)
+		if err != nil {
+			return fmt.Errorf("failed to list objects in S3: %w", err)
+		}
+		for _, key := range objects {
+			stored[key] = struct{}{}
+		}
+	}
+
+	// Files whose size and modification time match the latest snapshot keep
+	// their previous hash and don't have to be read again
+	previous := make(map[string]ManifestEntry)
+	if latest, err := s.latestSnapshot(ctx, backend, awsCfg, name); err != nil {
+		return err
+	} else if latest != nil {
+		for _, entry := range latest.Entries {
+			previous[entry.Path] = entry
+		}
+	}
+
+	manifest := &Manifest{
+		Source: sourcePath,
+		Time:   time.Now(),
+	}
+
+	err := walkDirectory(sourcePath, dirCfg.Symlinks, dirCfg.SpecialFiles, func(entry walkEntry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		manifestEntry := ManifestEntry{
+			Path:       filepath.ToSlash(entry.relPath),
+			Size:       entry.info.Size(),
+			Mode:       entry.info.Mode(),
+			ModTime:    entry.info.ModTime(),
+			LinkTarget: entry.linkTarget,
+		}
+
+		switch entry.kind {
+		case entrySymlink:
+			manifestEntry.Type = "symlink"
+		case entryHardlink:
+			manifestEntry.Type = "hardlink"
+			manifestEntry.LinkTarget = filepath.ToSlash(entry.linkTarget)
+		case entrySpecial:
+			manifestEntry.Type = specialFileType(entry.info.Mode())
+		default:
+			manifestEntry.Type = "file"
+
+			prev, ok := previous[manifestEntry.Path]
+			unchanged := ok && prev.Type == "file" && prev.Size == manifestEntry.Size && prev.ModTime.Equal(manifestEntry.ModTime)
+
+			if store != nil {
+				if unchanged && (len(prev.Chunks) > 0 || prev.Size == 0) {
+					manifestEntry.Hash = prev.Hash
+					manifestEntry.Chunks = prev.Chunks
+				} else {
+					recipe, err := writeFileChunks(ctx, store, entry.path)
+					if err != nil {
+						return err
+					}
+					manifestEntry.Hash = recipe.Hash
+					manifestEntry.Chunks = recipe.Chunks
+					history.StatsFrom(ctx).AddFile(entry.relPath, manifestEntry.Size)
+					log.Debug().Msgf("Chunked file: %s", entry.relPath)
+				}
+				break
+			}
+
+			if unchanged {
+				manifestEntry.Hash = prev.Hash
+				break
+			}
+
+			hash, uploaded, err := s.storeContent(ctx, backend, awsCfg, entry.path, stored)
+			if err != nil {
+				return err
+			}
+			manifestEntry.Hash = hash
+			if uploaded {
+				history.StatsFrom(ctx).AddFile(entry.relPath, manifestEntry.Size)
+				log.Debug().Msgf("Uploaded file: %s", entry.relPath)
+			}
+		}
+
+		manifest.Entries = append(manifest.Entries, manifestEntry)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to backup directory: %w", err)
+	}
+
+	if store != nil {
+		if err := store.Flush(ctx); err != nil {
+			return fmt.Errorf("failed to backup directory: %w", err)
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	key := s3.GetObjectKey(s.snapshotPrefix(awsCfg), fmt.Sprintf("%s_%s.json", name, manifest.Time.Format(snapshotTimeFormat)))
+	if err := backend.Upload(ctx, key, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to upload manifest to S3: %w", err)
+	}
+	history.StatsFrom(ctx).AddKey(key)
+
+	log.Info().Msgf("Successfully created snapshot %s of directory %s", key, sourcePath)
+	return nil
+}
+
+func writeFileChunks(ctx context.Context, store *chunkstore.Store, path string) (*chunkstore.Recipe, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	recipe, err := store.Write(ctx, file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to chunk file %s: %w", path, err)
+	}
+	return recipe, nil
+}
+
+// storeContent uploads the content of the file at path under its hash,
+// unless content with that hash is already stored. The file is read once
+// into a temporary copy, so that the uploaded content always matches the
+// hash even if the file changes in the meantime.
+func (s *Service) storeContent(ctx context.Context, backend storage.Storage, awsCfg *config.AWSConfig, path string, stored map[string]struct{}) (string, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	tmpFile, err := os.CreateTemp("", "backme-content-*")
+	if err != nil {
+		return "", false, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmpFile, hasher), file); err != nil {
+		return "", false, fmt.Errorf("failed to read file %s: %w", path, err)
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	key := s.contentKey(awsCfg, hash)
+	if _, exists := stored[key]; exists {
+		return hash, false, nil
+	}
+
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		return "", false, fmt.Errorf("failed to rewind temporary file: %w", err)
+	}
+	if err := backend.Upload(ctx, key, tmpFile); err != nil {
+		return "", false, fmt.Errorf("failed to upload file %s to S3: %w", path, err)
+	}
+	stored[key] = struct{}{}
+	return hash, true, nil
+}
+
+// snapshotSource returns the source directory name of a manifest key of the
+// form <name>_<timestamp>.json
+func snapshotSource(key string) (string, bool) {
+	base, ok := strings.CutSuffix(path.Base(key), ".json")
+	if !ok {
+		return "", false
+	}
+
+	for _, format := range []string{snapshotTimeFormat, legacySnapshotTimeFormat} {
+		if len(base) <= len(format)+1 {
+			continue
+		}
+
+		name, stamp := base[:len(base)-len(format)-1], base[len(base)-len(format):]
+		if base[len(name)] != '_' {
+			continue
+		}
+		if _, err := time.Parse(format, stamp); err == nil {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (s *Service) listSnapshots(ctx context.Context, backend storage.Storage, awsCfg *config.AWSConfig, name string) ([]string, error) {
+	prefix := s.snapshotPrefix(awsCfg) + "/"
+	if name != "" {
+		prefix += name + "_"
+	}
+
+	keys, err := backend.ListObjects(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	// Sources whose name starts with name followed by an underscore share
+	// the prefix, so only keys naming exactly this source are kept
+	keys = slices.DeleteFunc(keys, func(key string) bool {
+		source, ok := snapshotSource(key)
+		return !ok || (name != "" && source != name)
+	})
+
+	// Keys end with a sortable timestamp, so sorting them orders snapshots of the same source by time
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *Service) latestSnapshot(ctx context.Context, backend storage.Storage, awsCfg *config.AWSConfig, name string) (*Manifest, error) {
+	keys, err := s.listSnapshots(ctx, backend, awsCfg, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return loadManifest(ctx, backend, keys[len(keys)-1])
+}
+
+func loadManifest(ctx context.Context, backend storage.Storage, key string) (*Manifest, error) {
+	body, err := backend.Download(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download snapshot %s: %w", key, err)
+	}
+	defer body.Close()
+
+	var manifest Manifest
+	if err := json.NewDecoder(body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %s: %w", key, err)
+	}
+	return &manifest, nil
+}
+
+// ListSnapshots returns the manifest keys of all snapshots, optionally only
+// those of sources with the given directory name, oldest first
+func (s *Service) ListSnapshots(ctx context.Context, name string, awsCfg *config.AWSConfig) ([]string, error) {
+	backend, err := s.getStorageForConfig(awsCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage: %w", err)
+	}
+	defer s.releaseStorage(backend)
+	return s.listSnapshots(ctx, backend, awsCfg, name)
+}
+
+// GetSnapshot downloads and decodes the manifest stored under key
+func (s *Service) GetSnapshot(ctx context.Context, key string, awsCfg *config.AWSConfig) (*Manifest, error) {
+	backend, err := s.getStorageForConfig(awsCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage: %w", err)
+	}
+	defer s.releaseStorage(backend)
+	return loadManifest(ctx, backend, key)
+}
+
+// DiffSnapshots returns the paths that were added, removed or modified
+// between the snapshots stored under fromKey and toKey
+func (s *Service) DiffSnapshots(ctx context.Context, fromKey, toKey string, awsCfg *config.AWSConfig) ([]SnapshotChange, error) {
+	from, err := s.GetSnapshot(ctx, fromKey, awsCfg)
+	if err != nil {
+		return nil, err
+	}
+	to, err := s.GetSnapshot(ctx, toKey, awsCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	fromEntries := make(map[string]ManifestEntry, len(from.Entries))
+	for _, entry := range from.Entries {
+		fromEntries[entry.Path] = entry
+	}
+
+	var changes []SnapshotChange
+	for _, entry := range to.Entries {
+		prev, ok := fromEntries[entry.Path]
+		switch {
+		case !ok:
+			changes = append(changes, SnapshotChange{Path: entry.Path, Change: "added"})
+		case prev.Type != entry.Type || prev.Hash != entry.Hash || prev.LinkTarget != entry.LinkTarget || prev.Mode != entry.Mode:
+			changes = append(changes, SnapshotChange{Path: entry.Path, Change: "modified"})
+		}
+		delete(fromEntries, entry.Path)
+	}
+	for path := range fromEntries {
+		changes = append(changes, SnapshotChange{Path: path, Change: "removed"})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// RestoreSnapshot restores every path of the snapshot stored under key into targetPath
+func (s *Service) RestoreSnapshot(ctx context.Context, key string, targetPath string, awsCfg *config.AWSConfig) error {
+	log.Info().Msgf("Restoring snapshot %s to %s", key, targetPath)
+
+	backend, err := s.getStorageForConfig(awsCfg)
+	if err != nil {
+		return fmt.Errorf("failed to open storage: %w", err)
+	}
+	defer s.releaseStorage(backend)
+
+	manifest, err := loadManifest(ctx, backend, key)
+	if err != nil {
+		return err
+	}
+
+	// Open the chunk store only if the snapshot was taken with dedup enabled
+	var store *chunkstore.Store
+	for _, entry := range manifest.Entries {
+		if len(entry.Chunks) > 0 {
+			store, err = chunkstore.Open(ctx, backend, chunkStorePrefix(s.snapshotRoot(awsCfg)))
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	for _, entry := range manifest.Entries {
+		if err := s.restoreManifestEntry(ctx, backend, store, awsCfg, targetPath, entry); err != nil {
+			return err
+		}
+	}
+
+	log.Info().Msgf("Successfully restored snapshot %s to %s", key, targetPath)
+	return nil
+}
+
+func (s *Service) restoreManifestEntry(ctx context.Context, backend storage.Storage, store *chunkstore.Store, awsCfg *config.AWSConfig, targetPath string, entry ManifestEntry) error {
+	path, err := restorePath(targetPath, entry.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+
+	switch entry.Type {
+	case "file":
+		file, err := createFile(path, entry.Mode.Perm())
+		if err != nil {
+			return fmt.Errorf("failed to create file %s: %w", path, err)
+		}
+		defer file.Close()
+
+		switch {
+		case len(entry.Chunks) > 0:
+			recipe := &chunkstore.Recipe{Size: entry.Size, Hash: entry.Hash, Chunks: entry.Chunks}
+			if err := store.Restore(ctx, recipe, file); err != nil {
+				return fmt.Errorf("failed to restore content of %s: %w", entry.Path, err)
+			}
+		case entry.Size > 0:
+			body, err := backend.Download(ctx, s.contentKey(awsCfg, entry.Hash))
+			if err != nil {
+				return fmt.Errorf("failed to download content of %s: %w", entry.Path, err)
+			}
+			defer body.Close()
+
+			if _, err := io.Copy(file, body); err != nil {
+				return fmt.Errorf("failed to write file %s: %w", path, err)
+			}
+		}
+		if err := os.Chtimes(path, entry.ModTime, entry.ModTime); err != nil {
+			return fmt.Errorf("failed to set modification time of %s: %w", path, err)
+		}
+
+	case "symlink":
+		os.Remove(path)
+		if err := os.Symlink(entry.LinkTarget, path); err != nil {
+			return fmt.Errorf("failed to create symlink %s: %w", path, err)
+		}
+
+	case "hardlink":
+		target, err := restorePath(targetPath, entry.LinkTarget)
+		if err != nil {
+			return err
+		}
+		os.Remove(path)
+		if err := os.Link(target, path); err != nil {
+			return fmt.Errorf("failed to create hardlink %s: %w", path, err)
+		}
+
+	case "fifo":
+		os.Remove(path)
+		if err := syscall.Mkfifo(path, uint32(entry.Mode.Perm())); err != nil {
+			return fmt.Errorf("failed to create FIFO %s: %w", path, err)
+		}
+
+	default:
+		log.Warn().Msgf("Skipping unsupported snapshot entry %s of type %s", entry.Path, entry.Type)
+		return nil
+	}
+
+	log.Debug().Msgf("Restored file: %s", entry.Path)
+	return nil
+}
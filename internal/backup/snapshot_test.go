@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotSource(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+		ok   bool
+	}{
+		{key: ".snapshots/manifests/docs_2025-01-01_00-00-00.123456789.json", want: "docs", ok: true},
+		{key: ".snapshots/manifests/docs_2025-01-01_00-00-00.json", want: "docs", ok: true},
+		{key: ".snapshots/manifests/my_docs_2025-01-01_00-00-00.000000000.json", want: "my_docs", ok: true},
+		{key: ".snapshots/manifests/docs_2025-01-01.json"},
+		{key: ".snapshots/manifests/docs_2025-01-01_00-00-00.123.json"},
+		{key: ".snapshots/manifests/docs_2025-01-01_00-00-00.000000000.tmp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			name, ok := snapshotSource(tt.key)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, name)
+		})
+	}
+}
+
+func TestSnapshotsWithinOneSecond(t *testing.T) {
+	ctx := context.Background()
+	backend := newMemoryStorage()
+	s := New(&config.Config{StateDir: t.TempDir()}, backend)
+
+	source := t.TempDir()
+	writeFiles(t, source, map[string]string{"a.txt": "a"})
+	name := archiveName(source)
+	require.NoError(t, backend.Upload(ctx, ".snapshots/manifests/"+name+"_2025-01-01_00-00-00.json", strings.NewReader("{}")))
+
+	dirCfg := &config.DirectoryConfig{SourcePath: source, Mode: config.DirectoryModeSnapshot}
+	for range 3 {
+		require.NoError(t, s.BackupDirectory(ctx, dirCfg, nil))
+	}
+
+	// Every snapshot is kept, along with the one in the old key format
+	keys, err := s.ListSnapshots(ctx, name, nil)
+	require.NoError(t, err)
+	require.Len(t, keys, 4)
+	assert.Equal(t, ".snapshots/manifests/"+name+"_2025-01-01_00-00-00.json", keys[0])
+
+	manifest, err := s.GetSnapshot(ctx, keys[3], nil)
+	require.NoError(t, err)
+	require.Len(t, manifest.Entries, 1)
+	assert.Equal(t, "a.txt", manifest.Entries[0].Path)
+}
@@ -0,0 +1,128 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/storage"
+)
+
+// memoryStorage is a storage.Storage that keeps objects in memory
+type memoryStorage struct {
+	mu      sync.Mutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data         []byte
+	metadata     map[string]string
+	lastModified time.Time
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{objects: make(map[string]memoryObject)}
+}
+
+func (m *memoryStorage) Upload(ctx context.Context, key string, reader io.Reader) error {
+	return m.UploadWithMetadata(ctx, key, reader, nil)
+}
+
+func (m *memoryStorage) UploadWithMetadata(ctx context.Context, key string, reader io.Reader, metadata map[string]string) error {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = memoryObject{data: data, metadata: maps.Clone(metadata), lastModified: time.Now()}
+	return nil
+}
+
+func (m *memoryStorage) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := m.get(key)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+func (m *memoryStorage) DownloadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	obj, err := m.get(key)
+	if err != nil {
+		return nil, err
+	}
+	end := min(offset+length, int64(len(obj.data)))
+	return io.NopCloser(bytes.NewReader(obj.data[offset:end])), nil
+}
+
+func (m *memoryStorage) ListObjects(ctx context.Context, prefix string) ([]string, error) {
+	infos, err := m.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(infos))
+	for _, info := range infos {
+		keys = append(keys, info.Key)
+	}
+	return keys, nil
+}
+
+func (m *memoryStorage) List(ctx context.Context, prefix string) ([]storage.ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var infos []storage.ObjectInfo
+	for key, obj := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, storage.ObjectInfo{Key: key, Size: int64(len(obj.data)), LastModified: obj.lastModified})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+func (m *memoryStorage) GetObjectMetadata(ctx context.Context, key string) (*storage.ObjectInfo, error) {
+	obj, err := m.get(key)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.ObjectInfo{
+		Key:          key,
+		Size:         int64(len(obj.data)),
+		LastModified: obj.lastModified,
+		Metadata:     maps.Clone(obj.metadata),
+	}, nil
+}
+
+func (m *memoryStorage) DeleteObject(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *memoryStorage) get(key string) (memoryObject, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj, ok := m.objects[key]
+	if !ok {
+		return memoryObject{}, fmt.Errorf("%w: %s", storage.ErrNotFound, key)
+	}
+	return obj, nil
+}
+
+// keys returns the keys of all stored objects
+func (m *memoryStorage) keys() []string {
+	keys, _ := m.ListObjects(context.Background(), "")
+	return keys
+}
@@ -0,0 +1,229 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+type entryKind int
+
+const (
+	entryFile entryKind = iota
+	entrySymlink
+	entryHardlink
+	entrySpecial
+)
+
+// walkEntry is a single non-directory entry found while walking a source tree
+type walkEntry struct {
+	path       string
+	relPath    string
+	info       os.FileInfo
+	kind       entryKind
+	linkTarget string
+}
+
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+type walker struct {
+	symlinks     string
+	specialFiles string
+	ancestors    map[fileID]struct{}
+	hardlinks    map[fileID]string
+	fn           func(walkEntry) error
+}
+
+func newWalker(symlinks, specialFiles string, fn func(walkEntry) error) (*walker, error) {
+	if symlinks == "" {
+		symlinks = config.SymlinksFollow
+	}
+	if specialFiles == "" {
+		specialFiles = config.SpecialFilesSkip
+	}
+
+	switch symlinks {
+	case config.SymlinksSkip, config.SymlinksPreserve, config.SymlinksFollow:
+	default:
+		return nil, config.Invalid(fmt.Errorf("invalid symlinks policy: %s", symlinks))
+	}
+	switch specialFiles {
+	case config.SpecialFilesSkip, config.SpecialFilesRecord:
+	default:
+		return nil, config.Invalid(fmt.Errorf("invalid special files policy: %s", specialFiles))
+	}
+
+	return &walker{
+		symlinks:     symlinks,
+		specialFiles: specialFiles,
+		ancestors:    make(map[fileID]struct{}),
+		hardlinks:    make(map[fileID]string),
+		fn:           fn,
+	}, nil
+}
+
+// walkDirectory walks root and calls fn for every file, symlink, hardlink and
+// special file according to the given policies. Directories are not reported.
+func walkDirectory(root string, symlinks, specialFiles string, fn func(walkEntry) error) error {
+	w, err := newWalker(symlinks, specialFiles, fn)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return w.visit(root, filepath.Base(root), info, false)
+	}
+	return w.walkDir(root, "", info)
+}
+
+// walkPath is like walkDirectory but only walks the entry at relPath below
+// root, reporting paths relative to root
+func walkPath(root, relPath string, symlinks, specialFiles string, fn func(walkEntry) error) error {
+	w, err := newWalker(symlinks, specialFiles, fn)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(root, relPath)
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return w.walkDir(path, relPath, info)
+	}
+	return w.visit(path, relPath, info, false)
+}
+
+func (w *walker) walkDir(path, relPath string, info os.FileInfo) error {
+	// Track the directories on the current path so that following a symlink
+	// back into one of them is detected as a loop
+	if id, _, ok := getFileID(info); ok {
+		if _, seen := w.ancestors[id]; seen {
+			log.Warn().Msgf("Symlink loop detected, skipping: %s", path)
+			return nil
+		}
+		w.ancestors[id] = struct{}{}
+		defer delete(w.ancestors, id)
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		childPath := filepath.Join(path, entry.Name())
+		childRel := filepath.Join(relPath, entry.Name())
+
+		childInfo, err := os.Lstat(childPath)
+		if err != nil {
+			return err
+		}
+
+		if childInfo.IsDir() {
+			if err := w.walkDir(childPath, childRel, childInfo); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := w.visit(childPath, childRel, childInfo, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *walker) visit(path, relPath string, info os.FileInfo, viaSymlink bool) error {
+	mode := info.Mode()
+
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return w.visitSymlink(path, relPath, info)
+
+	case mode.IsRegular():
+		// Files reached through a followed symlink are uploaded with their
+		// content rather than being recorded as hardlinks of the target
+		if !viaSymlink {
+			if id, nlink, ok := getFileID(info); ok && nlink > 1 {
+				if first, seen := w.hardlinks[id]; seen {
+					return w.fn(walkEntry{path: path, relPath: relPath, info: info, kind: entryHardlink, linkTarget: first})
+				}
+				w.hardlinks[id] = relPath
+			}
+		}
+		return w.fn(walkEntry{path: path, relPath: relPath, info: info, kind: entryFile})
+
+	default:
+		if w.specialFiles == config.SpecialFilesSkip {
+			log.Debug().Msgf("Skipping special file: %s", relPath)
+			return nil
+		}
+		return w.fn(walkEntry{path: path, relPath: relPath, info: info, kind: entrySpecial})
+	}
+}
+
+func (w *walker) visitSymlink(path, relPath string, info os.FileInfo) error {
+	switch w.symlinks {
+	case config.SymlinksSkip:
+		log.Debug().Msgf("Skipping symlink: %s", relPath)
+		return nil
+
+	case config.SymlinksPreserve:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return fmt.Errorf("failed to read symlink %s: %w", path, err)
+		}
+		return w.fn(walkEntry{path: path, relPath: relPath, info: info, kind: entrySymlink, linkTarget: target})
+	}
+
+	targetInfo, err := os.Stat(path)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Skipping broken symlink: %s", relPath)
+		return nil
+	}
+
+	if targetInfo.IsDir() {
+		return w.walkDir(path, relPath, targetInfo)
+	}
+	return w.visit(path, relPath, targetInfo, true)
+}
+
+func getFileID(info os.FileInfo) (fileID, uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, 0, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, uint64(stat.Nlink), true
+}
+
+// specialFileType returns a short name for the type of a special file
+func specialFileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeCharDevice != 0:
+		return "char-device"
+	case mode&os.ModeDevice != 0:
+		return "block-device"
+	default:
+		return "irregular"
+	}
+}
@@ -0,0 +1,205 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/s3"
+	"github.com/pkkulhari/backme/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultDebounce is how long a watched directory has to be quiet before
+// changed files are uploaded
+const DefaultDebounce = 5 * time.Second
+
+// RunGuard runs fn unless it would overlap with another run of the same
+// schedule, in which case fn may be delayed or its context cancelled
+type RunGuard func(ctx context.Context, fn func(ctx context.Context))
+
+// WatchDirectory keeps the S3 copy of a directory up to date by uploading and
+// deleting changed files shortly after they change. It performs a full sync
+// first and runs until ctx is cancelled. Periodic reconciliation is done by
+// BackupDirectory, which performs a full sync for watch mode schedules. Every
+// sync runs through guard, if one is given, so that it doesn't overlap with
+// the reconciliation.
+func (s *Service) WatchDirectory(ctx context.Context, dirCfg *config.DirectoryConfig, awsCfg *config.AWSConfig, guard RunGuard) error {
+	if dirCfg == nil {
+		return config.Invalid(fmt.Errorf("directory configuration is required"))
+	}
+
+	targets, err := s.openTargets(awsCfg)
+	if err != nil {
+		return fmt.Errorf("failed to open storage: %w", err)
+	}
+	defer s.releaseTargets(targets)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create file watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	sourcePath := dirCfg.SourcePath
+	if err := addWatches(watcher, sourcePath); err != nil {
+		return fmt.Errorf("failed to watch directory %s: %w", sourcePath, err)
+	}
+
+	if guard == nil {
+		guard = func(ctx context.Context, fn func(ctx context.Context)) { fn(ctx) }
+	}
+	var syncErr error
+	fullSync := func(ctx context.Context) {
+		if syncErr = s.BackupDirectory(ctx, dirCfg, awsCfg); syncErr != nil {
+			log.Error().Err(syncErr).Str("source", sourcePath).Msg("Failed to sync watched directory")
+		}
+	}
+
+	// Catch up with changes made while nothing was watching. Watching is
+	// pointless if the configuration keeps every sync from succeeding.
+	guard(ctx, fullSync)
+	if errors.Is(syncErr, config.ErrInvalid) {
+		return syncErr
+	}
+
+	debounce := dirCfg.Debounce
+	if debounce <= 0 {
+		debounce = DefaultDebounce
+	}
+	// Uploads are postponed while changes keep coming in, but never longer than this
+	maxDelay := 10 * debounce
+
+	log.Info().Str("source", sourcePath).Msg("Watching directory for changes")
+
+	changed := make(map[string]struct{})
+	var firstChange time.Time
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+
+			relPath, err := filepath.Rel(sourcePath, event.Name)
+			if err != nil || relPath == "." {
+				continue
+			}
+
+			// New directories need their own watch
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+					if err := addWatches(watcher, event.Name); err != nil {
+						log.Warn().Err(err).Msgf("Failed to watch new directory %s", event.Name)
+					}
+				}
+			}
+
+			if len(changed) == 0 {
+				firstChange = time.Now()
+			}
+			changed[relPath] = struct{}{}
+
+			delay := debounce
+			if remaining := maxDelay - time.Since(firstChange); remaining < delay {
+				delay = max(remaining, 0)
+			}
+			timer.Reset(delay)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			// Events may have been lost, so fall back to a full sync
+			log.Warn().Err(err).Str("source", sourcePath).Msg("File watcher error, running full sync")
+			guard(ctx, fullSync)
+
+		case <-timer.C:
+			paths := make([]string, 0, len(changed))
+			for relPath := range changed {
+				paths = append(paths, relPath)
+			}
+			sort.Strings(paths)
+			changed = make(map[string]struct{})
+
+			guard(ctx, func(ctx context.Context) {
+				for _, t := range targets {
+					if t.err != nil {
+						log.Error().Err(t.err).Str("source", sourcePath).Str("destination", t.name).Msg("Failed to sync changed paths")
+						continue
+					}
+					for _, relPath := range paths {
+						if err := s.syncChangedPath(ctx, t.storage, dirCfg, awsCfg, relPath); err != nil {
+							log.Error().Err(err).Str("source", sourcePath).Str("destination", t.name).Msgf("Failed to sync changed path %s", relPath)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+// syncChangedPath uploads the entry at relPath or, if it no longer exists
+// and deletion is enabled, deletes it and everything below it from S3
+func (s *Service) syncChangedPath(ctx context.Context, backend storage.Storage, dirCfg *config.DirectoryConfig, awsCfg *config.AWSConfig, relPath string) error {
+	prefix := s.directoryPrefix(awsCfg)
+	key := s3.GetObjectKey(prefix, relPath)
+
+	if _, err := os.Lstat(filepath.Join(dirCfg.SourcePath, relPath)); !os.IsNotExist(err) {
+		return walkPath(dirCfg.SourcePath, relPath, dirCfg.Symlinks, dirCfg.SpecialFiles, func(entry walkEntry) error {
+			if err := uploadEntry(ctx, backend, s3.GetObjectKey(prefix, entry.relPath), entry); err != nil {
+				return err
+			}
+			log.Debug().Msgf("Uploaded file: %s", entry.relPath)
+			return nil
+		})
+	}
+
+	if !dirCfg.Delete {
+		return nil
+	}
+
+	keys, err := backend.ListObjects(ctx, key+"/")
+	if err != nil {
+		return fmt.Errorf("failed to list objects in S3: %w", err)
+	}
+	for _, k := range append(keys, key) {
+		if err := backend.DeleteObject(ctx, k); errors.Is(err, storage.ErrLocked) {
+			log.Warn().Err(err).Msgf("Kept locked object of deleted file %s", k)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to delete object %s from S3: %w", k, err)
+		}
+		log.Debug().Msgf("Deleted file from S3: %s", k)
+	}
+	return nil
+}
+
+// addWatches watches root and every directory below it
+func addWatches(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}
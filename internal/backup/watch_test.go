@@ -0,0 +1,58 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchDirectoryRunsThroughGuard(t *testing.T) {
+	source := t.TempDir()
+	writeFiles(t, source, map[string]string{"a.txt": "a"})
+	backend := newMemoryStorage()
+	s := New(&config.Config{StateDir: t.TempDir(), AWS: config.AWSConfig{DirectoryPrefix: "docs"}}, backend)
+
+	// Nothing is uploaded while a scheduled run holds the guard
+	var mu sync.Mutex
+	guarded := 0
+	guard := func(ctx context.Context, fn func(ctx context.Context)) {
+		mu.Lock()
+		defer mu.Unlock()
+		guarded++
+		fn(ctx)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.WatchDirectory(ctx, &config.DirectoryConfig{SourcePath: source, Mode: config.DirectoryModeWatch, Debounce: 10 * time.Millisecond}, nil, guard)
+	}()
+
+	hasKey := func(key string) bool {
+		keys, err := backend.ListObjects(context.Background(), "docs/")
+		require.NoError(t, err)
+		return slices.Contains(keys, key)
+	}
+	require.Eventually(t, func() bool { return hasKey("docs/a.txt") }, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	require.NoError(t, os.WriteFile(filepath.Join(source, "b.txt"), []byte("b"), 0644))
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, hasKey("docs/b.txt"))
+	mu.Unlock()
+	require.Eventually(t, func() bool { return hasKey("docs/b.txt") }, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.GreaterOrEqual(t, guarded, 2)
+}
@@ -0,0 +1,93 @@
+package chunkstore
+
+import (
+	"io"
+)
+
+// Chunk size bounds of the content-defined chunker
+const (
+	MinChunkSize = 512 << 10
+	AvgChunkSize = 1 << 20
+	MaxChunkSize = 8 << 20
+)
+
+// chunkMask selects the top bits of the gear hash, a boundary is found when
+// they are all zero, which happens on average every AvgChunkSize bytes
+const chunkMask = uint64(AvgChunkSize-1) << 44
+
+var gearTable [256]uint64
+
+func init() {
+	// The table must never change, otherwise chunk boundaries of new backups
+	// no longer match those already stored
+	seed := uint64(0x6261636b6d65)
+	for i := range gearTable {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker splits a stream into content-defined chunks using a gear rolling
+// hash, so that inserting or removing data only changes nearby chunks
+type Chunker struct {
+	r     io.Reader
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{
+		r:   r,
+		buf: make([]byte, MaxChunkSize),
+	}
+}
+
+// Next returns the next chunk or io.EOF at the end of the stream. The
+// returned slice is only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.end-c.start < MaxChunkSize && !c.eof {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+
+		for c.end < len(c.buf) && !c.eof {
+			n, err := c.r.Read(c.buf[c.end:])
+			c.end += n
+			if err == io.EOF {
+				c.eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	data := c.buf[c.start:c.end]
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+
+	n := cutPoint(data)
+	c.start += n
+	return data[:n], nil
+}
+
+func cutPoint(data []byte) int {
+	if len(data) <= MinChunkSize {
+		return len(data)
+	}
+
+	limit := min(len(data), MaxChunkSize)
+	var hash uint64
+	for i := MinChunkSize; i < limit; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return limit
+}
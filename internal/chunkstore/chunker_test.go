@@ -0,0 +1,75 @@
+package chunkstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// randomData returns size bytes that are the same for every seed
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// chunks splits data and returns every chunk
+func chunks(t *testing.T, data []byte) [][]byte {
+	chunker := NewChunker(bytes.NewReader(data))
+	var result [][]byte
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return result
+		}
+		require.NoError(t, err)
+		result = append(result, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunkerBounds(t *testing.T) {
+	data := randomData(1, 32<<20)
+	result := chunks(t, data)
+	require.Greater(t, len(result), 1)
+
+	assert.Equal(t, data, bytes.Join(result, nil))
+	for i, chunk := range result[:len(result)-1] {
+		assert.GreaterOrEqual(t, len(chunk), MinChunkSize, "chunk %d", i)
+		assert.LessOrEqual(t, len(chunk), MaxChunkSize, "chunk %d", i)
+	}
+	assert.LessOrEqual(t, len(result[len(result)-1]), MaxChunkSize)
+
+	// Data without any cut point is split at the maximum size
+	result = chunks(t, make([]byte, 2*MaxChunkSize+1))
+	require.Len(t, result, 3)
+	assert.Len(t, result[0], MaxChunkSize)
+	assert.Len(t, result[1], MaxChunkSize)
+	assert.Len(t, result[2], 1)
+}
+
+func TestChunkerStableAfterInsertion(t *testing.T) {
+	data := randomData(2, 16<<20)
+	inserted := append(randomData(3, 1000), data...)
+
+	before := make(map[[32]byte]bool)
+	for _, chunk := range chunks(t, data) {
+		before[sha256.Sum256(chunk)] = true
+	}
+
+	after := chunks(t, inserted)
+	shared := 0
+	for _, chunk := range after {
+		if before[sha256.Sum256(chunk)] {
+			shared++
+		}
+	}
+
+	// Only the chunks around the insertion change
+	assert.GreaterOrEqual(t, shared, len(after)-2)
+	assert.Greater(t, shared, 0)
+}
@@ -0,0 +1,224 @@
+package chunkstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkkulhari/backme/internal/s3"
+	"github.com/pkkulhari/backme/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// PackSize is the size at which pending chunks are uploaded as a pack object
+const PackSize = 16 << 20
+
+// Recipe lists the chunks needed to reassemble a stream
+type Recipe struct {
+	Size   int64    `json:"size"`
+	Hash   string   `json:"hash"`
+	Chunks []string `json:"chunks"`
+}
+
+type packIndex struct {
+	Chunks []indexEntry `json:"chunks"`
+}
+
+type indexEntry struct {
+	Hash   string `json:"hash"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+type location struct {
+	pack   string
+	offset int64
+	length int64
+}
+
+// Store keeps deduplicated chunks in pack objects below a prefix. Every pack
+// has an index object listing the chunks it contains. Packs are never
+// garbage-collected: chunks stay stored after the last recipe referencing
+// them is gone, so the store only grows.
+type Store struct {
+	client  storage.Storage
+	prefix  string
+	index   map[string]location
+	pending map[string]struct{}
+	pack    bytes.Buffer
+	entries []indexEntry
+}
+
+// Open loads the indexes of all packs below prefix
+func Open(ctx context.Context, client storage.Storage, prefix string) (*Store, error) {
+	store := &Store{
+		client:  client,
+		prefix:  prefix,
+		index:   make(map[string]location),
+		pending: make(map[string]struct{}),
+	}
+
+	keys, err := client.ListObjects(ctx, store.indexPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunk indexes: %w", err)
+	}
+
+	for _, key := range keys {
+		if err := store.loadIndex(ctx, key); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Debug().Msgf("Loaded %d chunks from %d packs", len(store.index), len(keys))
+	return store, nil
+}
+
+func (s *Store) packKey(id string) string {
+	return s3.GetObjectKey(s.prefix, "packs", id)
+}
+
+func (s *Store) indexPrefix() string {
+	return s3.GetObjectKey(s.prefix, "index") + "/"
+}
+
+func (s *Store) indexKey(id string) string {
+	return s3.GetObjectKey(s.prefix, "index", id+".json")
+}
+
+func (s *Store) loadIndex(ctx context.Context, key string) error {
+	body, err := s.client.Download(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to download chunk index %s: %w", key, err)
+	}
+	defer body.Close()
+
+	var idx packIndex
+	if err := json.NewDecoder(body).Decode(&idx); err != nil {
+		return fmt.Errorf("failed to decode chunk index %s: %w", key, err)
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(key, s.indexPrefix()), ".json")
+	for _, entry := range idx.Chunks {
+		s.index[entry.Hash] = location{pack: id, offset: entry.Offset, length: entry.Length}
+	}
+	return nil
+}
+
+// Write splits r into chunks, stores the ones not seen before and returns the
+// recipe to reassemble it. Flush must be called before the recipe is
+// persisted so that all of its chunks are uploaded.
+func (s *Store) Write(ctx context.Context, r io.Reader) (*Recipe, error) {
+	recipe := &Recipe{}
+	hasher := sha256.New()
+	chunker := NewChunker(io.TeeReader(r, hasher))
+
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunk: %w", err)
+		}
+
+		sum := sha256.Sum256(chunk)
+		hash := hex.EncodeToString(sum[:])
+		recipe.Chunks = append(recipe.Chunks, hash)
+		recipe.Size += int64(len(chunk))
+
+		if _, ok := s.index[hash]; ok {
+			continue
+		}
+		if _, ok := s.pending[hash]; ok {
+			continue
+		}
+
+		s.entries = append(s.entries, indexEntry{Hash: hash, Offset: int64(s.pack.Len()), Length: int64(len(chunk))})
+		s.pending[hash] = struct{}{}
+		s.pack.Write(chunk)
+
+		if s.pack.Len() >= PackSize {
+			if err := s.Flush(ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	recipe.Hash = hex.EncodeToString(hasher.Sum(nil))
+	return recipe, nil
+}
+
+// Flush uploads pending chunks as a new pack together with its index
+func (s *Store) Flush(ctx context.Context) error {
+	if len(s.entries) == 0 {
+		return nil
+	}
+
+	sum := sha256.Sum256(s.pack.Bytes())
+	id := hex.EncodeToString(sum[:])
+
+	if err := s.client.Upload(ctx, s.packKey(id), bytes.NewReader(s.pack.Bytes())); err != nil {
+		return fmt.Errorf("failed to upload chunk pack: %w", err)
+	}
+
+	data, err := json.Marshal(packIndex{Chunks: s.entries})
+	if err != nil {
+		return fmt.Errorf("failed to encode chunk index: %w", err)
+	}
+	// The index is written last so that it never references a missing pack
+	if err := s.client.Upload(ctx, s.indexKey(id), bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to upload chunk index: %w", err)
+	}
+
+	for _, entry := range s.entries {
+		s.index[entry.Hash] = location{pack: id, offset: entry.Offset, length: entry.Length}
+	}
+	log.Debug().Msgf("Uploaded chunk pack %s with %d chunks", id, len(s.entries))
+
+	s.pack.Reset()
+	s.entries = nil
+	s.pending = make(map[string]struct{})
+	return nil
+}
+
+// Restore reassembles the stream described by recipe into w. Every chunk
+// is verified before it is written, so corrupted data never reaches w.
+func (s *Store) Restore(ctx context.Context, recipe *Recipe, w io.Writer) error {
+	hasher := sha256.New()
+	w = io.MultiWriter(w, hasher)
+
+	for _, hash := range recipe.Chunks {
+		loc, ok := s.index[hash]
+		if !ok {
+			return fmt.Errorf("chunk %s not found in store", hash)
+		}
+
+		body, err := s.client.DownloadRange(ctx, s.packKey(loc.pack), loc.offset, loc.length)
+		if err != nil {
+			return fmt.Errorf("failed to download chunk %s: %w", hash, err)
+		}
+		chunk, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to download chunk %s: %w", hash, err)
+		}
+
+		sum := sha256.Sum256(chunk)
+		if hex.EncodeToString(sum[:]) != hash {
+			return fmt.Errorf("chunk %s is corrupted", hash)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return fmt.Errorf("failed to write chunk %s: %w", hash, err)
+		}
+	}
+
+	if recipe.Hash != "" && hex.EncodeToString(hasher.Sum(nil)) != recipe.Hash {
+		return fmt.Errorf("restored data does not match its recorded hash")
+	}
+	return nil
+}
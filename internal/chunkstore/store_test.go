@@ -0,0 +1,68 @@
+package chunkstore
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkkulhari/backme/internal/filesystem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	client, err := filesystem.New(t.TempDir())
+	require.NoError(t, err)
+
+	store, err := Open(ctx, client, "chunks")
+	require.NoError(t, err)
+
+	data := randomData(4, 4<<20)
+	recipe, err := store.Write(ctx, bytes.NewReader(data))
+	require.NoError(t, err)
+	require.NoError(t, store.Flush(ctx))
+	assert.Equal(t, int64(len(data)), recipe.Size)
+
+	// A new store finds the chunks through the pack index
+	reopened, err := Open(ctx, client, "chunks")
+	require.NoError(t, err)
+	assert.Equal(t, store.index, reopened.index)
+
+	var restored bytes.Buffer
+	require.NoError(t, reopened.Restore(ctx, recipe, &restored))
+	assert.Equal(t, data, restored.Bytes())
+
+	// Writing the same data again adds no pack
+	again, err := reopened.Write(ctx, bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, recipe, again)
+	assert.Empty(t, reopened.entries)
+}
+
+func TestRestoreRejectsCorruptedChunk(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	client, err := filesystem.New(root)
+	require.NoError(t, err)
+
+	store, err := Open(ctx, client, "chunks")
+	require.NoError(t, err)
+	recipe, err := store.Write(ctx, bytes.NewReader(randomData(5, 4<<20)))
+	require.NoError(t, err)
+	require.NoError(t, store.Flush(ctx))
+
+	loc := store.index[recipe.Chunks[0]]
+	path := filepath.Join(root, "chunks", "packs", loc.pack)
+	pack, err := os.ReadFile(path)
+	require.NoError(t, err)
+	pack[loc.offset] ^= 0xff
+	require.NoError(t, os.WriteFile(path, pack, 0o644))
+
+	var restored bytes.Buffer
+	err = store.Restore(ctx, recipe, &restored)
+	assert.ErrorContains(t, err, "chunk "+recipe.Chunks[0]+" is corrupted")
+	assert.Zero(t, restored.Len())
+}
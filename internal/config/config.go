@@ -1,27 +1,83 @@
 package config
 
+import "time"
+
 type Config struct {
 	LogLevel  string         `mapstructure:"log_level"`
+	StateDir  string         `mapstructure:"state_dir"`
+	Worker    WorkerConfig   `mapstructure:"worker"`
 	Database  DatabaseConfig `mapstructure:"database"`
 	AWS       AWSConfig      `mapstructure:"aws"`
 	Schedules Schedules      `mapstructure:"schedules"`
 }
 
+// WorkerConfig limits how many scheduled backups the worker runs at once.
+// Zero means unlimited.
+type WorkerConfig struct {
+	MaxConcurrentJobs int `mapstructure:"max_concurrent_jobs"`
+	MaxJobsPerHost    int `mapstructure:"max_jobs_per_host"`
+}
+
 type DatabaseConfig struct {
 	Host     string `mapstructure:"host"`
 	Port     int    `mapstructure:"port"`
 	User     string `mapstructure:"user"`
 	Password string `mapstructure:"password"`
 	Name     string `mapstructure:"name"`
+	Dedup    bool   `mapstructure:"dedup"`
 }
 
 type AWSConfig struct {
-	AccessKeyID     string `mapstructure:"access_key_id"`
-	SecretAccessKey string `mapstructure:"secret_access_key"`
-	Region          string `mapstructure:"region"`
-	Bucket          string `mapstructure:"bucket"`
-	DatabasePrefix  string `mapstructure:"database_prefix"`
-	DirectoryPrefix string `mapstructure:"directory_prefix"`
+	AccessKeyID       string   `mapstructure:"access_key_id"`
+	SecretAccessKey   string   `mapstructure:"secret_access_key"`
+	Region            string   `mapstructure:"region"`
+	Bucket            string   `mapstructure:"bucket"`
+	DatabasePrefix    string   `mapstructure:"database_prefix"`
+	DirectoryPrefix   string   `mapstructure:"directory_prefix"`
+	Destination       string   `mapstructure:"destination"`
+	Destinations      []string `mapstructure:"destinations"`
+	ReplicationPolicy string   `mapstructure:"replication_policy"`
+
+	// Credentials other than static keys. Without keys the default AWS
+	// credential chain is used, optionally with a named profile, and the
+	// resulting credentials can be used to assume a role.
+	Profile         string        `mapstructure:"profile"`
+	RoleARN         string        `mapstructure:"role_arn"`
+	ExternalID      string        `mapstructure:"external_id"`
+	SessionDuration time.Duration `mapstructure:"session_duration"`
+
+	// Settings for S3-compatible servers such as MinIO or Ceph
+	Endpoint           string `mapstructure:"endpoint"`
+	ForcePathStyle     bool   `mapstructure:"force_path_style"`
+	CABundle           string `mapstructure:"ca_bundle"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+	UnsignedPayload    bool   `mapstructure:"unsigned_payload"`
+	DisableChecksums   bool   `mapstructure:"disable_checksums"`
+
+	// Applied to every uploaded object
+	ServerSideEncryption string            `mapstructure:"server_side_encryption"`
+	SSEKMSKeyID          string            `mapstructure:"sse_kms_key_id"`
+	SSECustomerKey       string            `mapstructure:"sse_customer_key"`
+	StorageClass         string            `mapstructure:"storage_class"`
+	Tags                 map[string]string `mapstructure:"tags"`
+	Metadata             map[string]string `mapstructure:"metadata"`
+
+	// Object Lock settings, requiring a bucket with Object Lock enabled
+	ObjectLockMode      string        `mapstructure:"object_lock_mode"`
+	ObjectLockRetention time.Duration `mapstructure:"object_lock_retention"`
+	LegalHold           bool          `mapstructure:"legal_hold"`
+
+	// Retention of database dumps and directory archives
+	Retention *RetentionConfig `mapstructure:"retention,omitempty"`
+}
+
+// RetentionConfig decides which database dumps and directory archives are
+// kept when older ones are pruned. A backup is kept if it is one of the
+// newest KeepLast backups or younger than MaxAge, and the newest backup is
+// always kept.
+type RetentionConfig struct {
+	KeepLast int           `mapstructure:"keep_last"`
+	MaxAge   time.Duration `mapstructure:"max_age"`
 }
 
 type Schedules struct {
@@ -32,22 +88,113 @@ type Schedules struct {
 type DatabaseSchedule struct {
 	Name       string         `mapstructure:"name"`
 	Expression string         `mapstructure:"expression"`
+	Timezone   string         `mapstructure:"timezone"`
+	Jitter     time.Duration  `mapstructure:"jitter"`
+	CatchUp    string         `mapstructure:"catch_up"`
+	Overlap    string         `mapstructure:"overlap"`
+	Timeout    time.Duration  `mapstructure:"timeout"`
+	Priority   int            `mapstructure:"priority"`
 	Database   DatabaseConfig `mapstructure:"database"`
+	Retry      *RetryConfig   `mapstructure:"retry,omitempty"`
 	AWS        *AWSConfig     `mapstructure:"aws,omitempty"`
 }
 
+type DirectoryConfig struct {
+	SourcePath   string        `mapstructure:"source_path"`
+	Mode         string        `mapstructure:"mode"`
+	Sync         bool          `mapstructure:"sync"`
+	Delete       bool          `mapstructure:"delete"`
+	Symlinks     string        `mapstructure:"symlinks"`
+	SpecialFiles string        `mapstructure:"special_files"`
+	Dedup        bool          `mapstructure:"dedup"`
+	Debounce     time.Duration `mapstructure:"debounce"`
+
+	// EncryptionKeyFile holds the passphrase archives are encrypted with
+	EncryptionKeyFile string `mapstructure:"encryption_key_file"`
+}
+
 type DirectorySchedule struct {
-	Name       string     `mapstructure:"name"`
-	Expression string     `mapstructure:"expression"`
-	SourcePath string     `mapstructure:"source_path"`
-	Sync       bool       `mapstructure:"sync"`
-	Delete     bool       `mapstructure:"delete"`
-	AWS        *AWSConfig `mapstructure:"aws,omitempty"`
+	Name            string        `mapstructure:"name"`
+	Expression      string        `mapstructure:"expression"`
+	Timezone        string        `mapstructure:"timezone"`
+	Jitter          time.Duration `mapstructure:"jitter"`
+	CatchUp         string        `mapstructure:"catch_up"`
+	Overlap         string        `mapstructure:"overlap"`
+	Timeout         time.Duration `mapstructure:"timeout"`
+	Priority        int           `mapstructure:"priority"`
+	DirectoryConfig `mapstructure:",squash"`
+	Retry           *RetryConfig `mapstructure:"retry,omitempty"`
+	AWS             *AWSConfig   `mapstructure:"aws,omitempty"`
+}
+
+// RetryConfig controls how often a failed scheduled backup is retried.
+// Jitter is the fraction by which each backoff is randomly varied.
+type RetryConfig struct {
+	MaxAttempts    int           `mapstructure:"max_attempts"`
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"`
+	MaxBackoff     time.Duration `mapstructure:"max_backoff"`
+	Jitter         float64       `mapstructure:"jitter"`
 }
 
+// Directory backup modes
+const (
+	DirectoryModeFiles    = "files"
+	DirectoryModeArchive  = "archive"
+	DirectoryModeSnapshot = "snapshot"
+	DirectoryModeWatch    = "watch"
+)
+
+// Overlap policies deciding what happens when a schedule is due while its
+// previous run is still in progress
+const (
+	OverlapSkip           = "skip"
+	OverlapQueue          = "queue"
+	OverlapCancelPrevious = "cancel-previous"
+)
+
+// Catch up policies for runs missed while the worker was not running
+const (
+	CatchUpOnce = "once"
+	CatchUpSkip = "skip"
+)
+
+// Replication policies deciding whether a backup written to only some of
+// its destinations succeeded
+const (
+	ReplicationAll = "all"
+	ReplicationAny = "any"
+)
+
+// Server side encryption modes
+const (
+	SSEAES256   = "AES256"
+	SSEKMS      = "aws:kms"
+	SSECustomer = "SSE-C"
+)
+
+// Object Lock retention modes
+const (
+	ObjectLockGovernance = "GOVERNANCE"
+	ObjectLockCompliance = "COMPLIANCE"
+)
+
+// Symlink policies for directory backups
+const (
+	SymlinksSkip     = "skip"
+	SymlinksPreserve = "preserve"
+	SymlinksFollow   = "follow"
+)
+
+// Policies for sockets, devices and FIFOs found in directory backups
+const (
+	SpecialFilesSkip   = "skip"
+	SpecialFilesRecord = "record"
+)
+
 func New() *Config {
 	return &Config{
 		LogLevel: "info",
+		StateDir: "/var/lib/backme",
 		Database: DatabaseConfig{
 			Host: "localhost",
 			Port: 5432,
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Encode converts a configuration value into maps keyed by the mapstructure
+// tag names, so that it can be written back to the config file by viper.
+// Zero values are left out and durations are written as strings such as
+// "1h30m".
+func Encode(v any) any {
+	return encodeValue(reflect.ValueOf(v))
+}
+
+func encodeValue(v reflect.Value) any {
+	if !v.IsValid() {
+		return nil
+	}
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		return time.Duration(v.Int()).String()
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return encodeValue(v.Elem())
+
+	case reflect.Struct:
+		m := make(map[string]any)
+		encodeStruct(v, m)
+		return m
+
+	case reflect.Slice, reflect.Array:
+		items := make([]any, v.Len())
+		for i := range items {
+			items[i] = encodeValue(v.Index(i))
+		}
+		return items
+
+	case reflect.Map:
+		m := make(map[string]any, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = encodeValue(iter.Value())
+		}
+		return m
+
+	default:
+		return v.Interface()
+	}
+}
+
+func encodeStruct(v reflect.Value, m map[string]any) {
+	t := v.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if strings.Contains(opts, "squash") {
+			encodeStruct(v.Field(i), m)
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+
+		if v.Field(i).IsZero() {
+			continue
+		}
+		m[name] = encodeValue(v.Field(i))
+	}
+}
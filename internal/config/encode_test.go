@@ -0,0 +1,54 @@
+package config
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestEncodeRoundTrip tests that schedules written with Encode are read back
+// unchanged, including squashed fields and durations
+func TestEncodeRoundTrip(t *testing.T) {
+	want := Schedules{
+		Databases: []DatabaseSchedule{{
+			Name:       "nightly",
+			Expression: "daily",
+			Timezone:   "Europe/Berlin",
+			Jitter:     90 * time.Second,
+			Timeout:    2 * time.Hour,
+			Database:   DatabaseConfig{Host: "db", Port: 5432, Name: "app", Dedup: true},
+			Retry:      &RetryConfig{MaxAttempts: 5, InitialBackoff: 30 * time.Second, Jitter: 0.2},
+		}},
+		Directories: []DirectorySchedule{{
+			Name:       "docs",
+			Expression: "@hourly",
+			Overlap:    OverlapQueue,
+			Priority:   3,
+			DirectoryConfig: DirectoryConfig{
+				SourcePath: "/srv/docs",
+				Mode:       DirectoryModeWatch,
+				Sync:       true,
+				Debounce:   1500 * time.Millisecond,
+			},
+			AWS: &AWSConfig{Bucket: "docs", DirectoryPrefix: "docs", Tags: map[string]string{"env": "prod"}},
+		}},
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	w := viper.New()
+	w.Set("schedules.databases", Encode(want.Databases))
+	w.Set("schedules.directories", Encode(want.Directories))
+	require.NoError(t, w.WriteConfigAs(path))
+
+	r := viper.New()
+	r.SetConfigFile(path)
+	require.NoError(t, r.ReadInConfig())
+	var got Config
+	require.NoError(t, r.Unmarshal(&got))
+
+	assert.Equal(t, want, got.Schedules)
+}
@@ -0,0 +1,23 @@
+package config
+
+import "errors"
+
+// ErrInvalid marks errors caused by the configuration, such as an unknown
+// policy or a missing source directory, which retrying a backup doesn't fix
+var ErrInvalid = errors.New("invalid configuration")
+
+// invalidError keeps the message of an error marked with ErrInvalid
+type invalidError struct {
+	err error
+}
+
+func (e *invalidError) Error() string { return e.err.Error() }
+
+func (e *invalidError) Unwrap() error { return e.err }
+
+func (e *invalidError) Is(target error) bool { return target == ErrInvalid }
+
+// Invalid marks err as caused by the configuration
+func Invalid(err error) error {
+	return &invalidError{err: err}
+}
@@ -0,0 +1,216 @@
+// Package encryption encrypts backups before they leave the host. Data is
+// split into segments that are sealed with AES-256-GCM under a key derived
+// from a passphrase with scrypt, so that large archives can be streamed and
+// any truncation or modification is detected.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// Extension is appended to the keys of encrypted objects
+	Extension = ".enc"
+
+	magic       = "BACKMEE1"
+	saltSize    = 16
+	segmentSize = 64 << 10
+)
+
+// ErrDecrypt is returned when data cannot be decrypted with the passphrase
+var ErrDecrypt = errors.New("failed to decrypt: wrong passphrase or corrupted data")
+
+// ReadKeyFile returns the passphrase stored in the file at path. A trailing
+// newline is not part of the passphrase.
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key file: %w", err)
+	}
+	passphrase := strings.TrimRight(string(data), "\r\n")
+	if passphrase == "" {
+		return nil, fmt.Errorf("encryption key file %s is empty", path)
+	}
+	return []byte(passphrase), nil
+}
+
+func newAEAD(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonce returns the nonce of segment n. The key is unique to every stream,
+// so a counter never repeats a nonce. The last byte marks the final segment.
+func nonce(n uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], n)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Writer encrypts everything written to it. Close must be called to write
+// the final segment.
+type Writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	segment uint64
+	closed  bool
+}
+
+// NewWriter returns a Writer encrypting to w with a key derived from passphrase
+func NewWriter(w io.Writer, passphrase []byte) (*Writer, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.WriteString(w, magic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(salt); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, aead: aead, buf: make([]byte, 0, segmentSize)}, nil
+}
+
+func (e *Writer) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed encryption writer")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more data follows, since the
+		// last segment has to be sealed as final
+		if len(e.buf) == segmentSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):segmentSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the final segment. It does not close the underlying writer.
+func (e *Writer) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(true)
+}
+
+func (e *Writer) seal(final bool) error {
+	sealed := e.aead.Seal(nil, nonce(e.segment, final), e.buf, nil)
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.segment++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// Reader decrypts a stream written by Writer
+type Reader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	next    []byte
+	plain   []byte
+	segment uint64
+	done    bool
+}
+
+// NewReader returns a Reader decrypting r with a key derived from passphrase
+func NewReader(r io.Reader, passphrase []byte) (*Reader, error) {
+	header := make([]byte, len(magic)+saltSize)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.Equal(header[:len(magic)], []byte(magic)) {
+		return nil, fmt.Errorf("not an encrypted backup")
+	}
+	aead, err := newAEAD(passphrase, header[len(magic):])
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Reader{r: r, aead: aead, buf: make([]byte, segmentSize+aead.Overhead())}
+	// The first segment is read ahead, see fill
+	if d.next, err = d.readSegment(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Reader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.fill(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// fill decrypts the next segment. Whether a segment is the final one is
+// only known once the one after it was read, so segments are read ahead.
+func (d *Reader) fill() error {
+	current := d.next
+	next, err := d.readSegment()
+	if err != nil {
+		return err
+	}
+
+	final := len(next) == 0
+	plain, err := d.aead.Open(current[:0], nonce(d.segment, final), current, nil)
+	if err != nil {
+		return ErrDecrypt
+	}
+	d.segment++
+	d.plain, d.next, d.done = plain, next, final
+	return nil
+}
+
+// readSegment returns the next sealed segment, or nil at the end of the stream
+func (d *Reader) readSegment() ([]byte, error) {
+	n, err := io.ReadFull(d.r, d.buf)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return bytes.Clone(d.buf[:n]), nil
+}
@@ -0,0 +1,51 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encrypt(t *testing.T, plain []byte) []byte {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, []byte("secret"))
+	require.NoError(t, err)
+	_, err = w.Write(plain)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, segmentSize, segmentSize + 1, 3*segmentSize - 7} {
+		plain := make([]byte, size)
+		_, _ = rand.Read(plain)
+
+		r, err := NewReader(bytes.NewReader(encrypt(t, plain)), []byte("secret"))
+		require.NoError(t, err)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, plain, got, "size %d", size)
+	}
+}
+
+func TestWrongPassphrase(t *testing.T) {
+	r, err := NewReader(bytes.NewReader(encrypt(t, []byte("data"))), []byte("wrong"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestTruncated(t *testing.T) {
+	sealed := encrypt(t, make([]byte, 2*segmentSize))
+
+	// Dropping the final segment must not go unnoticed
+	r, err := NewReader(bytes.NewReader(sealed[:len(sealed)-16]), []byte("secret"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
@@ -0,0 +1,320 @@
+package filesystem
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkkulhari/backme/internal/storage"
+)
+
+const (
+	// metadataSuffix is appended to an object's path to get its metadata sidecar
+	metadataSuffix = ".backme-meta"
+	// tempPrefix marks files that are still being written
+	tempPrefix = ".backme-tmp-"
+	// escapeSuffix is appended to file names that would otherwise be taken
+	// for a sidecar or temporary file
+	escapeSuffix = ".backme-esc"
+)
+
+var _ storage.Storage = (*Client)(nil)
+
+// Client stores objects as files below a root directory, for example on a
+// local disk or an NFS mount. Keys map to paths relative to the root and user
+// metadata is kept in a sidecar file next to each object.
+type Client struct {
+	root string
+}
+
+func New(root string) (*Client, error) {
+	if root == "" {
+		return nil, fmt.Errorf("root directory is required")
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create root directory: %w", err)
+	}
+
+	return &Client{root: filepath.Clean(root)}, nil
+}
+
+func (c *Client) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" {
+		return "", fmt.Errorf("invalid object key: %q", key)
+	}
+	return filepath.Join(c.root, filepath.FromSlash(path.Join(path.Dir(clean), escapeName(path.Base(clean))))), nil
+}
+
+// escapeName returns the file name an object is stored under, so that keys
+// looking like sidecar or temporary files can be stored as well
+func escapeName(name string) string {
+	if strings.HasSuffix(name, metadataSuffix) || strings.HasPrefix(name, tempPrefix) || strings.HasSuffix(name, escapeSuffix) {
+		return name + escapeSuffix
+	}
+	return name
+}
+
+// objectName returns the name of the object stored in a file, or false if
+// the file is a sidecar or temporary file
+func objectName(name string) (string, bool) {
+	switch {
+	case strings.HasSuffix(name, escapeSuffix):
+		return strings.TrimSuffix(name, escapeSuffix), true
+	case strings.HasSuffix(name, metadataSuffix), strings.HasPrefix(name, tempPrefix):
+		return "", false
+	}
+	return name, true
+}
+
+func (c *Client) Upload(ctx context.Context, key string, reader io.Reader) error {
+	return c.UploadWithMetadata(ctx, key, reader, nil)
+}
+
+// UploadWithMetadata writes the object to a temporary file and renames it
+// into place, so readers never see partially written objects
+func (c *Client) UploadWithMetadata(ctx context.Context, key string, reader io.Reader, metadata map[string]string) error {
+	filePath, err := c.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", key, err)
+	}
+
+	if err := writeAtomic(ctx, filePath, reader); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", key, err)
+	}
+
+	if len(metadata) == 0 {
+		if err := os.Remove(filePath + metadataSuffix); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove metadata of %s: %w", key, err)
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata of %s: %w", key, err)
+	}
+	if err := writeAtomic(ctx, filePath+metadataSuffix, strings.NewReader(string(data))); err != nil {
+		return fmt.Errorf("failed to write metadata of %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func writeAtomic(ctx context.Context, filePath string, reader io.Reader) error {
+	dir := filepath.Dir(filePath)
+	tmpFile, err := os.CreateTemp(dir, tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	if _, err := io.Copy(tmpFile, &contextReader{ctx: ctx, r: reader}); err != nil {
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), filePath); err != nil {
+		return err
+	}
+
+	// Persist the rename itself
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+	return dirFile.Sync()
+}
+
+func (c *Client) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	filePath, err := c.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", key, wrapNotFound(err))
+	}
+
+	return file, nil
+}
+
+func (c *Client) DownloadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	filePath, err := c.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", key, wrapNotFound(err))
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to seek in file %s: %w", key, err)
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, nil
+}
+
+func (c *Client) ListObjects(ctx context.Context, prefix string) ([]string, error) {
+	objects, err := c.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	return keys, nil
+}
+
+func (c *Client) List(ctx context.Context, prefix string) ([]storage.ObjectInfo, error) {
+	// Only walk the directory the prefix points into
+	walkRoot := c.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		walkRoot = filepath.Join(c.root, filepath.FromSlash(path.Clean("/"+prefix[:i])))
+	}
+
+	var objects []storage.ObjectInfo
+	err := filepath.WalkDir(walkRoot, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && filePath == walkRoot {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+		name, ok := objectName(d.Name())
+		if !ok {
+			return nil
+		}
+
+		rel, err := filepath.Rel(c.root, filepath.Dir(filePath))
+		if err != nil {
+			return err
+		}
+		key := path.Join(filepath.ToSlash(rel), name)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, storage.ObjectInfo{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	return objects, nil
+}
+
+func (c *Client) GetObjectMetadata(ctx context.Context, key string) (*storage.ObjectInfo, error) {
+	filePath, err := c.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file %s: %w", key, wrapNotFound(err))
+	}
+
+	objectInfo := &storage.ObjectInfo{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+	}
+
+	data, err := os.ReadFile(filePath + metadataSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read metadata of %s: %w", key, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &objectInfo.Metadata); err != nil {
+			return nil, fmt.Errorf("failed to decode metadata of %s: %w", key, err)
+		}
+	}
+
+	return objectInfo, nil
+}
+
+// DeleteObject removes the object and its metadata. Directories left empty
+// are removed as well. Deleting a missing object is not an error.
+func (c *Client) DeleteObject(ctx context.Context, key string) error {
+	filePath, err := c.path(key)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range []string{filePath, filePath + metadataSuffix} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete file %s: %w", key, err)
+		}
+	}
+
+	for dir := filepath.Dir(filePath); dir != c.root && strings.HasPrefix(dir, c.root); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+func wrapNotFound(err error) error {
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %w", storage.ErrNotFound, err)
+	}
+	return err
+}
+
+// contextReader stops reading once its context is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,165 @@
+package filesystem
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkkulhari/backme/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newClient(t *testing.T) (*Client, string) {
+	root := t.TempDir()
+	client, err := New(root)
+	require.NoError(t, err)
+	return client, root
+}
+
+func download(t *testing.T, client *Client, key string) string {
+	body, err := client.Download(context.Background(), key)
+	require.NoError(t, err)
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	require.NoError(t, err)
+	return string(data)
+}
+
+// failingReader returns some data and then an error
+type failingReader struct {
+	read bool
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.read {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.read = true
+	return copy(p, "partial"), nil
+}
+
+func TestUploadIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	client, root := newClient(t)
+
+	require.NoError(t, client.Upload(ctx, "docs/a.txt", strings.NewReader("old")))
+
+	err := client.Upload(ctx, "docs/a.txt", &failingReader{})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, "old", download(t, client, "docs/a.txt"))
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = client.Upload(cancelled, "docs/a.txt", strings.NewReader("new"))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, "old", download(t, client, "docs/a.txt"))
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(filepath.Join(root, "docs"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "a.txt", entries[0].Name())
+}
+
+func TestMetadataSidecar(t *testing.T) {
+	ctx := context.Background()
+	client, root := newClient(t)
+
+	metadata := map[string]string{"link-target": "b.txt"}
+	require.NoError(t, client.UploadWithMetadata(ctx, "docs/a.txt", strings.NewReader("a"), metadata))
+	assert.FileExists(t, filepath.Join(root, "docs", "a.txt"+metadataSuffix))
+
+	info, err := client.GetObjectMetadata(ctx, "docs/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "docs/a.txt", info.Key)
+	assert.Equal(t, int64(1), info.Size)
+	assert.Equal(t, metadata, info.Metadata)
+
+	// The sidecar is not listed as an object
+	keys, err := client.ListObjects(ctx, "docs/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"docs/a.txt"}, keys)
+
+	// Uploading without metadata removes the old one
+	require.NoError(t, client.Upload(ctx, "docs/a.txt", strings.NewReader("a")))
+	assert.NoFileExists(t, filepath.Join(root, "docs", "a.txt"+metadataSuffix))
+	info, err = client.GetObjectMetadata(ctx, "docs/a.txt")
+	require.NoError(t, err)
+	assert.Empty(t, info.Metadata)
+
+	require.NoError(t, client.UploadWithMetadata(ctx, "docs/a.txt", strings.NewReader("a"), metadata))
+	require.NoError(t, client.DeleteObject(ctx, "docs/a.txt"))
+	assert.NoDirExists(t, filepath.Join(root, "docs"))
+
+	_, err = client.GetObjectMetadata(ctx, "docs/a.txt")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestReservedNames(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newClient(t)
+
+	keys := []string{
+		"docs/a.txt",
+		"docs/a.txt" + metadataSuffix,
+		"docs/" + tempPrefix + "draft",
+		"docs/notes" + escapeSuffix,
+	}
+	for _, key := range keys {
+		require.NoError(t, client.UploadWithMetadata(ctx, key, strings.NewReader(key), map[string]string{"key": key}))
+	}
+
+	listed, err := client.ListObjects(ctx, "docs/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, keys, listed)
+
+	for _, key := range keys {
+		assert.Equal(t, key, download(t, client, key))
+		info, err := client.GetObjectMetadata(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"key": key}, info.Metadata)
+	}
+
+	require.NoError(t, client.DeleteObject(ctx, "docs/a.txt"+metadataSuffix))
+	assert.Equal(t, "docs/a.txt", download(t, client, "docs/a.txt"))
+}
+
+func TestList(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newClient(t)
+
+	for _, key := range []string{"top.txt", "docs/a.txt", "docs/ab.txt", "docs/sub/b.txt", "docsa/c.txt"} {
+		require.NoError(t, client.Upload(ctx, key, strings.NewReader(key)))
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{prefix: "", want: []string{"top.txt", "docs/a.txt", "docs/ab.txt", "docs/sub/b.txt", "docsa/c.txt"}},
+		{prefix: "docs/", want: []string{"docs/a.txt", "docs/ab.txt", "docs/sub/b.txt"}},
+		{prefix: "docs", want: []string{"docs/a.txt", "docs/ab.txt", "docs/sub/b.txt", "docsa/c.txt"}},
+		{prefix: "docs/a", want: []string{"docs/a.txt", "docs/ab.txt"}},
+		{prefix: "docs/a.txt", want: []string{"docs/a.txt"}},
+		{prefix: "docs/sub/b.txt", want: []string{"docs/sub/b.txt"}},
+		{prefix: "missing/", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			objects, err := client.List(ctx, tt.prefix)
+			require.NoError(t, err)
+
+			var keys []string
+			for _, obj := range objects {
+				keys = append(keys, obj.Key)
+				assert.Equal(t, int64(len(obj.Key)), obj.Size)
+			}
+			assert.ElementsMatch(t, tt.want, keys)
+		})
+	}
+}
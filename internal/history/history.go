@@ -0,0 +1,198 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/state"
+)
+
+// maxRuns is the number of runs kept per schedule
+const maxRuns = 100
+
+// Run is the outcome of a single run of a schedule
+type Run struct {
+	Schedule string    `json:"schedule"`
+	Type     string    `json:"type"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Bytes    int64     `json:"bytes"`
+	Files    int       `json:"files"`
+	Keys     []string  `json:"keys,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	// FailedDestinations maps the destinations the backup failed on to the
+	// error, also when the replication policy let the run succeed
+	FailedDestinations map[string]string `json:"failed_destinations,omitempty"`
+}
+
+// Duration returns how long the run took
+func (r Run) Duration() time.Duration {
+	return r.End.Sub(r.Start)
+}
+
+// Succeeded reports whether the run completed without error
+func (r Run) Succeeded() bool {
+	return r.Error == ""
+}
+
+// Partial reports whether the run succeeded although some of its
+// destinations failed
+func (r Run) Partial() bool {
+	return r.Succeeded() && len(r.FailedDestinations) > 0
+}
+
+// Store keeps the latest runs of every schedule in the state directory
+type Store struct {
+	state *state.Store
+	mu    sync.Mutex
+}
+
+// New returns a history store kept in store
+func New(store *state.Store) *Store {
+	return &Store{state: store}
+}
+
+func stateName(scheduleType, schedule string) string {
+	return state.Name("history", scheduleType, schedule)
+}
+
+// Record appends run to the history of its schedule, dropping the oldest
+// runs beyond the limit. The history is locked while it is updated, so
+// that runs recorded by the worker and by "backme run" at the same time
+// are all kept.
+func (s *Store) Record(run Run) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.state.Lock(stateName(run.Type, run.Schedule))
+	if err != nil {
+		return fmt.Errorf("failed to record run: %w", err)
+	}
+	defer unlock()
+
+	runs, err := s.Runs(run.Type, run.Schedule)
+	if err != nil {
+		return err
+	}
+
+	runs = append(runs, run)
+	if len(runs) > maxRuns {
+		runs = runs[len(runs)-maxRuns:]
+	}
+
+	if err := s.state.Save(stateName(run.Type, run.Schedule), runs); err != nil {
+		return fmt.Errorf("failed to record run: %w", err)
+	}
+	return nil
+}
+
+// Runs returns the recorded runs of a schedule, oldest first
+func (s *Store) Runs(scheduleType, schedule string) ([]Run, error) {
+	var runs []Run
+	if _, err := s.state.Load(stateName(scheduleType, schedule), &runs); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// LastSuccess returns the latest successful run among runs, or nil
+func LastSuccess(runs []Run) *Run {
+	return last(runs, Run.Succeeded)
+}
+
+// LastFailure returns the latest failed run among runs, or nil
+func LastFailure(runs []Run) *Run {
+	return last(runs, func(r Run) bool { return !r.Succeeded() })
+}
+
+func last(runs []Run, match func(Run) bool) *Run {
+	for i := len(runs) - 1; i >= 0; i-- {
+		if match(runs[i]) {
+			return &runs[i]
+		}
+	}
+	return nil
+}
+
+// Stats collects what a run uploaded. It is safe for concurrent use and all
+// methods do nothing on a nil Stats.
+type Stats struct {
+	mu     sync.Mutex
+	bytes  int64
+	files  map[string]struct{}
+	keys   []string
+	failed map[string]string
+}
+
+type statsKey struct{}
+
+// WithStats returns a context that backups running with it report to
+func WithStats(ctx context.Context, stats *Stats) context.Context {
+	return context.WithValue(ctx, statsKey{}, stats)
+}
+
+// StatsFrom returns the stats of ctx, or nil
+func StatsFrom(ctx context.Context) *Stats {
+	stats, _ := ctx.Value(statsKey{}).(*Stats)
+	return stats
+}
+
+// AddFile records an uploaded file of size bytes. A file uploaded to
+// several destinations is counted once by its name.
+func (s *Stats) AddFile(name string, size int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[name]; ok {
+		return
+	}
+	if s.files == nil {
+		s.files = make(map[string]struct{})
+	}
+	s.files[name] = struct{}{}
+	s.bytes += size
+}
+
+// AddKey records the key of an object holding the backup
+func (s *Stats) AddKey(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !slices.Contains(s.keys, key) {
+		s.keys = append(s.keys, key)
+	}
+}
+
+// AddFailedDestination records that the backup failed on destination
+func (s *Stats) AddFailedDestination(destination string, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed == nil {
+		s.failed = make(map[string]string)
+	}
+	s.failed[destination] = err.Error()
+}
+
+// Fill copies the collected stats into run
+func (s *Stats) Fill(run *Run) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run.Bytes = s.bytes
+	run.Files = len(s.files)
+	run.Keys = slices.Clone(s.keys)
+	run.FailedDestinations = maps.Clone(s.failed)
+}
@@ -0,0 +1,57 @@
+package history
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordConcurrently(t *testing.T) {
+	dir := t.TempDir()
+
+	// Every store stands for a process, such as the worker and "backme run"
+	var stores []*Store
+	for range 4 {
+		store, err := state.Open(dir)
+		require.NoError(t, err)
+		stores = append(stores, New(store))
+	}
+
+	var wg sync.WaitGroup
+	for i, store := range stores {
+		for j := range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				run := Run{Schedule: "docs", Type: "directory", Start: time.Now(), Error: fmt.Sprintf("%d-%d", i, j)}
+				assert.NoError(t, store.Record(run))
+			}()
+		}
+	}
+	wg.Wait()
+
+	runs, err := stores[0].Runs("directory", "docs")
+	require.NoError(t, err)
+	assert.Len(t, runs, 40)
+}
+
+func TestRecordKeepsLatestRuns(t *testing.T) {
+	store, err := state.Open(t.TempDir())
+	require.NoError(t, err)
+	history := New(store)
+
+	for i := range maxRuns + 5 {
+		require.NoError(t, history.Record(Run{Schedule: "db", Type: "database", Bytes: int64(i)}))
+	}
+
+	runs, err := history.Runs("database", "db")
+	require.NoError(t, err)
+	require.Len(t, runs, maxRuns)
+	assert.Equal(t, int64(5), runs[0].Bytes)
+	assert.Equal(t, int64(maxRuns+4), runs[maxRuns-1].Bytes)
+}
@@ -1,22 +1,69 @@
 package s3
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
 	"path"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
 	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/state"
+	"github.com/pkkulhari/backme/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	_ storage.Storage   = (*Client)(nil)
+	_ storage.Versioned = (*Client)(nil)
+	_ storage.Tagged    = (*Client)(nil)
 )
 
 type Client struct {
 	s3Client *s3.Client
 	bucket   string
+
+	// Applied to every uploaded object
+	sse          types.ServerSideEncryption
+	kmsKeyID     string
+	storageClass types.StorageClass
+	tagging      string
+	metadata     map[string]string
+	lockMode     types.ObjectLockMode
+	lockPeriod   time.Duration
+	legalHold    bool
+
+	// Whether objects in the bucket can be locked, checked before the first delete
+	lockCheck   sync.Once
+	lockEnabled bool
+
+	// SSE-C key, also needed to read objects back
+	customerKey    string
+	customerKeyMD5 string
+
+	// Records multipart uploads so they can be resumed, nil if disabled
+	state *state.Store
 }
 
 type Options struct {
@@ -24,38 +71,238 @@ type Options struct {
 }
 
 func New(cfg *config.Config, opts *Options) (*Client, error) {
-	awsCfg, err := awsconfig.LoadDefaultConfig(
-		context.TODO(),
-		awsconfig.WithRegion(cfg.AWS.Region),
-		awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+	endpoint := cfg.AWS.Endpoint
+	if opts != nil && opts.Endpoint != "" {
+		// Use custom endpoint for testing
+		endpoint = opts.Endpoint
+	}
+
+	region := cfg.AWS.Region
+	if region == "" && endpoint != "" {
+		// Most S3-compatible servers accept any region
+		region = "us-east-1"
+	}
+
+	loadOpts := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithRegion(region),
+	}
+
+	// Without static keys the default credential chain is used, which covers
+	// environment variables, shared profiles, SSO, web identity and instance roles
+	if cfg.AWS.AccessKeyID != "" || cfg.AWS.SecretAccessKey != "" {
+		if cfg.AWS.AccessKeyID == "" || cfg.AWS.SecretAccessKey == "" {
+			return nil, config.Invalid(fmt.Errorf("access_key_id and secret_access_key must be set together"))
+		}
+		loadOpts = append(loadOpts, awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
 			cfg.AWS.AccessKeyID,
 			cfg.AWS.SecretAccessKey,
 			"",
-		)),
-	)
+		)))
+	}
+	if cfg.AWS.Profile != "" {
+		loadOpts = append(loadOpts, awsconfig.WithSharedConfigProfile(cfg.AWS.Profile))
+	}
+
+	if cfg.AWS.InsecureSkipVerify {
+		httpClient := awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			if tr.TLSClientConfig == nil {
+				tr.TLSClientConfig = &tls.Config{}
+			}
+			tr.TLSClientConfig.InsecureSkipVerify = true
+		})
+		loadOpts = append(loadOpts, awsconfig.WithHTTPClient(httpClient))
+	}
+
+	if cfg.AWS.CABundle != "" {
+		caBundle, err := os.ReadFile(cfg.AWS.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		loadOpts = append(loadOpts, awsconfig.WithCustomCABundle(bytes.NewReader(caBundle)))
+	}
+
+	if cfg.AWS.DisableChecksums {
+		loadOpts = append(loadOpts,
+			awsconfig.WithRequestChecksumCalculation(aws.RequestChecksumCalculationWhenRequired),
+			awsconfig.WithResponseChecksumValidation(aws.ResponseChecksumValidationWhenRequired),
+		)
+	}
+
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.TODO(), loadOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to load AWS config: %w", err)
 	}
 
-	s3Client := s3.NewFromConfig(awsCfg)
-	if opts != nil && opts.Endpoint != "" {
-		// Use custom endpoint for testing
-		awsCfg.BaseEndpoint = aws.String(opts.Endpoint)
-		s3Client = s3.NewFromConfig(awsCfg)
+	if cfg.AWS.RoleARN != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsCfg), cfg.AWS.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = "backme"
+			if cfg.AWS.ExternalID != "" {
+				o.ExternalID = aws.String(cfg.AWS.ExternalID)
+			}
+			if cfg.AWS.SessionDuration > 0 {
+				o.Duration = cfg.AWS.SessionDuration
+			}
+		})
+		awsCfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	s3Client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+		o.UsePathStyle = cfg.AWS.ForcePathStyle
+		if cfg.AWS.UnsignedPayload {
+			o.APIOptions = append(o.APIOptions, v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware)
+		}
+	})
+
+	client := &Client{
+		s3Client:     s3Client,
+		bucket:       cfg.AWS.Bucket,
+		storageClass: types.StorageClass(cfg.AWS.StorageClass),
+		metadata:     cfg.AWS.Metadata,
+	}
+	if err := client.setEncryption(&cfg.AWS); err != nil {
+		return nil, config.Invalid(err)
+	}
+	if err := client.setObjectLock(&cfg.AWS); err != nil {
+		return nil, config.Invalid(err)
+	}
+
+	if cfg.StateDir != "" {
+		client.state, err = state.Open(cfg.StateDir)
+		if err != nil {
+			log.Warn().Err(err).Msg("Large uploads will not be resumable")
+		}
+	}
+
+	if len(cfg.AWS.Tags) > 0 {
+		tags := url.Values{}
+		for k, v := range cfg.AWS.Tags {
+			tags.Set(k, v)
+		}
+		client.tagging = tags.Encode()
+	}
+
+	return client, nil
+}
+
+func (c *Client) setEncryption(cfg *config.AWSConfig) error {
+	if cfg.SSEKMSKeyID != "" && cfg.ServerSideEncryption != config.SSEKMS {
+		return fmt.Errorf("sse_kms_key_id requires server_side_encryption %s", config.SSEKMS)
+	}
+	if cfg.SSECustomerKey != "" && cfg.ServerSideEncryption != config.SSECustomer {
+		return fmt.Errorf("sse_customer_key requires server_side_encryption %s", config.SSECustomer)
 	}
 
-	return &Client{
-		s3Client: s3Client,
-		bucket:   cfg.AWS.Bucket,
-	}, nil
+	switch cfg.ServerSideEncryption {
+	case "":
+	case config.SSEAES256:
+		c.sse = types.ServerSideEncryptionAes256
+	case config.SSEKMS:
+		c.sse = types.ServerSideEncryptionAwsKms
+		c.kmsKeyID = cfg.SSEKMSKeyID
+	case config.SSECustomer:
+		key, err := base64.StdEncoding.DecodeString(cfg.SSECustomerKey)
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("sse_customer_key must be a base64 encoded 256-bit key")
+		}
+		sum := md5.Sum(key)
+		c.customerKey = cfg.SSECustomerKey
+		c.customerKeyMD5 = base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		return fmt.Errorf("invalid server side encryption: %s", cfg.ServerSideEncryption)
+	}
+
+	return nil
+}
+
+func (c *Client) setObjectLock(cfg *config.AWSConfig) error {
+	switch cfg.ObjectLockMode {
+	case "":
+		if cfg.ObjectLockRetention != 0 {
+			return fmt.Errorf("object_lock_retention requires object_lock_mode")
+		}
+	case config.ObjectLockGovernance, config.ObjectLockCompliance:
+		// Without an explicit period objects are locked as long as the
+		// retention keeps them
+		c.lockPeriod = cfg.ObjectLockRetention
+		if c.lockPeriod == 0 && cfg.Retention != nil {
+			c.lockPeriod = cfg.Retention.MaxAge
+		}
+		if c.lockPeriod <= 0 {
+			return fmt.Errorf("object_lock_mode requires a positive object_lock_retention or retention.max_age")
+		}
+		c.lockMode = types.ObjectLockMode(cfg.ObjectLockMode)
+	default:
+		return fmt.Errorf("invalid object lock mode: %s", cfg.ObjectLockMode)
+	}
+	c.legalHold = cfg.LegalHold
+
+	// S3 only accepts locked objects with a checksum
+	if (c.lockMode != "" || c.legalHold) && cfg.DisableChecksums {
+		return fmt.Errorf("object lock cannot be used with disable_checksums")
+	}
+	return nil
+}
+
+// customerKeyParams returns the SSE-C algorithm, key and key MD5 to send
+// with a request, or nils when SSE-C is not used
+func (c *Client) customerKeyParams() (*string, *string, *string) {
+	if c.customerKey == "" {
+		return nil, nil, nil
+	}
+	return aws.String("AES256"), aws.String(c.customerKey), aws.String(c.customerKeyMD5)
 }
 
 func (c *Client) Upload(ctx context.Context, key string, reader io.Reader) error {
-	_, err := c.s3Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(c.bucket),
-		Key:    aws.String(key),
-		Body:   reader,
-	})
+	return c.UploadWithMetadata(ctx, key, reader, nil)
+}
+
+// UploadWithMetadata uploads an object and attaches the given user metadata
+// to it, in addition to the configured metadata, tags and encryption
+func (c *Client) UploadWithMetadata(ctx context.Context, key string, reader io.Reader, metadata map[string]string) error {
+	merged := make(map[string]string, len(c.metadata)+len(metadata))
+	maps.Copy(merged, c.metadata)
+	maps.Copy(merged, metadata)
+
+	// Large files are uploaded in parts. Uploads of files with a stable path
+	// can be resumed after a restart.
+	file, _ := reader.(*os.File)
+	resumable := false
+	if f, ok := reader.(storage.ResumableFile); ok {
+		file, resumable = f.File, true
+	}
+	if file != nil {
+		if info, err := file.Stat(); err == nil && info.Mode().IsRegular() && info.Size() >= MultipartThreshold {
+			return c.uploadMultipart(ctx, key, file, merged, resumable)
+		}
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(c.bucket),
+		Key:                  aws.String(key),
+		Body:                 reader,
+		Metadata:             merged,
+		ServerSideEncryption: c.sse,
+		StorageClass:         c.storageClass,
+	}
+	if c.kmsKeyID != "" {
+		input.SSEKMSKeyId = aws.String(c.kmsKeyID)
+	}
+	if c.tagging != "" {
+		input.Tagging = aws.String(c.tagging)
+	}
+	if c.lockMode != "" {
+		input.ObjectLockMode = c.lockMode
+		input.ObjectLockRetainUntilDate = aws.Time(time.Now().Add(c.lockPeriod))
+	}
+	if c.legalHold {
+		input.ObjectLockLegalHoldStatus = types.ObjectLockLegalHoldStatusOn
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = c.customerKeyParams()
+
+	_, err := c.s3Client.PutObject(ctx, input)
 	if err != nil {
 		return fmt.Errorf("failed to upload file to S3: %w", err)
 	}
@@ -64,12 +311,32 @@ func (c *Client) Upload(ctx context.Context, key string, reader io.Reader) error
 }
 
 func (c *Client) Download(ctx context.Context, key string) (io.ReadCloser, error) {
-	result, err := c.s3Client.GetObject(ctx, &s3.GetObjectInput{
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(c.bucket),
 		Key:    aws.String(key),
-	})
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = c.customerKeyParams()
+
+	result, err := c.s3Client.GetObject(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file from S3: %w", wrapNotFound(err))
+	}
+
+	return result.Body, nil
+}
+
+// DownloadRange downloads length bytes of an object starting at offset
+func (c *Client) DownloadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = c.customerKeyParams()
+
+	result, err := c.s3Client.GetObject(ctx, input)
 	if err != nil {
-		return nil, fmt.Errorf("failed to download file from S3: %w", err)
+		return nil, fmt.Errorf("failed to download file from S3: %w", wrapNotFound(err))
 	}
 
 	return result.Body, nil
@@ -96,19 +363,173 @@ func (c *Client) ListObjects(ctx context.Context, prefix string) ([]string, erro
 	return objects, nil
 }
 
-func (c *Client) GetObjectMetadata(ctx context.Context, key string) (*s3.HeadObjectOutput, error) {
-	result, err := c.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+func (c *Client) List(ctx context.Context, prefix string) ([]storage.ObjectInfo, error) {
+	var objects []storage.ObjectInfo
+	paginator := s3.NewListObjectsV2Paginator(c.s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(c.bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects in S3: %w", err)
+		}
+
+		for _, obj := range page.Contents {
+			objects = append(objects, storage.ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+				StorageClass: string(obj.StorageClass),
+			})
+		}
+	}
+
+	return objects, nil
+}
+
+func (c *Client) GetObjectMetadata(ctx context.Context, key string) (*storage.ObjectInfo, error) {
+	return c.GetVersionMetadata(ctx, key, "")
+}
+
+// GetVersionMetadata returns information about a single version of an
+// object, or about the current version if versionID is empty
+func (c *Client) GetVersionMetadata(ctx context.Context, key, versionID string) (*storage.ObjectInfo, error) {
+	var version *string
+	if versionID != "" {
+		version = aws.String(versionID)
+	}
+
+	input := &s3.HeadObjectInput{
+		Bucket:    aws.String(c.bucket),
+		Key:       aws.String(key),
+		VersionId: version,
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = c.customerKeyParams()
+
+	result, err := c.s3Client.HeadObject(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object metadata from S3: %w", wrapNotFound(err))
+	}
+
+	info := &storage.ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(result.ContentLength),
+		LastModified: aws.ToTime(result.LastModified),
+		Metadata:     result.Metadata,
+		StorageClass: string(result.StorageClass),
+		Encryption:   string(result.ServerSideEncryption),
+		RetainUntil:  aws.ToTime(result.ObjectLockRetainUntilDate),
+		LegalHold:    result.ObjectLockLegalHoldStatus == types.ObjectLockLegalHoldStatusOn,
+	}
+	if info.StorageClass == "" {
+		info.StorageClass = string(types.StorageClassStandard)
+	}
+	if result.SSEKMSKeyId != nil {
+		info.Encryption += " (" + aws.ToString(result.SSEKMSKeyId) + ")"
+	}
+	if result.SSECustomerAlgorithm != nil {
+		info.Encryption = config.SSECustomer
+	}
+
+	return info, nil
+}
+
+// GetObjectTags returns the tags of an object. Servers that don't support
+// tagging and missing permission to read tags result in no tags.
+func (c *Client) GetObjectTags(ctx context.Context, key string) (map[string]string, error) {
+	result, err := c.s3Client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
 		Bucket: aws.String(c.bucket),
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get object metadata from S3: %w", err)
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NotImplemented" || apiErr.ErrorCode() == "AccessDenied") {
+			log.Debug().Err(err).Msgf("Tags of %s are not available", key)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get object tags from S3: %w", wrapNotFound(err))
 	}
 
-	return result, nil
+	tags := make(map[string]string, len(result.TagSet))
+	for _, tag := range result.TagSet {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return tags, nil
 }
 
+// ListVersions returns all versions and delete markers of objects starting
+// with prefix, newest first for every key
+func (c *Client) ListVersions(ctx context.Context, prefix string) ([]storage.ObjectVersion, error) {
+	var versions []storage.ObjectVersion
+	paginator := s3.NewListObjectVersionsPaginator(c.s3Client, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(c.bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list object versions in S3: %w", err)
+		}
+
+		for _, v := range page.Versions {
+			versions = append(versions, storage.ObjectVersion{
+				Key:          aws.ToString(v.Key),
+				VersionID:    aws.ToString(v.VersionId),
+				Size:         aws.ToInt64(v.Size),
+				LastModified: aws.ToTime(v.LastModified),
+				IsLatest:     aws.ToBool(v.IsLatest),
+			})
+		}
+		for _, m := range page.DeleteMarkers {
+			versions = append(versions, storage.ObjectVersion{
+				Key:          aws.ToString(m.Key),
+				VersionID:    aws.ToString(m.VersionId),
+				LastModified: aws.ToTime(m.LastModified),
+				IsLatest:     aws.ToBool(m.IsLatest),
+				DeleteMarker: true,
+			})
+		}
+	}
+
+	// Versions and delete markers are returned separately
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].Key != versions[j].Key {
+			return versions[i].Key < versions[j].Key
+		}
+		return versions[i].LastModified.After(versions[j].LastModified)
+	})
+	return versions, nil
+}
+
+// DownloadVersion returns the content of a single version of an object
+func (c *Client) DownloadVersion(ctx context.Context, key, versionID string) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket:    aws.String(c.bucket),
+		Key:       aws.String(key),
+		VersionId: aws.String(versionID),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = c.customerKeyParams()
+
+	result, err := c.s3Client.GetObject(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file version from S3: %w", wrapNotFound(err))
+	}
+
+	return result.Body, nil
+}
+
+// DeleteObject deletes the object stored under key. In a bucket with Object
+// Lock this would only add a delete marker in front of a locked object, so
+// locked objects are left alone and an error wrapping storage.ErrLocked is
+// returned instead.
 func (c *Client) DeleteObject(ctx context.Context, key string) error {
+	if err := c.checkLock(ctx, key); err != nil {
+		return err
+	}
+
 	_, err := c.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(c.bucket),
 		Key:    aws.String(key),
@@ -120,6 +541,86 @@ func (c *Client) DeleteObject(ctx context.Context, key string) error {
 	return nil
 }
 
+// checkLock returns an error wrapping storage.ErrLocked if the current
+// version of key has a retention date in the future or a legal hold
+func (c *Client) checkLock(ctx context.Context, key string) error {
+	c.lockCheck.Do(func() {
+		status, err := c.GetObjectLockStatus(ctx)
+		// Check every object if the bucket configuration can't be read
+		c.lockEnabled = err != nil || status.Enabled
+	})
+	if !c.lockEnabled {
+		return nil
+	}
+
+	info, err := c.GetObjectMetadata(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.LegalHold {
+		return fmt.Errorf("%s has a legal hold: %w", key, storage.ErrLocked)
+	}
+	if info.RetainUntil.After(time.Now()) {
+		return fmt.Errorf("%s is retained until %s: %w", key, info.RetainUntil.Format(time.RFC3339), storage.ErrLocked)
+	}
+	return nil
+}
+
+// ObjectLockStatus describes the Object Lock configuration of the bucket
+type ObjectLockStatus struct {
+	Enabled          bool
+	DefaultMode      string
+	DefaultRetention string
+}
+
+// GetObjectLockStatus returns the Object Lock configuration of the bucket
+func (c *Client) GetObjectLockStatus(ctx context.Context) (*ObjectLockStatus, error) {
+	result, err := c.s3Client.GetObjectLockConfiguration(ctx, &s3.GetObjectLockConfigurationInput{
+		Bucket: aws.String(c.bucket),
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "ObjectLockConfigurationNotFoundError" {
+			return &ObjectLockStatus{}, nil
+		}
+		return nil, fmt.Errorf("failed to get object lock configuration: %w", err)
+	}
+
+	status := &ObjectLockStatus{}
+	if lock := result.ObjectLockConfiguration; lock != nil {
+		status.Enabled = lock.ObjectLockEnabled == types.ObjectLockEnabledEnabled
+		if lock.Rule != nil && lock.Rule.DefaultRetention != nil {
+			retention := lock.Rule.DefaultRetention
+			status.DefaultMode = string(retention.Mode)
+			switch {
+			case retention.Days != nil:
+				status.DefaultRetention = fmt.Sprintf("%d days", *retention.Days)
+			case retention.Years != nil:
+				status.DefaultRetention = fmt.Sprintf("%d years", *retention.Years)
+			}
+		}
+	}
+	return status, nil
+}
+
+// EnableVersioning turns on versioning for the bucket
+func (c *Client) EnableVersioning(ctx context.Context) error {
+	_, err := c.s3Client.PutBucketVersioning(ctx, &s3.PutBucketVersioningInput{
+		Bucket: aws.String(c.bucket),
+		VersioningConfiguration: &types.VersioningConfiguration{
+			Status: types.BucketVersioningStatusEnabled,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enable bucket versioning: %w", err)
+	}
+
+	return nil
+}
+
 func (c *Client) CreateBucket(ctx context.Context) error {
 	_, err := c.s3Client.CreateBucket(ctx, &s3.CreateBucketInput{
 		Bucket: aws.String(c.bucket),
@@ -171,6 +672,18 @@ func (c *Client) DeleteBucket(ctx context.Context) error {
 	return nil
 }
 
+// wrapNotFound adds storage.ErrNotFound to errors caused by missing objects
+func wrapNotFound(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NotFound", "NoSuchKey":
+			return fmt.Errorf("%w: %w", storage.ErrNotFound, err)
+		}
+	}
+	return err
+}
+
 func GetObjectKey(prefix string, parts ...string) string {
 	if prefix == "" {
 		return path.Join(parts...)
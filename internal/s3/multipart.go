@@ -0,0 +1,297 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/pkkulhari/backme/internal/state"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// MultipartThreshold is the size from which files are uploaded in parts
+	MultipartThreshold = 64 << 20
+	// minPartSize is the smallest part size used for multipart uploads
+	minPartSize = 16 << 20
+	// maxParts is the maximum number of parts S3 accepts for one upload
+	maxParts = 10000
+)
+
+// uploadState is persisted while a multipart upload is in progress so that
+// it can be resumed after a restart
+type uploadState struct {
+	UploadID string `json:"upload_id"`
+	Key      string `json:"key"`
+	PartSize int64  `json:"part_size"`
+}
+
+// uploadMultipart uploads the rest of file from its current offset in parts.
+// For a resumable file and with a state store, an upload of the same file
+// interrupted earlier is resumed and only the missing parts are uploaded.
+// Other uploads are aborted when they fail.
+func (c *Client) uploadMultipart(ctx context.Context, key string, file *os.File, metadata map[string]string, resumable bool) error {
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to get file offset: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	size := info.Size() - offset
+
+	var stateName string
+	if resumable && c.state != nil {
+		stateName = state.Name("upload", c.bucket, key, file.Name(), strconv.FormatInt(info.Size(), 10),
+			info.ModTime().UTC().String(), strconv.FormatInt(offset, 10))
+	}
+
+	upload, completed, err := c.resumeUpload(ctx, stateName)
+	if err != nil {
+		return err
+	}
+	if upload == nil {
+		upload, err = c.createUpload(ctx, key, size, metadata)
+		if err != nil {
+			return err
+		}
+		if stateName != "" {
+			if err := c.state.Save(stateName, upload); err != nil {
+				log.Warn().Err(err).Msgf("Upload of %s will not be resumable", key)
+			}
+		}
+	} else {
+		log.Info().Msgf("Resuming upload of %s with %d parts already uploaded", key, len(completed))
+	}
+
+	var parts []types.CompletedPart
+	for number, start := int32(1), int64(0); start < size; number, start = number+1, start+upload.PartSize {
+		if part, ok := completed[number]; ok {
+			parts = append(parts, part)
+			continue
+		}
+
+		length := min(upload.PartSize, size-start)
+		input := &s3.UploadPartInput{
+			Bucket:     aws.String(c.bucket),
+			Key:        aws.String(key),
+			UploadId:   aws.String(upload.UploadID),
+			PartNumber: aws.Int32(number),
+			Body:       io.NewSectionReader(file, offset+start, length),
+		}
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = c.customerKeyParams()
+
+		result, err := c.s3Client.UploadPart(ctx, input)
+		if err != nil {
+			c.failUpload(ctx, key, upload, stateName)
+			return fmt.Errorf("failed to upload part %d of %s: %w", number, key, err)
+		}
+
+		parts = append(parts, types.CompletedPart{
+			PartNumber:        aws.Int32(number),
+			ETag:              result.ETag,
+			ChecksumCRC32:     result.ChecksumCRC32,
+			ChecksumCRC32C:    result.ChecksumCRC32C,
+			ChecksumCRC64NVME: result.ChecksumCRC64NVME,
+			ChecksumSHA1:      result.ChecksumSHA1,
+			ChecksumSHA256:    result.ChecksumSHA256,
+		})
+	}
+
+	input := &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(c.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(upload.UploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = c.customerKeyParams()
+
+	if _, err := c.s3Client.CompleteMultipartUpload(ctx, input); err != nil {
+		c.failUpload(ctx, key, upload, stateName)
+		return fmt.Errorf("failed to complete upload of %s: %w", key, err)
+	}
+
+	if stateName != "" {
+		if err := c.state.Delete(stateName); err != nil {
+			log.Warn().Err(err).Msgf("Failed to delete upload state of %s", key)
+		}
+	}
+	return nil
+}
+
+// resumeUpload returns the upload recorded under stateName together with
+// its uploaded parts, or nil if there is nothing to resume
+func (c *Client) resumeUpload(ctx context.Context, stateName string) (*uploadState, map[int32]types.CompletedPart, error) {
+	if stateName == "" {
+		return nil, nil, nil
+	}
+
+	var upload uploadState
+	found, err := c.state.Load(stateName, &upload)
+	if err != nil || !found {
+		return nil, nil, err
+	}
+
+	completed := make(map[int32]types.CompletedPart)
+	paginator := s3.NewListPartsPaginator(c.s3Client, &s3.ListPartsInput{
+		Bucket:   aws.String(c.bucket),
+		Key:      aws.String(upload.Key),
+		UploadId: aws.String(upload.UploadID),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			var apiErr smithy.APIError
+			if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchUpload" {
+				// The upload was completed or aborted in the meantime
+				return nil, nil, c.state.Delete(stateName)
+			}
+			return nil, nil, fmt.Errorf("failed to list uploaded parts: %w", err)
+		}
+
+		for _, part := range page.Parts {
+			completed[aws.ToInt32(part.PartNumber)] = types.CompletedPart{
+				PartNumber:        part.PartNumber,
+				ETag:              part.ETag,
+				ChecksumCRC32:     part.ChecksumCRC32,
+				ChecksumCRC32C:    part.ChecksumCRC32C,
+				ChecksumCRC64NVME: part.ChecksumCRC64NVME,
+				ChecksumSHA1:      part.ChecksumSHA1,
+				ChecksumSHA256:    part.ChecksumSHA256,
+			}
+		}
+	}
+
+	return &upload, completed, nil
+}
+
+func (c *Client) createUpload(ctx context.Context, key string, size int64, metadata map[string]string) (*uploadState, error) {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(c.bucket),
+		Key:                  aws.String(key),
+		Metadata:             metadata,
+		ServerSideEncryption: c.sse,
+		StorageClass:         c.storageClass,
+	}
+	if c.kmsKeyID != "" {
+		input.SSEKMSKeyId = aws.String(c.kmsKeyID)
+	}
+	if c.tagging != "" {
+		input.Tagging = aws.String(c.tagging)
+	}
+	if c.lockMode != "" {
+		input.ObjectLockMode = c.lockMode
+		input.ObjectLockRetainUntilDate = aws.Time(time.Now().Add(c.lockPeriod))
+	}
+	if c.legalHold {
+		input.ObjectLockLegalHoldStatus = types.ObjectLockLegalHoldStatusOn
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = c.customerKeyParams()
+
+	result, err := c.s3Client.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start upload of %s: %w", key, err)
+	}
+
+	partSize := int64(minPartSize)
+	if size/partSize >= maxParts {
+		partSize = size/(maxParts-1) + 1
+	}
+
+	return &uploadState{
+		UploadID: aws.ToString(result.UploadId),
+		Key:      key,
+		PartSize: partSize,
+	}, nil
+}
+
+// failUpload aborts an upload that cannot be resumed later. Resumable
+// uploads are kept so that the next attempt continues where this one
+// stopped, unless the upload ran out of time.
+func (c *Client) failUpload(ctx context.Context, key string, upload *uploadState, stateName string) {
+	if stateName != "" {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			if err := c.state.Delete(stateName); err != nil {
+				log.Warn().Err(err).Msgf("Failed to delete upload state of %s", key)
+			}
+		} else if found, _ := c.state.Load(stateName, &uploadState{}); found {
+			return
+		}
+	}
+
+	_, err := c.s3Client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(c.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(upload.UploadID),
+	})
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed to abort upload of %s", key)
+	}
+}
+
+// AbortStaleUploads aborts multipart uploads below prefix that were started
+// more than olderThan ago, except those that can still be resumed from the
+// local state. It returns the number of aborted uploads. A prefix is
+// required so that uploads of other hosts sharing the bucket are left alone.
+func (c *Client) AbortStaleUploads(ctx context.Context, prefix string, olderThan time.Duration) (int, error) {
+	if prefix == "" {
+		return 0, fmt.Errorf("a prefix is required to abort stale uploads")
+	}
+
+	resumable := make(map[string]struct{})
+	if c.state != nil {
+		names, err := c.state.List("upload")
+		if err != nil {
+			return 0, fmt.Errorf("failed to list upload state: %w", err)
+		}
+		for _, name := range names {
+			var upload uploadState
+			if found, err := c.state.Load(name, &upload); err == nil && found {
+				resumable[upload.UploadID] = struct{}{}
+			}
+		}
+	}
+
+	aborted := 0
+	paginator := s3.NewListMultipartUploadsPaginator(c.s3Client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(c.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return aborted, fmt.Errorf("failed to list multipart uploads: %w", err)
+		}
+
+		for _, upload := range page.Uploads {
+			if _, ok := resumable[aws.ToString(upload.UploadId)]; ok {
+				continue
+			}
+			if time.Since(aws.ToTime(upload.Initiated)) < olderThan {
+				continue
+			}
+
+			_, err := c.s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(c.bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				return aborted, fmt.Errorf("failed to abort upload of %s: %w", aws.ToString(upload.Key), err)
+			}
+			log.Debug().Msgf("Aborted stale upload of %s", aws.ToString(upload.Key))
+			aborted++
+		}
+	}
+
+	return aborted, nil
+}
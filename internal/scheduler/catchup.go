@@ -0,0 +1,79 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/state"
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog/log"
+)
+
+// scheduleState is persisted per schedule to detect runs missed while the
+// worker was not running
+type scheduleState struct {
+	LastSuccess time.Time `json:"last_success"`
+}
+
+func scheduleStateName(kind, name string) string {
+	return state.Name("schedule", kind, name)
+}
+
+// recordSuccess remembers that the schedule just completed successfully
+func (s *Scheduler) recordSuccess(kind, name string) {
+	if s.state == nil {
+		return
+	}
+	if err := s.state.Save(scheduleStateName(kind, name), scheduleState{LastSuccess: time.Now()}); err != nil {
+		log.Warn().Err(err).Str("name", name).Msg("Failed to record successful run")
+	}
+}
+
+// catchUpPolicy returns the catch up policy of a database or directory schedule
+func catchUpPolicy(schedule any) string {
+	switch schedule := schedule.(type) {
+	case config.DatabaseSchedule:
+		return schedule.CatchUp
+	case config.DirectorySchedule:
+		return schedule.CatchUp
+	}
+	return ""
+}
+
+// catchUp starts job right away if a run of the schedule was due since its
+// last success. Schedules that never succeeded are left to their next run.
+func (s *Scheduler) catchUp(kind, name, cronExpr, policy string, job cron.Job) error {
+	switch policy {
+	case "", config.CatchUpOnce:
+	case config.CatchUpSkip:
+		return nil
+	default:
+		return fmt.Errorf("invalid catch up policy: %s", policy)
+	}
+
+	if s.state == nil {
+		return nil
+	}
+
+	var last scheduleState
+	found, err := s.state.Load(scheduleStateName(kind, name), &last)
+	if err != nil || !found {
+		return err
+	}
+
+	schedule, err := parser.Parse(cronExpr)
+	if err != nil {
+		return err
+	}
+
+	if missed := schedule.Next(last.LastSuccess); missed.Before(time.Now()) {
+		log.Warn().
+			Str("name", name).
+			Time("last_success", last.LastSuccess).
+			Time("missed", missed).
+			Msg("Catching up on missed scheduled run")
+		go job.Run()
+	}
+	return nil
+}
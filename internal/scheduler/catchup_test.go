@@ -0,0 +1,52 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/robfig/cron/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatchUp(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		lastSuccess time.Duration
+		want        bool
+	}{
+		{name: "missed", lastSuccess: 2 * time.Hour, want: true},
+		{name: "missed once", policy: config.CatchUpOnce, lastSuccess: 2 * time.Hour, want: true},
+		{name: "not due", lastSuccess: 30 * time.Minute, want: false},
+		{name: "skip", policy: config.CatchUpSkip, lastSuccess: 2 * time.Hour, want: false},
+		{name: "never succeeded", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(testConfig(t))
+			if tt.lastSuccess != 0 {
+				require.NoError(t, s.state.Save(scheduleStateName("directory", "docs"), scheduleState{LastSuccess: time.Now().Add(-tt.lastSuccess)}))
+			}
+
+			ran := make(chan struct{}, 1)
+			job := cron.FuncJob(func() { ran <- struct{}{} })
+			require.NoError(t, s.catchUp("directory", "docs", "@every 1h", tt.policy, job))
+
+			select {
+			case <-ran:
+				assert.True(t, tt.want, "unexpected catch up run")
+			case <-time.After(100 * time.Millisecond):
+				assert.False(t, tt.want, "missed run was not caught up")
+			}
+		})
+	}
+}
+
+func TestCatchUpInvalidPolicy(t *testing.T) {
+	s := New(testConfig(t))
+	err := s.catchUp("directory", "docs", "@every 1h", "always", cron.FuncJob(func() {}))
+	assert.ErrorContains(t, err, "invalid catch up policy: always")
+}
@@ -0,0 +1,44 @@
+package scheduler
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/history"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunStatsPerAttempt(t *testing.T) {
+	schedule := config.DirectorySchedule{
+		Name:       "docs",
+		Expression: "@every 1h",
+		Retry:      &config.RetryConfig{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+	}
+	s := New(testConfig(t, schedule))
+
+	attempts := 0
+	err := s.Run(context.Background(), "directory", "docs", nil, func(ctx context.Context, cfg any) error {
+		attempts++
+		stats := history.StatsFrom(ctx)
+		stats.AddFile("a.txt", 10)
+		stats.AddFile("b.txt", 20)
+		if attempts == 1 {
+			return &net.OpError{Op: "read", Err: syscall.ECONNRESET}
+		}
+		// A file uploaded to a second destination is not counted again
+		stats.AddFile("a.txt", 10)
+		return nil
+	})
+	require.NoError(t, err)
+
+	runs, err := s.history.Runs("directory", "docs")
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	assert.Equal(t, 2, runs[0].Files)
+	assert.Equal(t, int64(30), runs[0].Bytes)
+}
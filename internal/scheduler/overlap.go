@@ -0,0 +1,103 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// newJob returns a cron job running fn that applies the overlap policy
+// when the previous run of the schedule is still in progress. Runs are
+// tracked by guard, which outlives the job when the schedule is reloaded.
+func newJob(ctx context.Context, name, policy string, guard *runGuard, fn func(ctx context.Context)) (*guardedJob, error) {
+	switch policy {
+	case "", config.OverlapSkip, config.OverlapQueue, config.OverlapCancelPrevious:
+	default:
+		return nil, fmt.Errorf("invalid overlap policy: %s", policy)
+	}
+
+	return &guardedJob{ctx: ctx, name: name, policy: policy, guard: guard, fn: fn}, nil
+}
+
+// guardedJob runs a schedule through its run guard
+type guardedJob struct {
+	ctx    context.Context
+	name   string
+	policy string
+	guard  *runGuard
+	fn     func(ctx context.Context)
+}
+
+// Run starts a scheduled run
+func (j *guardedJob) Run() {
+	j.guard.run(j.ctx, j.name, j.policy, "scheduled run", j.fn)
+}
+
+// trigger starts a run requested outside the schedule, which follows the
+// overlap policy like a scheduled run
+func (j *guardedJob) trigger() {
+	j.guard.run(j.ctx, j.name, j.policy, "requested run", j.fn)
+}
+
+// runGuard tracks the run in progress of a schedule
+type runGuard struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// run calls fn unless a run is in progress, in which case the run is
+// skipped, waits for it to finish or cancels it depending on policy. What
+// names the run in log messages.
+func (g *runGuard) run(ctx context.Context, name, policy, what string, fn func(ctx context.Context)) {
+	for delayed := false; ; {
+		g.mu.Lock()
+		if g.done == nil {
+			break
+		}
+
+		previous := g.done
+		switch policy {
+		case config.OverlapQueue:
+			if !delayed {
+				log.Warn().Str("name", name).Msgf("Delaying %s until the previous run finished", what)
+				delayed = true
+			}
+		case config.OverlapCancelPrevious:
+			log.Warn().Str("name", name).Msg("Cancelling the previous run, which is still in progress")
+			g.cancel()
+		default:
+			g.mu.Unlock()
+			log.Warn().Str("name", name).Msgf("Skipped %s, the previous run is still in progress", what)
+			return
+		}
+		g.mu.Unlock()
+
+		select {
+		case <-previous:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	g.cancel, g.done = cancel, done
+	g.mu.Unlock()
+
+	defer func() {
+		cancel()
+
+		g.mu.Lock()
+		if g.done == done {
+			g.cancel, g.done = nil, nil
+		}
+		g.mu.Unlock()
+		close(done)
+	}()
+
+	fn(ctx)
+}
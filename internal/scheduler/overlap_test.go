@@ -0,0 +1,110 @@
+package scheduler
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startRun starts a run through guard that blocks until release is closed
+// or its context is cancelled, and waits until it is running. It returns
+// the context of the run and a flag set once the run returned.
+func startRun(t *testing.T, guard *runGuard, policy string, release <-chan struct{}) (context.Context, *atomic.Bool) {
+	ctxs := make(chan context.Context, 1)
+	finished := &atomic.Bool{}
+	go guard.run(context.Background(), "test", policy, "scheduled run", func(ctx context.Context) {
+		ctxs <- ctx
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		finished.Store(true)
+	})
+
+	select {
+	case ctx := <-ctxs:
+		return ctx, finished
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "run did not start")
+		return nil, nil
+	}
+}
+
+func TestRunGuardSkip(t *testing.T) {
+	guard := &runGuard{}
+	release := make(chan struct{})
+	startRun(t, guard, config.OverlapSkip, release)
+
+	var runs atomic.Int32
+	guard.run(context.Background(), "test", config.OverlapSkip, "scheduled run", func(ctx context.Context) { runs.Add(1) })
+	assert.Equal(t, int32(0), runs.Load())
+
+	// Once the previous run finished, the next one starts again
+	close(release)
+	require.Eventually(t, func() bool {
+		guard.run(context.Background(), "test", config.OverlapSkip, "scheduled run", func(ctx context.Context) { runs.Add(1) })
+		return runs.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRunGuardQueue(t *testing.T) {
+	guard := &runGuard{}
+	release := make(chan struct{})
+	_, finished := startRun(t, guard, config.OverlapQueue, release)
+
+	queued := make(chan struct{})
+	go func() {
+		defer close(queued)
+		guard.run(context.Background(), "test", config.OverlapQueue, "scheduled run", func(ctx context.Context) {
+			assert.True(t, finished.Load(), "queued run started before the previous run finished")
+		})
+	}()
+
+	select {
+	case <-queued:
+		require.FailNow(t, "queued run did not wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-queued:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "queued run did not start")
+	}
+}
+
+func TestRunGuardQueueCancelled(t *testing.T) {
+	guard := &runGuard{}
+	release := make(chan struct{})
+	defer close(release)
+	startRun(t, guard, config.OverlapQueue, release)
+
+	// A queued run gives up when the worker stops
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var runs atomic.Int32
+	guard.run(ctx, "test", config.OverlapQueue, "scheduled run", func(ctx context.Context) { runs.Add(1) })
+	assert.Equal(t, int32(0), runs.Load())
+}
+
+func TestRunGuardCancelPrevious(t *testing.T) {
+	guard := &runGuard{}
+	release := make(chan struct{})
+	defer close(release)
+	previous, finished := startRun(t, guard, config.OverlapCancelPrevious, release)
+
+	var started atomic.Bool
+	guard.run(context.Background(), "test", config.OverlapCancelPrevious, "scheduled run", func(ctx context.Context) {
+		started.Store(true)
+		assert.ErrorIs(t, previous.Err(), context.Canceled, "previous run was not cancelled before the new one started")
+		assert.True(t, finished.Load(), "new run started before the previous run stopped")
+		assert.NoError(t, ctx.Err())
+	})
+	assert.True(t, started.Load())
+}
@@ -0,0 +1,144 @@
+package scheduler
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// jobQueue limits how many scheduled backups run at once, overall and per
+// database host. Waiting jobs are started by priority, then in order of
+// arrival.
+type jobQueue struct {
+	maxJobs        int
+	maxJobsPerHost int
+
+	mu      sync.Mutex
+	running int
+	hosts   map[string]int
+	waiting []*queuedJob
+	seq     uint64
+}
+
+type queuedJob struct {
+	name     string
+	priority int
+	host     string
+	seq      uint64
+	ready    chan struct{}
+}
+
+// newJobQueue returns a queue with the given limits, where zero means unlimited
+func newJobQueue(maxJobs, maxJobsPerHost int) *jobQueue {
+	return &jobQueue{
+		maxJobs:        maxJobs,
+		maxJobsPerHost: maxJobsPerHost,
+		hosts:          make(map[string]int),
+	}
+}
+
+// setLimits changes the limits, starting waiting jobs if they were raised
+func (q *jobQueue) setLimits(maxJobs, maxJobsPerHost int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.maxJobs = maxJobs
+	q.maxJobsPerHost = maxJobsPerHost
+	q.dispatch()
+}
+
+// acquire waits until the job may run and returns a function that must be
+// called once it finished. Jobs without a host only count towards the
+// overall limit.
+func (q *jobQueue) acquire(ctx context.Context, name string, priority int, host string) (func(), error) {
+	q.mu.Lock()
+	q.seq++
+	job := &queuedJob{name: name, priority: priority, host: host, seq: q.seq, ready: make(chan struct{})}
+	q.waiting = append(q.waiting, job)
+	q.dispatch()
+	waiting := len(q.waiting)
+	q.mu.Unlock()
+
+	release := func() { q.release(host) }
+
+	select {
+	case <-job.ready:
+		return release, nil
+	default:
+		log.Info().Str("name", name).Int("queued", waiting).Msg("Waiting for a free job slot")
+	}
+
+	select {
+	case <-job.ready:
+		return release, nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		select {
+		case <-job.ready:
+			// Started in the meantime, give the slot to the next job
+			q.finish(host)
+		default:
+			q.waiting = slices.DeleteFunc(q.waiting, func(j *queuedJob) bool { return j == job })
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (q *jobQueue) release(host string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.finish(host)
+}
+
+func (q *jobQueue) finish(host string) {
+	q.running--
+	if host != "" {
+		if q.hosts[host]--; q.hosts[host] <= 0 {
+			delete(q.hosts, host)
+		}
+	}
+	q.dispatch()
+}
+
+// dispatch starts waiting jobs in order as long as limits allow. A job held
+// back by its host limit doesn't block jobs for other hosts.
+func (q *jobQueue) dispatch() {
+	slices.SortFunc(q.waiting, func(a, b *queuedJob) int {
+		return cmp.Or(cmp.Compare(b.priority, a.priority), cmp.Compare(a.seq, b.seq))
+	})
+
+	remaining := q.waiting[:0]
+	for _, job := range q.waiting {
+		if q.maxJobs > 0 && q.running >= q.maxJobs {
+			remaining = append(remaining, job)
+			continue
+		}
+		if job.host != "" && q.maxJobsPerHost > 0 && q.hosts[job.host] >= q.maxJobsPerHost {
+			remaining = append(remaining, job)
+			continue
+		}
+
+		q.running++
+		if job.host != "" {
+			q.hosts[job.host]++
+		}
+		close(job.ready)
+	}
+	clear(q.waiting[len(remaining):])
+	q.waiting = remaining
+}
+
+// limit returns fn wrapped so that every call waits for a slot in the queue
+func (q *jobQueue) limit(name string, priority int, host string, fn func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		release, err := q.acquire(ctx, name, priority, host)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return fn(ctx)
+	}
+}
@@ -0,0 +1,98 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waiting returns the number of jobs waiting in q
+func (q *jobQueue) waitingJobs() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+// acquireAsync acquires a slot in the background and reports the job name
+// on started once it got one
+func acquireAsync(ctx context.Context, q *jobQueue, name string, priority int, host string, started chan<- string) <-chan func() {
+	releases := make(chan func(), 1)
+	go func() {
+		release, err := q.acquire(ctx, name, priority, host)
+		if err != nil {
+			close(releases)
+			return
+		}
+		started <- name
+		releases <- release
+	}()
+	return releases
+}
+
+func TestQueuePriority(t *testing.T) {
+	ctx := context.Background()
+	q := newJobQueue(1, 0)
+	release, err := q.acquire(ctx, "running", 0, "")
+	require.NoError(t, err)
+
+	started := make(chan string, 3)
+	low := acquireAsync(ctx, q, "low", 0, "", started)
+	require.Eventually(t, func() bool { return q.waitingJobs() == 1 }, time.Second, time.Millisecond)
+	high := acquireAsync(ctx, q, "high", 5, "", started)
+	require.Eventually(t, func() bool { return q.waitingJobs() == 2 }, time.Second, time.Millisecond)
+
+	// The job with the higher priority starts first although it came later
+	release()
+	assert.Equal(t, "high", <-started)
+	(<-high)()
+	assert.Equal(t, "low", <-started)
+	(<-low)()
+}
+
+func TestQueueHostLimit(t *testing.T) {
+	ctx := context.Background()
+	q := newJobQueue(0, 1)
+	release, err := q.acquire(ctx, "first", 0, "db1")
+	require.NoError(t, err)
+
+	started := make(chan string, 2)
+	second := acquireAsync(ctx, q, "second", 0, "db1", started)
+	require.Eventually(t, func() bool { return q.waitingJobs() == 1 }, time.Second, time.Millisecond)
+
+	// A job for another host is not held back by the waiting one
+	other, err := q.acquire(ctx, "other", 0, "db2")
+	require.NoError(t, err)
+	other()
+	assert.Equal(t, 1, q.waitingJobs())
+
+	release()
+	assert.Equal(t, "second", <-started)
+	(<-second)()
+}
+
+func TestQueueCancel(t *testing.T) {
+	q := newJobQueue(1, 0)
+	release, err := q.acquire(context.Background(), "running", 0, "")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := q.acquire(ctx, "cancelled", 0, "")
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return q.waitingJobs() == 1 }, time.Second, time.Millisecond)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.Equal(t, 0, q.waitingJobs())
+
+	// The cancelled job must not hold on to a slot
+	release()
+	release, err = q.acquire(context.Background(), "next", 0, "")
+	require.NoError(t, err)
+	release()
+}
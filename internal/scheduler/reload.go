@@ -0,0 +1,132 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// Reload applies the schedules of cfg to the running scheduler. Schedules
+// that were removed or changed are unscheduled and changed or new ones are
+// scheduled, while unchanged schedules and runs in progress are left alone.
+// Runs of a changed schedule still apply its overlap policy to runs the
+// previous version started, and missed runs are not caught up again. An
+// invalid configuration is rejected as a whole.
+func (s *Scheduler) Reload(cfg *config.Config) error {
+	if err := Validate(cfg); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cfg = cfg
+	s.queue.setLimits(cfg.Worker.MaxConcurrentJobs, cfg.Worker.MaxJobsPerHost)
+
+	desired := make(map[entryKey]any)
+	for _, schedule := range cfg.Schedules.Databases {
+		desired[entryKey{"database", schedule.Name}] = schedule
+	}
+	for _, schedule := range cfg.Schedules.Directories {
+		desired[entryKey{"directory", schedule.Name}] = schedule
+	}
+
+	for key, e := range s.entries {
+		if schedule, ok := desired[key]; ok && reflect.DeepEqual(schedule, e.schedule) {
+			delete(desired, key)
+			continue
+		}
+		s.cron.Remove(e.id)
+		delete(s.entries, key)
+		log.Info().Str("name", key.name).Msgf("Unscheduled %s backup", key.kind)
+	}
+
+	for _, schedule := range desired {
+		switch schedule := schedule.(type) {
+		case config.DatabaseSchedule:
+			s.addDatabaseSchedule(schedule)
+		case config.DirectorySchedule:
+			s.addDirectorySchedule(schedule)
+		}
+	}
+	return nil
+}
+
+// Validate checks the schedules of cfg without scheduling them
+func Validate(cfg *config.Config) error {
+	var errs []error
+	check := func(kind, name, expression, timezone, overlap, catchUp string, seen map[string]bool) {
+		if name == "" {
+			errs = append(errs, fmt.Errorf("%s schedule without a name", kind))
+			return
+		}
+		if seen[name] {
+			errs = append(errs, fmt.Errorf("duplicate %s schedule '%s'", kind, name))
+		}
+		seen[name] = true
+
+		if _, err := getCronExpression(expression, timezone); err != nil {
+			errs = append(errs, fmt.Errorf("%s schedule '%s': %w", kind, name, err))
+		}
+		switch overlap {
+		case "", config.OverlapSkip, config.OverlapQueue, config.OverlapCancelPrevious:
+		default:
+			errs = append(errs, fmt.Errorf("%s schedule '%s': invalid overlap policy: %s", kind, name, overlap))
+		}
+		switch catchUp {
+		case "", config.CatchUpOnce, config.CatchUpSkip:
+		default:
+			errs = append(errs, fmt.Errorf("%s schedule '%s': invalid catch up policy: %s", kind, name, catchUp))
+		}
+	}
+
+	if err := validateRetention(cfg.AWS.Retention); err != nil {
+		errs = append(errs, err)
+	}
+
+	seen := make(map[string]bool)
+	for _, schedule := range cfg.Schedules.Databases {
+		check("database", schedule.Name, schedule.Expression, schedule.Timezone, schedule.Overlap, schedule.CatchUp, seen)
+		if schedule.AWS != nil {
+			if err := validateRetention(schedule.AWS.Retention); err != nil {
+				errs = append(errs, fmt.Errorf("database schedule '%s': %w", schedule.Name, err))
+			}
+		}
+	}
+
+	seen = make(map[string]bool)
+	for _, schedule := range cfg.Schedules.Directories {
+		check("directory", schedule.Name, schedule.Expression, schedule.Timezone, schedule.Overlap, schedule.CatchUp, seen)
+		switch schedule.Mode {
+		case "", config.DirectoryModeFiles, config.DirectoryModeArchive, config.DirectoryModeSnapshot, config.DirectoryModeWatch:
+		default:
+			errs = append(errs, fmt.Errorf("directory schedule '%s': invalid directory backup mode: %s", schedule.Name, schedule.Mode))
+		}
+		if schedule.AWS != nil && schedule.AWS.Retention != nil {
+			if schedule.Mode != config.DirectoryModeArchive {
+				errs = append(errs, fmt.Errorf("directory schedule '%s': retention only applies to archive mode", schedule.Name))
+			} else if err := validateRetention(schedule.AWS.Retention); err != nil {
+				errs = append(errs, fmt.Errorf("directory schedule '%s': %w", schedule.Name, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateRetention checks that a retention, if set, keeps backups by count
+// or age
+func validateRetention(retention *config.RetentionConfig) error {
+	switch {
+	case retention == nil:
+		return nil
+	case retention.KeepLast < 0 || retention.MaxAge < 0:
+		return fmt.Errorf("retention keep_last and max_age must not be negative")
+	case retention.KeepLast == 0 && retention.MaxAge == 0:
+		return fmt.Errorf("retention needs keep_last or max_age")
+	}
+	return nil
+}
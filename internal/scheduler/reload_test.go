@@ -0,0 +1,181 @@
+package scheduler
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitForRuns waits until n runs of the directory schedule name were
+// recorded, so that no run writes to the state directory after the test
+func waitForRuns(t *testing.T, s *Scheduler, name string, n int) {
+	require.Eventually(t, func() bool {
+		runs, err := s.history.Runs("directory", name)
+		return err == nil && len(runs) == n
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func testConfig(t *testing.T, schedules ...config.DirectorySchedule) *config.Config {
+	return &config.Config{
+		StateDir:  t.TempDir(),
+		Schedules: config.Schedules{Directories: schedules},
+	}
+}
+
+// blockingBackup returns a backup function that counts its runs and blocks
+// until release is closed
+func blockingBackup(runs *atomic.Int32, started chan<- struct{}, release <-chan struct{}) BackupFunc {
+	return func(ctx context.Context, cfg any) error {
+		runs.Add(1)
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return nil
+	}
+}
+
+func TestReloadWhileRunning(t *testing.T) {
+	for _, policy := range []string{config.OverlapSkip, config.OverlapQueue} {
+		t.Run(policy, func(t *testing.T) {
+			schedule := config.DirectorySchedule{Name: "docs", Expression: "@every 1h", Overlap: policy}
+			cfg := testConfig(t, schedule)
+
+			var runs atomic.Int32
+			started, release := make(chan struct{}, 10), make(chan struct{})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			s := New(cfg)
+			require.NoError(t, s.Start(ctx, nil, blockingBackup(&runs, started, release)))
+			defer s.Stop()
+
+			require.NoError(t, s.Trigger("directory", "docs"))
+			<-started
+
+			// Changing the schedule must not start a second run next to the one in progress
+			schedule.Timeout = time.Hour
+			require.NoError(t, s.Reload(testConfig(t, schedule)))
+			require.NoError(t, s.Trigger("directory", "docs"))
+
+			time.Sleep(100 * time.Millisecond)
+			assert.Equal(t, int32(1), runs.Load())
+
+			close(release)
+			if policy == config.OverlapQueue {
+				<-started
+				assert.Equal(t, int32(2), runs.Load())
+				waitForRuns(t, s, "docs", 2)
+				return
+			}
+			waitForRuns(t, s, "docs", 1)
+		})
+	}
+}
+
+func TestReloadDoesNotCatchUp(t *testing.T) {
+	schedule := config.DirectorySchedule{Name: "docs", Expression: "@every 1h"}
+	cfg := testConfig(t, schedule)
+
+	var runs atomic.Int32
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	defer close(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := New(cfg)
+	require.NoError(t, s.Start(ctx, nil, blockingBackup(&runs, started, release)))
+	defer s.Stop()
+
+	// A run was missed, but only starting the worker catches up on it
+	require.NoError(t, s.state.Save(scheduleStateName("directory", "docs"), scheduleState{LastSuccess: time.Now().Add(-2 * time.Hour)}))
+	schedule.Priority = 1
+	require.NoError(t, s.Reload(testConfig(t, schedule)))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(0), runs.Load())
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		schedules config.Schedules
+		wantErr   string
+	}{
+		{
+			name: "valid",
+			schedules: config.Schedules{
+				Databases:   []config.DatabaseSchedule{{Name: "db", Expression: "daily", Overlap: config.OverlapQueue}},
+				Directories: []config.DirectorySchedule{{Name: "db", Expression: "@hourly", CatchUp: config.CatchUpSkip}},
+			},
+		},
+		{
+			name:      "missing name",
+			schedules: config.Schedules{Databases: []config.DatabaseSchedule{{Expression: "daily"}}},
+			wantErr:   "database schedule without a name",
+		},
+		{
+			name:      "duplicate name",
+			schedules: config.Schedules{Directories: []config.DirectorySchedule{{Name: "docs", Expression: "daily"}, {Name: "docs", Expression: "daily"}}},
+			wantErr:   "duplicate directory schedule 'docs'",
+		},
+		{
+			name:      "invalid expression",
+			schedules: config.Schedules{Databases: []config.DatabaseSchedule{{Name: "db", Expression: "nope"}}},
+			wantErr:   "invalid cron expression",
+		},
+		{
+			name:      "invalid timezone",
+			schedules: config.Schedules{Databases: []config.DatabaseSchedule{{Name: "db", Expression: "daily", Timezone: "Mars/Olympus"}}},
+			wantErr:   "invalid timezone",
+		},
+		{
+			name:      "invalid overlap",
+			schedules: config.Schedules{Databases: []config.DatabaseSchedule{{Name: "db", Expression: "daily", Overlap: "bogus"}}},
+			wantErr:   "invalid overlap policy: bogus",
+		},
+		{
+			name:      "invalid catch up",
+			schedules: config.Schedules{Databases: []config.DatabaseSchedule{{Name: "db", Expression: "daily", CatchUp: "always"}}},
+			wantErr:   "invalid catch up policy: always",
+		},
+		{
+			name: "invalid mode",
+			schedules: config.Schedules{Directories: []config.DirectorySchedule{{
+				Name: "docs", Expression: "daily", DirectoryConfig: config.DirectoryConfig{Mode: "mirror"},
+			}}},
+			wantErr: "invalid directory backup mode: mirror",
+		},
+		{
+			name: "empty retention",
+			schedules: config.Schedules{Databases: []config.DatabaseSchedule{{
+				Name: "db", Expression: "daily", AWS: &config.AWSConfig{Retention: &config.RetentionConfig{}},
+			}}},
+			wantErr: "retention needs keep_last or max_age",
+		},
+		{
+			name: "retention outside archive mode",
+			schedules: config.Schedules{Directories: []config.DirectorySchedule{{
+				Name: "docs", Expression: "daily", AWS: &config.AWSConfig{Retention: &config.RetentionConfig{KeepLast: 7}},
+			}}},
+			wantErr: "retention only applies to archive mode",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(&config.Config{Schedules: tt.schedules})
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
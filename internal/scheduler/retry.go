@@ -0,0 +1,117 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net"
+	"os/exec"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// Defaults for retry settings left empty
+const (
+	defaultMaxAttempts    = 3
+	defaultInitialBackoff = 30 * time.Second
+	defaultMaxBackoff     = 10 * time.Minute
+)
+
+// permanentErrorCodes are S3 error codes that retrying won't fix
+var permanentErrorCodes = map[string]bool{
+	"AccessDenied":          true,
+	"AllAccessDisabled":     true,
+	"InvalidAccessKeyId":    true,
+	"InvalidBucketName":     true,
+	"NoSuchBucket":          true,
+	"SignatureDoesNotMatch": true,
+}
+
+// withRetry calls fn until it succeeds, the attempts configured in retry are
+// used up or the error is not retryable. Without retry settings fn is
+// called once.
+func withRetry(ctx context.Context, name string, retry *config.RetryConfig, fn func(ctx context.Context) error) error {
+	if retry == nil {
+		return fn(ctx)
+	}
+
+	maxAttempts := retry.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= maxAttempts || !isRetryable(ctx, err) {
+			return err
+		}
+
+		delay := backoff(retry, attempt)
+		log.Warn().Err(err).
+			Str("name", name).
+			Int("attempt", attempt).
+			Int("max_attempts", maxAttempts).
+			Msgf("Scheduled backup failed, retrying in %s", delay.Round(time.Second))
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff returns the delay before the attempt following the given one. It
+// doubles with every attempt up to the maximum and is varied by up to the
+// jitter fraction in either direction.
+func backoff(retry *config.RetryConfig, attempt int) time.Duration {
+	initial := retry.InitialBackoff
+	if initial <= 0 {
+		initial = defaultInitialBackoff
+	}
+	maximum := retry.MaxBackoff
+	if maximum <= 0 {
+		maximum = defaultMaxBackoff
+	}
+
+	delay := initial
+	for i := 1; i < attempt && delay < maximum; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maximum)
+
+	if jitter := min(retry.Jitter, 1); jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * jitter * float64(delay))
+	}
+	return delay
+}
+
+// isRetryable reports whether a failed backup may succeed when run again.
+// Only network, I/O and throttling errors, timeouts and failed pg_dump runs
+// are retried. Cancelled runs and errors caused by the configuration or
+// permissions are not.
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, config.ErrInvalid) || errors.Is(err, fs.ErrPermission) {
+		return false
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return !permanentErrorCodes[apiErr.ErrorCode()]
+	}
+
+	var netErr net.Error
+	var pathErr *fs.PathError
+	var exitErr *exec.ExitError
+	return errors.As(err, &netErr) ||
+		errors.As(err, &pathErr) ||
+		errors.As(err, &exitErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,107 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	retry := &config.RetryConfig{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		assert.Equal(t, want, backoff(retry, attempt+1), "attempt %d", attempt+1)
+	}
+
+	assert.Equal(t, defaultInitialBackoff, backoff(&config.RetryConfig{}, 1))
+	assert.Equal(t, defaultMaxBackoff, backoff(&config.RetryConfig{}, 100))
+
+	retry.Jitter = 0.5
+	for range 100 {
+		delay := backoff(retry, 2)
+		assert.GreaterOrEqual(t, delay, time.Second)
+		assert.LessOrEqual(t, delay, 3*time.Second)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{name: "unknown", ctx: context.Background(), err: errors.New("unexpected failure"), want: false},
+		{name: "pg_dump failed", ctx: context.Background(), err: fmtWrap(&exec.ExitError{}), want: true},
+		{name: "network", ctx: context.Background(), err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, want: true},
+		{name: "I/O", ctx: context.Background(), err: fmtWrap(&fs.PathError{Op: "write", Path: "/tmp/dump.sql", Err: syscall.ENOSPC}), want: true},
+		{name: "connection closed", ctx: context.Background(), err: fmtWrap(io.ErrUnexpectedEOF), want: true},
+		{name: "timed out", ctx: context.Background(), err: fmtWrap(context.DeadlineExceeded), want: true},
+		{name: "permission", ctx: context.Background(), err: fmtWrap(&fs.PathError{Op: "open", Path: "/srv/docs", Err: syscall.EACCES}), want: false},
+		{name: "invalid configuration", ctx: context.Background(), err: fmtWrap(config.Invalid(errors.New("invalid symlinks policy: bogus"))), want: false},
+		{name: "invalid destination", ctx: context.Background(), err: errors.Join(config.Invalid(errors.New("unsupported destination")), &net.OpError{Op: "dial", Err: errors.New("connection refused")}), want: false},
+		{name: "throttled", ctx: context.Background(), err: &smithy.GenericAPIError{Code: "SlowDown"}, want: true},
+		{name: "access denied", ctx: context.Background(), err: &smithy.GenericAPIError{Code: "AccessDenied"}, want: false},
+		{name: "missing bucket", ctx: context.Background(), err: fmtWrap(&smithy.GenericAPIError{Code: "NoSuchBucket"}), want: false},
+		{name: "canceled error", ctx: context.Background(), err: fmtWrap(context.Canceled), want: false},
+		{name: "canceled context", ctx: cancelled, err: errors.New("upload failed"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isRetryable(tt.ctx, tt.err))
+		})
+	}
+}
+
+func fmtWrap(err error) error {
+	return errors.Join(errors.New("failed to upload dump"), err)
+}
+
+func TestWithRetry(t *testing.T) {
+	retry := &config.RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	attempts := 0
+	err := withRetry(context.Background(), "test", retry, func(ctx context.Context) error {
+		attempts++
+		return &net.OpError{Op: "read", Err: syscall.ECONNRESET}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = withRetry(context.Background(), "test", retry, func(ctx context.Context) error {
+		attempts++
+		return &smithy.GenericAPIError{Code: "InvalidAccessKeyId"}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+
+	attempts = 0
+	err = withRetry(context.Background(), "test", retry, func(ctx context.Context) error {
+		attempts++
+		return config.Invalid(errors.New("source path does not exist: /srv/docs"))
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+
+	attempts = 0
+	err = withRetry(context.Background(), "test", nil, func(ctx context.Context) error {
+		attempts++
+		return &net.OpError{Op: "read", Err: syscall.ECONNRESET}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
@@ -2,105 +2,238 @@ package scheduler
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/history"
+	"github.com/pkkulhari/backme/internal/state"
 	"github.com/robfig/cron/v3"
 	"github.com/rs/zerolog/log"
 )
 
 type BackupFunc func(ctx context.Context, cfg any) error
 
+// parser accepts standard cron expressions with an optional leading seconds
+// field, descriptors such as @hourly and a CRON_TZ= or TZ= prefix
+var parser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
 type Scheduler struct {
-	cfg  *config.Config
-	cron *cron.Cron
+	cfg     *config.Config
+	cron    *cron.Cron
+	queue   *jobQueue
+	state   *state.Store
+	history *history.Store
+
+	mu            sync.Mutex
+	ctx           context.Context
+	dbBackupFunc  BackupFunc
+	dirBackupFunc BackupFunc
+	entries       map[entryKey]entry
+	guards        map[entryKey]*runGuard
+}
+
+// entryKey identifies a schedule, whose names are unique per type
+type entryKey struct {
+	kind string
+	name string
+}
+
+// entry is a scheduled cron job together with the schedule it was created
+// from. The job runs the backup right away, while scheduled applies the
+// schedule's jitter first.
+type entry struct {
+	id        cron.EntryID
+	schedule  any
+	cronExpr  string
+	job       *guardedJob
+	scheduled cron.Job
 }
 
 func New(cfg *config.Config) *Scheduler {
-	return &Scheduler{
-		cfg:  cfg,
-		cron: cron.New(),
+	s := &Scheduler{
+		cfg:     cfg,
+		cron:    cron.New(cron.WithParser(parser)),
+		queue:   newJobQueue(cfg.Worker.MaxConcurrentJobs, cfg.Worker.MaxJobsPerHost),
+		entries: make(map[entryKey]entry),
+		guards:  make(map[entryKey]*runGuard),
 	}
+
+	if cfg.StateDir != "" {
+		store, err := state.Open(cfg.StateDir)
+		if err != nil {
+			log.Warn().Err(err).Msg("Missed runs will not be caught up and runs will not be recorded")
+		} else {
+			s.state = store
+			s.history = history.New(store)
+		}
+	}
+	return s
 }
 
 func (s *Scheduler) Start(ctx context.Context, dbBackupFunc, dirBackupFunc BackupFunc) error {
-	// Schedule database backups
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ctx = ctx
+	s.dbBackupFunc = dbBackupFunc
+	s.dirBackupFunc = dirBackupFunc
+
 	for _, schedule := range s.cfg.Schedules.Databases {
-		dbSchedule := schedule // Create a copy to avoid closure issues
-		cronExpr := s.getCronExpression(dbSchedule.Expression)
-		if cronExpr == "" {
-			log.Error().Str("name", dbSchedule.Name).Msg("Invalid schedule configuration, skipping")
-			continue
+		s.addDatabaseSchedule(schedule)
+	}
+	for _, schedule := range s.cfg.Schedules.Directories {
+		s.addDirectorySchedule(schedule)
+	}
+
+	// Only missed runs are caught up, schedules changed by a reload are not
+	for key, e := range s.entries {
+		if err := s.catchUp(key.kind, key.name, e.cronExpr, catchUpPolicy(e.schedule), e.scheduled); err != nil {
+			log.Error().Err(err).Str("name", key.name).Msgf("Failed to catch up on missed %s backup", key.kind)
 		}
+	}
 
-		_, err := s.cron.AddFunc(cronExpr, func() {
-			if err := dbBackupFunc(ctx, struct {
-				config.DatabaseConfig
-				AWS *config.AWSConfig
-			}{
-				DatabaseConfig: dbSchedule.Database,
-				AWS:            dbSchedule.AWS,
-			}); err != nil {
-				log.Error().Err(err).
-					Str("name", dbSchedule.Name).
-					Str("database", dbSchedule.Database.Name).
-					Msg("Failed to execute scheduled database backup")
-			}
-		})
-		if err != nil {
+	s.cron.Start()
+	return nil
+}
+
+// addDatabaseSchedule schedules a database backup. Invalid schedules are
+// logged and skipped.
+func (s *Scheduler) addDatabaseSchedule(dbSchedule config.DatabaseSchedule) {
+	cronExpr, err := getCronExpression(dbSchedule.Expression, dbSchedule.Timezone)
+	if err != nil {
+		log.Error().Err(err).Str("name", dbSchedule.Name).Msg("Invalid schedule configuration, skipping")
+		return
+	}
+
+	run := s.databaseRun(dbSchedule, s.dbBackupFunc)
+	key := entryKey{"database", dbSchedule.Name}
+	job, err := newJob(s.ctx, dbSchedule.Name, dbSchedule.Overlap, s.guard(key), func(ctx context.Context) {
+		if err := run(ctx); err != nil {
 			log.Error().Err(err).
 				Str("name", dbSchedule.Name).
 				Str("database", dbSchedule.Database.Name).
-				Msg("Failed to schedule database backup")
-			continue
+				Msg("Failed to execute scheduled database backup")
 		}
-
-		log.Info().
+	})
+	scheduled := withJitter(s.ctx, dbSchedule.Name, dbSchedule.Jitter, job)
+	var id cron.EntryID
+	if err == nil {
+		id, err = s.cron.AddJob(cronExpr, scheduled)
+	}
+	if err != nil {
+		log.Error().Err(err).
 			Str("name", dbSchedule.Name).
 			Str("database", dbSchedule.Database.Name).
-			Str("schedule", cronExpr).
-			Msg("Scheduled database backup")
+			Msg("Failed to schedule database backup")
+		return
 	}
+	s.entries[key] = entry{id: id, schedule: dbSchedule, cronExpr: cronExpr, job: job, scheduled: scheduled}
 
-	// Schedule directory backups
-	for _, schedule := range s.cfg.Schedules.Directories {
-		dirSchedule := schedule // Create a copy to avoid closure issues
-		cronExpr := s.getCronExpression(dirSchedule.Expression)
-		if cronExpr == "" {
-			log.Error().Str("name", dirSchedule.Name).Msg("Invalid schedule configuration, skipping")
-			continue
-		}
+	log.Info().
+		Str("name", dbSchedule.Name).
+		Str("database", dbSchedule.Database.Name).
+		Str("schedule", cronExpr).
+		Msg("Scheduled database backup")
+}
 
-		_, err := s.cron.AddFunc(cronExpr, func() {
-			if err := dirBackupFunc(ctx, struct {
-				config.DirectorySchedule
-				AWS *config.AWSConfig
-			}{
-				DirectorySchedule: dirSchedule,
-				AWS:               dirSchedule.AWS,
-			}); err != nil {
-				log.Error().Err(err).
-					Str("name", dirSchedule.Name).
-					Str("source", dirSchedule.SourcePath).
-					Msg("Failed to execute scheduled directory backup")
-			}
-		})
-		if err != nil {
+// addDirectorySchedule schedules a directory backup. Invalid schedules are
+// logged and skipped.
+func (s *Scheduler) addDirectorySchedule(dirSchedule config.DirectorySchedule) {
+	cronExpr, err := getCronExpression(dirSchedule.Expression, dirSchedule.Timezone)
+	if err != nil {
+		log.Error().Err(err).Str("name", dirSchedule.Name).Msg("Invalid schedule configuration, skipping")
+		return
+	}
+
+	run := s.directoryRun(dirSchedule, s.dirBackupFunc)
+	key := entryKey{"directory", dirSchedule.Name}
+	job, err := newJob(s.ctx, dirSchedule.Name, dirSchedule.Overlap, s.guard(key), func(ctx context.Context) {
+		if err := run(ctx); err != nil {
 			log.Error().Err(err).
 				Str("name", dirSchedule.Name).
 				Str("source", dirSchedule.SourcePath).
-				Msg("Failed to schedule directory backup")
-			continue
+				Msg("Failed to execute scheduled directory backup")
 		}
-
-		log.Info().
+	})
+	scheduled := withJitter(s.ctx, dirSchedule.Name, dirSchedule.Jitter, job)
+	var id cron.EntryID
+	if err == nil {
+		id, err = s.cron.AddJob(cronExpr, scheduled)
+	}
+	if err != nil {
+		log.Error().Err(err).
 			Str("name", dirSchedule.Name).
 			Str("source", dirSchedule.SourcePath).
-			Str("schedule", cronExpr).
-			Msg("Scheduled directory backup")
+			Msg("Failed to schedule directory backup")
+		return
 	}
+	s.entries[key] = entry{id: id, schedule: dirSchedule, cronExpr: cronExpr, job: job, scheduled: scheduled}
 
-	s.cron.Start()
-	return nil
+	log.Info().
+		Str("name", dirSchedule.Name).
+		Str("source", dirSchedule.SourcePath).
+		Str("schedule", cronExpr).
+		Msg("Scheduled directory backup")
+}
+
+// guard returns the run guard of a schedule, which is kept across reloads so
+// that a changed schedule still sees the run its previous version started
+func (s *Scheduler) guard(key entryKey) *runGuard {
+	guard, ok := s.guards[key]
+	if !ok {
+		guard = &runGuard{}
+		s.guards[key] = guard
+	}
+	return guard
+}
+
+// databaseRun returns the complete run of a database schedule: the backup
+// with its timeout, the job limits, retries and recording of the outcome
+func (s *Scheduler) databaseRun(dbSchedule config.DatabaseSchedule, dbBackupFunc BackupFunc) func(ctx context.Context) error {
+	run := withTimeout(dbSchedule.Timeout, func(ctx context.Context) error {
+		return dbBackupFunc(ctx, struct {
+			config.DatabaseConfig
+			AWS *config.AWSConfig
+		}{
+			DatabaseConfig: dbSchedule.Database,
+			AWS:            dbSchedule.AWS,
+		})
+	})
+
+	// Backups of databases on the same host share the per-host job limit
+	host := dbSchedule.Database.Host
+	if host == "" {
+		host = s.cfg.Database.Host
+	}
+	run = s.queue.limit(dbSchedule.Name, dbSchedule.Priority, host, run)
+
+	return func(ctx context.Context) error {
+		return s.runSchedule(ctx, "database", dbSchedule.Name, dbSchedule.Retry, run)
+	}
+}
+
+// directoryRun returns the complete run of a directory schedule like
+// databaseRun
+func (s *Scheduler) directoryRun(dirSchedule config.DirectorySchedule, dirBackupFunc BackupFunc) func(ctx context.Context) error {
+	run := withTimeout(dirSchedule.Timeout, func(ctx context.Context) error {
+		return dirBackupFunc(ctx, struct {
+			config.DirectorySchedule
+			AWS *config.AWSConfig
+		}{
+			DirectorySchedule: dirSchedule,
+			AWS:               dirSchedule.AWS,
+		})
+	})
+	run = s.queue.limit(dirSchedule.Name, dirSchedule.Priority, "", run)
+
+	return func(ctx context.Context) error {
+		return s.runSchedule(ctx, "directory", dirSchedule.Name, dirSchedule.Retry, run)
+	}
 }
 
 func (s *Scheduler) Stop() {
@@ -109,18 +242,108 @@ func (s *Scheduler) Stop() {
 	}
 }
 
-func (s *Scheduler) getCronExpression(expr string) string {
+// runSchedule runs a scheduled backup with retries and records its outcome
+func (s *Scheduler) runSchedule(ctx context.Context, kind, name string, retry *config.RetryConfig, fn func(ctx context.Context) error) error {
+	run := history.Run{Schedule: name, Type: kind, Start: time.Now()}
+
+	// Every attempt starts over, so the run reports what its last attempt uploaded
+	var stats *history.Stats
+	err := withRetry(ctx, name, retry, func(ctx context.Context) error {
+		stats = &history.Stats{}
+		return fn(history.WithStats(ctx, stats))
+	})
+
+	run.End = time.Now()
+	stats.Fill(&run)
+	if err != nil {
+		run.Error = err.Error()
+	} else {
+		s.recordSuccess(kind, name)
+	}
+
+	if s.history != nil {
+		if err := s.history.Record(run); err != nil {
+			log.Warn().Err(err).Str("name", name).Msg("Failed to record run")
+		}
+	}
+	return err
+}
+
+// NextRun returns when a schedule with the given expression and timezone
+// runs next
+func (s *Scheduler) NextRun(expression, timezone string) (time.Time, error) {
+	cronExpr, err := getCronExpression(expression, timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	schedule, err := parser.Parse(cronExpr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return schedule.Next(time.Now()), nil
+}
+
+// withTimeout limits every call of fn to timeout, if one is set
+func withTimeout(timeout time.Duration, fn func(ctx context.Context) error) func(ctx context.Context) error {
+	if timeout <= 0 {
+		return fn
+	}
+
+	return func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		err := fn(ctx)
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("backup timed out after %s: %w", timeout, err)
+		}
+		return err
+	}
+}
+
+// getCronExpression resolves the named presets and applies the schedule's
+// timezone to expr
+func getCronExpression(expr, timezone string) (string, error) {
 	switch expr {
 	case "daily":
-		return "0 0 * * *" // Run at midnight every day
+		expr = "0 0 * * *" // Run at midnight every day
 	case "twice_daily":
-		return "0 */12 * * *" // Run every 12 hours
+		expr = "0 */12 * * *" // Run every 12 hours
 	case "thrice_daily":
-		return "0 */8 * * *" // Run every 8 hours
-	default:
-		if _, err := cron.ParseStandard(expr); err == nil {
-			return expr
+		expr = "0 */8 * * *" // Run every 8 hours
+	}
+
+	if timezone != "" {
+		if strings.HasPrefix(expr, "CRON_TZ=") || strings.HasPrefix(expr, "TZ=") {
+			return "", fmt.Errorf("timezone is set both in the expression and as timezone")
+		}
+		if _, err := time.LoadLocation(timezone); err != nil {
+			return "", fmt.Errorf("invalid timezone: %w", err)
 		}
-		return ""
+		expr = "CRON_TZ=" + timezone + " " + expr
+	}
+
+	if _, err := parser.Parse(expr); err != nil {
+		return "", fmt.Errorf("invalid cron expression: %w", err)
+	}
+	return expr, nil
+}
+
+// withJitter delays every run of job by a random duration below jitter
+func withJitter(ctx context.Context, name string, jitter time.Duration, job cron.Job) cron.Job {
+	if jitter <= 0 {
+		return job
 	}
+
+	return cron.FuncJob(func() {
+		delay := rand.N(jitter)
+		log.Debug().Str("name", name).Msgf("Delaying scheduled run by %s", delay.Round(time.Second))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		job.Run()
+	})
 }
@@ -0,0 +1,144 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/robfig/cron/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithTimeout(t *testing.T) {
+	hang := func(ctx context.Context) error {
+		<-ctx.Done()
+		return errors.Join(errors.New("pg_dump was aborted"), ctx.Err())
+	}
+
+	err := withTimeout(10*time.Millisecond, hang)(context.Background())
+	assert.ErrorContains(t, err, "backup timed out after 10ms")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Errors that aren't caused by the timeout are returned as they are
+	failed := errors.New("connection refused")
+	err = withTimeout(time.Hour, func(ctx context.Context) error { return failed })(context.Background())
+	assert.Equal(t, failed, err)
+
+	// A cancelled run isn't reported as timed out
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = withTimeout(time.Hour, hang)(ctx)
+	assert.NotContains(t, err.Error(), "timed out")
+}
+
+func TestRetryAfterTimeout(t *testing.T) {
+	var attempts []error
+	fn := withTimeout(20*time.Millisecond, func(ctx context.Context) error {
+		// Every attempt gets a context of its own, which hasn't expired yet
+		attempts = append(attempts, ctx.Err())
+		if len(attempts) == 1 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+
+	retry := &config.RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	require.NoError(t, withRetry(context.Background(), "test", retry, fn))
+	assert.Equal(t, []error{nil, nil}, attempts)
+}
+
+func TestGetCronExpression(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		timezone string
+		want     string
+		wantErr  string
+	}{
+		{name: "standard", expr: "30 2 * * *", want: "30 2 * * *"},
+		{name: "preset", expr: "daily", want: "0 0 * * *"},
+		{name: "preset with timezone", expr: "twice_daily", timezone: "Europe/Berlin", want: "CRON_TZ=Europe/Berlin 0 */12 * * *"},
+		{name: "seconds", expr: "15 30 2 * * *", want: "15 30 2 * * *"},
+		{name: "descriptor", expr: "@weekly", want: "@weekly"},
+		{name: "every", expr: "@every 90m", timezone: "UTC", want: "CRON_TZ=UTC @every 90m"},
+		{name: "timezone in expression", expr: "CRON_TZ=Asia/Tokyo 0 9 * * *", want: "CRON_TZ=Asia/Tokyo 0 9 * * *"},
+		{name: "timezone conflict", expr: "CRON_TZ=Asia/Tokyo 0 9 * * *", timezone: "Europe/Berlin", wantErr: "timezone is set both in the expression and as timezone"},
+		{name: "TZ conflict", expr: "TZ=Asia/Tokyo 0 9 * * *", timezone: "Asia/Tokyo", wantErr: "timezone is set both in the expression and as timezone"},
+		{name: "invalid timezone", expr: "daily", timezone: "Mars/Olympus", wantErr: "invalid timezone"},
+		{name: "too many fields", expr: "0 0 0 * * * *", wantErr: "invalid cron expression"},
+		{name: "out of range", expr: "61 * * * *", wantErr: "invalid cron expression"},
+		{name: "unknown descriptor", expr: "@fortnightly", wantErr: "invalid cron expression"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getCronExpression(tt.expr, tt.timezone)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCronExpressionSchedule(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	now := time.Date(2025, 1, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		expr     string
+		timezone string
+		want     time.Time
+	}{
+		{name: "timezone", expr: "daily", timezone: "Europe/Berlin", want: time.Date(2025, 1, 16, 0, 0, 0, 0, berlin)},
+		{name: "seconds", expr: "30 0 13 * * *", want: time.Date(2025, 1, 15, 13, 0, 30, 0, time.UTC)},
+		{name: "descriptor", expr: "@monthly", want: time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := getCronExpression(tt.expr, tt.timezone)
+			require.NoError(t, err)
+			schedule, err := parser.Parse(expr)
+			require.NoError(t, err)
+			next := schedule.Next(now)
+			assert.True(t, tt.want.Equal(next), "next run %s, want %s", next, tt.want)
+		})
+	}
+}
+
+func TestWithJitter(t *testing.T) {
+	var runs atomic.Int32
+	job := cron.FuncJob(func() { runs.Add(1) })
+
+	// Without jitter the job is returned as it is
+	withJitter(context.Background(), "test", 0, job).Run()
+	assert.Equal(t, int32(1), runs.Load())
+
+	withJitter(context.Background(), "test", time.Millisecond, job).Run()
+	assert.Equal(t, int32(2), runs.Load())
+
+	// A run waiting for its delay is dropped when the worker stops
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		withJitter(ctx, "test", time.Hour, job).Run()
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "jittered run did not stop")
+	}
+	assert.Equal(t, int32(2), runs.Load())
+}
@@ -0,0 +1,155 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/state"
+	"github.com/rs/zerolog/log"
+)
+
+// runRequestTimeout is how long a worker accepts a run request after it was
+// made. Older requests were left behind by a worker that stopped before it
+// picked them up.
+const runRequestTimeout = time.Minute
+
+// runRequest asks the worker to run a schedule right away
+type runRequest struct {
+	Type      string    `json:"type"`
+	Schedule  string    `json:"schedule"`
+	Requested time.Time `json:"requested"`
+}
+
+// RequestRun records a request for the worker using stateDir to run a
+// schedule. The worker picks it up when RunRequested is called. The request
+// is readable by the worker even if it runs as another user than the caller.
+func RequestRun(stateDir, kind, name string) error {
+	store, err := state.Open(stateDir)
+	if err != nil {
+		return err
+	}
+	return store.SaveShared(state.Name("trigger", kind, name), runRequest{Type: kind, Schedule: name, Requested: time.Now()})
+}
+
+// AwaitRunRequest waits until the worker picked up the request made by
+// RequestRun. A request that is still pending after timeout is withdrawn.
+func AwaitRunRequest(ctx context.Context, stateDir, kind, name string, timeout time.Duration) error {
+	store, err := state.Open(stateDir)
+	if err != nil {
+		return err
+	}
+
+	stateName := state.Name("trigger", kind, name)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	for {
+		pending, err := store.Load(stateName, &runRequest{})
+		if err != nil {
+			return err
+		}
+		if !pending {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			if err := store.Delete(stateName); err != nil {
+				log.Warn().Err(err).Msg("Failed to withdraw run request")
+			}
+			return fmt.Errorf("the worker did not pick up the run request within %s, check its log", timeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// RunRequested triggers the schedules requested by RequestRun
+func (s *Scheduler) RunRequested() {
+	if s.state == nil {
+		return
+	}
+
+	names, err := s.state.List("trigger")
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list run requests")
+		return
+	}
+
+	for _, name := range names {
+		var req runRequest
+		found, err := s.state.Load(name, &req)
+		if err == nil {
+			err = s.state.Delete(name)
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to read run request")
+			continue
+		}
+		if !found {
+			continue
+		}
+
+		if time.Since(req.Requested) > runRequestTimeout {
+			log.Warn().Str("name", req.Schedule).Time("requested", req.Requested).Msg("Ignoring expired run request")
+			continue
+		}
+		if err := s.Trigger(req.Type, req.Schedule); err != nil {
+			log.Error().Err(err).Msg("Failed to trigger requested run")
+		}
+	}
+}
+
+// Trigger starts a run of a scheduled backup right away. The run follows the
+// schedule's overlap policy, job limits and retries like a scheduled run, but
+// it is not delayed by the schedule's jitter.
+func (s *Scheduler) Trigger(kind, name string) error {
+	s.mu.Lock()
+	e, ok := s.entries[entryKey{kind, name}]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%s schedule '%s' not found", kind, name)
+	}
+
+	log.Info().Str("name", name).Msgf("Running %s backup on request", kind)
+	go e.job.trigger()
+	return nil
+}
+
+// RunGuarded runs fn through the run guard of a schedule, so that it doesn't
+// overlap with the schedule's runs. It waits for a run in progress to finish,
+// and a later run of a schedule with the cancel-previous policy cancels it.
+// What names fn in log messages.
+func (s *Scheduler) RunGuarded(ctx context.Context, kind, name, what string, fn func(ctx context.Context)) {
+	s.mu.Lock()
+	guard := s.guard(entryKey{kind, name})
+	s.mu.Unlock()
+
+	guard.run(ctx, name, config.OverlapQueue, what, fn)
+}
+
+// Run runs a configured schedule once in the calling process and returns
+// the outcome of its last attempt. Unlike Trigger, the run doesn't take
+// runs of a worker into account.
+func (s *Scheduler) Run(ctx context.Context, kind, name string, dbBackupFunc, dirBackupFunc BackupFunc) error {
+	switch kind {
+	case "database":
+		for _, schedule := range s.cfg.Schedules.Databases {
+			if schedule.Name == name {
+				return s.databaseRun(schedule, dbBackupFunc)(ctx)
+			}
+		}
+	case "directory":
+		for _, schedule := range s.cfg.Schedules.Directories {
+			if schedule.Name == name {
+				return s.directoryRun(schedule, dirBackupFunc)(ctx)
+			}
+		}
+	default:
+		return fmt.Errorf("invalid schedule type: %s", kind)
+	}
+	return fmt.Errorf("%s schedule '%s' not found", kind, name)
+}
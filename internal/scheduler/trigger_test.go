@@ -0,0 +1,61 @@
+package scheduler
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunRequest(t *testing.T) {
+	cfg := testConfig(t, config.DirectorySchedule{Name: "docs", Expression: "@every 1h"})
+
+	var runs atomic.Int32
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := New(cfg)
+	require.NoError(t, s.Start(ctx, nil, blockingBackup(&runs, started, release)))
+	defer s.Stop()
+
+	require.NoError(t, RequestRun(cfg.StateDir, "directory", "docs"))
+
+	// The worker may run as another user than the one making the request
+	info, err := os.Stat(filepath.Join(cfg.StateDir, state.Name("trigger", "directory", "docs")+".json"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		s.RunRequested()
+	}()
+	require.NoError(t, AwaitRunRequest(ctx, cfg.StateDir, "directory", "docs", 5*time.Second))
+	<-started
+	assert.Equal(t, int32(1), runs.Load())
+
+	close(release)
+	waitForRuns(t, s, "docs", 1)
+}
+
+func TestRunRequestNotPickedUp(t *testing.T) {
+	stateDir := t.TempDir()
+	require.NoError(t, RequestRun(stateDir, "directory", "docs"))
+
+	err := AwaitRunRequest(context.Background(), stateDir, "directory", "docs", 200*time.Millisecond)
+	assert.ErrorContains(t, err, "did not pick up the run request")
+
+	// The request is withdrawn so that a later worker doesn't run it unasked
+	store, err := state.Open(stateDir)
+	require.NoError(t, err)
+	found, err := store.Load(state.Name("trigger", "directory", "docs"), &runRequest{})
+	require.NoError(t, err)
+	assert.False(t, found)
+}
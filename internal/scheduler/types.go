@@ -23,7 +23,7 @@ func (sm *ScheduleManager) AddDatabaseSchedule(schedule config.DatabaseSchedule)
 			// Replace existing schedule
 			sm.cfg.Schedules.Databases[i] = schedule
 			log.Info().Str("name", schedule.Name).Msg("Updated existing database backup schedule")
-			viper.Set("schedules.databases", sm.cfg.Schedules.Databases)
+			viper.Set("schedules.databases", config.Encode(sm.cfg.Schedules.Databases))
 			return sm.saveConfig()
 		}
 	}
@@ -31,7 +31,7 @@ func (sm *ScheduleManager) AddDatabaseSchedule(schedule config.DatabaseSchedule)
 	// Add new schedule
 	sm.cfg.Schedules.Databases = append(sm.cfg.Schedules.Databases, schedule)
 	log.Info().Str("name", schedule.Name).Msg("Added new database backup schedule")
-	viper.Set("schedules.databases", sm.cfg.Schedules.Databases)
+	viper.Set("schedules.databases", config.Encode(sm.cfg.Schedules.Databases))
 	return sm.saveConfig()
 }
 
@@ -42,7 +42,7 @@ func (sm *ScheduleManager) AddDirectorySchedule(schedule config.DirectorySchedul
 			// Replace existing schedule
 			sm.cfg.Schedules.Directories[i] = schedule
 			log.Info().Str("name", schedule.Name).Msg("Updated existing directory backup schedule")
-			viper.Set("schedules.directories", sm.cfg.Schedules.Directories)
+			viper.Set("schedules.directories", config.Encode(sm.cfg.Schedules.Directories))
 			return sm.saveConfig()
 		}
 	}
@@ -50,7 +50,7 @@ func (sm *ScheduleManager) AddDirectorySchedule(schedule config.DirectorySchedul
 	// Add new schedule
 	sm.cfg.Schedules.Directories = append(sm.cfg.Schedules.Directories, schedule)
 	log.Info().Str("name", schedule.Name).Msg("Added new directory backup schedule")
-	viper.Set("schedules.directories", sm.cfg.Schedules.Directories)
+	viper.Set("schedules.directories", config.Encode(sm.cfg.Schedules.Directories))
 	return sm.saveConfig()
 }
 
@@ -71,7 +71,7 @@ func (sm *ScheduleManager) RemoveSchedule(name string, scheduleType string) erro
 			return fmt.Errorf("schedule '%s' not found", name)
 		}
 		sm.cfg.Schedules.Databases = schedules
-		viper.Set("schedules.databases", schedules)
+		viper.Set("schedules.databases", config.Encode(schedules))
 		log.Info().Str("name", name).Msg("Removed database backup schedule")
 
 	case "directory":
@@ -87,7 +87,7 @@ func (sm *ScheduleManager) RemoveSchedule(name string, scheduleType string) erro
 			return fmt.Errorf("schedule '%s' not found", name)
 		}
 		sm.cfg.Schedules.Directories = schedules
-		viper.Set("schedules.directories", schedules)
+		viper.Set("schedules.directories", config.Encode(schedules))
 		log.Info().Str("name", name).Msg("Removed directory backup schedule")
 
 	default:
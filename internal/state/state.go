@@ -0,0 +1,159 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Store keeps small JSON documents in a local directory so that work
+// interrupted by a restart can be resumed
+type Store struct {
+	dir string
+}
+
+// Open creates dir if necessary and returns a store using it
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Name returns a file name safe identifier for kind and the given parts
+func Name(kind string, parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return kind + "-" + hex.EncodeToString(sum[:16])
+}
+
+func (s *Store) path(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
+
+// Load decodes the document stored under name into v. It reports false if
+// there is no such document.
+func (s *Store) Load(name string, v any) (bool, error) {
+	data, err := os.ReadFile(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read state %s: %w", name, err)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("failed to decode state %s: %w", name, err)
+	}
+	return true, nil
+}
+
+// Save stores v under name, replacing the previous document atomically.
+// Only the owner can read the document.
+func (s *Store) Save(name string, v any) error {
+	return s.save(name, v, 0600)
+}
+
+// SaveShared is like Save, but the document can be read by other users. It
+// is meant for documents written by other users than the worker, such as
+// the root user.
+func (s *Store) SaveShared(name string, v any) error {
+	return s.save(name, v, 0644)
+}
+
+func (s *Store) save(name string, v any, perm os.FileMode) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode state %s: %w", name, err)
+	}
+
+	tmpFile, err := os.CreateTemp(s.dir, name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write state %s: %w", name, err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write state %s: %w", name, err)
+	}
+	if err := tmpFile.Chmod(perm); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write state %s: %w", name, err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to write state %s: %w", name, err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), s.path(name)); err != nil {
+		return fmt.Errorf("failed to write state %s: %w", name, err)
+	}
+	return nil
+}
+
+// Lock takes an exclusive lock on the document stored under name, which
+// is also respected by other processes using the same directory, and
+// returns a function releasing it. It blocks until the lock is free.
+func (s *Store) Lock(name string) (func(), error) {
+	file, err := os.OpenFile(filepath.Join(s.dir, name+".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock state %s: %w", name, err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock state %s: %w", name, err)
+	}
+
+	// Closing the file releases the lock
+	return func() { file.Close() }, nil
+}
+
+// Delete removes the document stored under name if it exists
+func (s *Store) Delete(name string) error {
+	if err := os.Remove(s.path(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete state %s: %w", name, err)
+	}
+	return nil
+}
+
+// List returns the names of all documents of the given kind
+func (s *Store) List(kind string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, kind+"-*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(matches))
+	for _, match := range matches {
+		names = append(names, strings.TrimSuffix(filepath.Base(match), ".json"))
+	}
+	return names, nil
+}
+
+// DeleteOlderThan removes documents of the given kind that were last saved
+// more than maxAge ago
+func (s *Store) DeleteOlderThan(kind string, maxAge time.Duration) error {
+	names, err := s.List(kind)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		info, err := os.Stat(s.path(name))
+		if err != nil {
+			continue
+		}
+		if time.Since(info.ModTime()) > maxAge {
+			if err := s.Delete(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrNotFound is returned when an object does not exist
+var ErrNotFound = errors.New("object not found")
+
+// ErrLocked is returned when a retention date or legal hold prevents an
+// object from being deleted
+var ErrLocked = errors.New("object is locked")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	Metadata     map[string]string
+
+	// Only reported by backends that support them
+	StorageClass string
+	Encryption   string
+	RetainUntil  time.Time
+	LegalHold    bool
+}
+
+// ResumableFile marks a file whose path and content don't change between
+// runs. Backends may resume an interrupted upload of it in a later attempt,
+// while uploads of other files are discarded when they fail.
+type ResumableFile struct {
+	*os.File
+}
+
+// Storage is a destination backups are written to and restored from
+type Storage interface {
+	// Upload stores the content of reader under key, replacing any existing object
+	Upload(ctx context.Context, key string, reader io.Reader) error
+
+	// UploadWithMetadata is like Upload but also attaches user metadata to the object
+	UploadWithMetadata(ctx context.Context, key string, reader io.Reader, metadata map[string]string) error
+
+	// Download returns the content of the object stored under key
+	Download(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// DownloadRange returns length bytes of the object starting at offset
+	DownloadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+
+	// ListObjects returns the keys of all objects starting with prefix
+	ListObjects(ctx context.Context, prefix string) ([]string, error)
+
+	// List returns key, size and modification time of all objects starting
+	// with prefix. User metadata is not included.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+
+	// GetObjectMetadata returns information about a single object including
+	// its user metadata, or an error wrapping ErrNotFound
+	GetObjectMetadata(ctx context.Context, key string) (*ObjectInfo, error)
+
+	// DeleteObject removes the object stored under key, or returns an error
+	// wrapping ErrLocked if the object is locked
+	DeleteObject(ctx context.Context, key string) error
+}
+
+// Tagged is implemented by backends that store tags with objects
+type Tagged interface {
+	// GetObjectTags returns the tags of the object stored under key
+	GetObjectTags(ctx context.Context, key string) (map[string]string, error)
+}
+
+// ObjectVersion is a single version of an object in a versioned backend
+type ObjectVersion struct {
+	Key          string
+	VersionID    string
+	Size         int64
+	LastModified time.Time
+	IsLatest     bool
+	DeleteMarker bool
+}
+
+// Versioned is implemented by backends that keep previous versions of
+// overwritten and deleted objects
+type Versioned interface {
+	// ListVersions returns all versions and delete markers of objects
+	// starting with prefix, newest first for every key
+	ListVersions(ctx context.Context, prefix string) ([]ObjectVersion, error)
+
+	// DownloadVersion returns the content of a single version of an object
+	DownloadVersion(ctx context.Context, key, versionID string) (io.ReadCloser, error)
+
+	// GetVersionMetadata is like GetObjectMetadata for a single version of an object
+	GetVersionMetadata(ctx context.Context, key, versionID string) (*ObjectInfo, error)
+}
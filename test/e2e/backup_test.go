@@ -2,11 +2,21 @@ package e2e
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/pkkulhari/backme/internal/backup"
 	"github.com/pkkulhari/backme/internal/config"
+	"github.com/pkkulhari/backme/internal/history"
+	"github.com/pkkulhari/backme/internal/s3"
 )
 
 func (s *E2ETestSuite) TestBackupFlow() {
@@ -21,7 +31,7 @@ func (s *E2ETestSuite) TestBackupFlow() {
 
 		// Perform backup
 		ctx := context.Background()
-		err = s.backup.BackupDirectory(ctx, s.testDir, false, false, nil)
+		err = s.backup.BackupDirectory(ctx, &config.DirectoryConfig{SourcePath: s.testDir}, nil)
 		s.Require().NoError(err)
 
 		// Verify backup
@@ -35,7 +45,7 @@ func (s *E2ETestSuite) TestBackupFlow() {
 
 		// Perform backup
 		ctx := context.Background()
-		err := s.backup.BackupDirectory(ctx, s.testDir, false, false, nil)
+		err := s.backup.BackupDirectory(ctx, &config.DirectoryConfig{SourcePath: s.testDir}, nil)
 		s.Require().NoError(err)
 
 		// Verify backup
@@ -47,7 +57,7 @@ func (s *E2ETestSuite) TestBackupFlow() {
 		// Initial backup
 		files := s.createTestFiles()
 		ctx := context.Background()
-		err := s.backup.BackupDirectory(ctx, s.testDir, true, false, nil)
+		err := s.backup.BackupDirectory(ctx, &config.DirectoryConfig{SourcePath: s.testDir, Sync: true}, nil)
 		s.Require().NoError(err)
 
 		// Add new file
@@ -59,7 +69,7 @@ func (s *E2ETestSuite) TestBackupFlow() {
 
 		// Perform incremental backup
 		time.Sleep(1 * time.Second) // Ensure different timestamp
-		err = s.backup.BackupDirectory(ctx, s.testDir, true, false, nil)
+		err = s.backup.BackupDirectory(ctx, &config.DirectoryConfig{SourcePath: s.testDir, Sync: true}, nil)
 		s.Require().NoError(err)
 
 		// Verify backup contains all files
@@ -71,7 +81,7 @@ func (s *E2ETestSuite) TestBackupFlow() {
 		ctx := context.Background()
 
 		// Test non-existent source
-		err := s.backup.BackupDirectory(ctx, "/nonexistent/path", false, false, nil)
+		err := s.backup.BackupDirectory(ctx, &config.DirectoryConfig{SourcePath: "/nonexistent/path"}, nil)
 		s.Require().Error(err)
 		s.Contains(err.Error(), "source path does not exist")
 
@@ -82,7 +92,7 @@ func (s *E2ETestSuite) TestBackupFlow() {
 			SecretAccessKey: "invalid-secret",
 			Bucket:          "invalid-bucket-name-@#$%",
 		}
-		err = s.backup.BackupDirectory(ctx, s.testDir, false, false, invalidCfg)
+		err = s.backup.BackupDirectory(ctx, &config.DirectoryConfig{SourcePath: s.testDir}, invalidCfg)
 		s.Require().Error(err)
 	})
 }
@@ -102,7 +112,7 @@ func (s *E2ETestSuite) TestScheduledBackup() {
 				return s.backup.BackupDatabase(ctx, nil, nil)
 			},
 			func(ctx context.Context, cfg any) error {
-				return s.backup.BackupDirectory(ctx, s.testDir, false, false, nil)
+				return s.backup.BackupDirectory(ctx, &config.DirectoryConfig{SourcePath: s.testDir}, nil)
 			},
 		)
 		s.Require().NoError(err)
@@ -123,7 +133,7 @@ func (s *E2ETestSuite) TestDirectBackupExecution() {
 
 	// Directly execute backup
 	ctx := context.Background()
-	err := s.backup.BackupDirectory(ctx, s.testDir, false, false, nil)
+	err := s.backup.BackupDirectory(ctx, &config.DirectoryConfig{SourcePath: s.testDir}, nil)
 	s.Require().NoError(err)
 
 	// Verify backup was created in S3
@@ -137,7 +147,7 @@ func (s *E2ETestSuite) TestIncrementalBackup() {
 
 	// Perform initial backup with sync mode
 	ctx := context.Background()
-	err := s.backup.BackupDirectory(ctx, s.testDir, true, false, nil)
+	err := s.backup.BackupDirectory(ctx, &config.DirectoryConfig{SourcePath: s.testDir, Sync: true}, nil)
 	s.Require().NoError(err)
 
 	// Add a new file
@@ -149,9 +159,451 @@ func (s *E2ETestSuite) TestIncrementalBackup() {
 
 	// Perform incremental backup
 	time.Sleep(1 * time.Second) // Ensure different timestamp
-	err = s.backup.BackupDirectory(ctx, s.testDir, true, false, nil)
+	err = s.backup.BackupDirectory(ctx, &config.DirectoryConfig{SourcePath: s.testDir, Sync: true}, nil)
 	s.Require().NoError(err)
 
 	// Verify backup contains all files
 	s.verifyBackupInS3(filepath.Base(s.testDir), files)
 }
+
+// TestSymlinksAndSpecialFiles tests that links and special files are handled without blocking
+func (s *E2ETestSuite) TestSymlinksAndSpecialFiles() {
+	files := s.createTestFiles()
+
+	// Create a symlink, a hardlink and a FIFO next to the regular files
+	s.Require().NoError(os.Symlink("test1.txt", filepath.Join(s.testDir, "link.txt")))
+	s.Require().NoError(os.Link(filepath.Join(s.testDir, "test2.txt"), filepath.Join(s.testDir, "hard.txt")))
+	s.Require().NoError(syscall.Mkfifo(filepath.Join(s.testDir, "pipe"), 0644))
+	defer os.Remove(filepath.Join(s.testDir, "link.txt"))
+	defer os.Remove(filepath.Join(s.testDir, "hard.txt"))
+	defer os.Remove(filepath.Join(s.testDir, "pipe"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := s.backup.BackupDirectory(ctx, &config.DirectoryConfig{
+		SourcePath:   s.testDir,
+		Symlinks:     config.SymlinksPreserve,
+		SpecialFiles: config.SpecialFilesRecord,
+	}, nil)
+	s.Require().NoError(err)
+
+	s.verifyBackupInS3(filepath.Base(s.testDir), append(files, "link.txt", "hard.txt", "pipe"))
+
+	metadata, err := s.s3Client.GetObjectMetadata(ctx, "link.txt")
+	s.Require().NoError(err)
+	s.Equal("symlink", metadata.Metadata["backme-type"])
+	s.Equal("test1.txt", metadata.Metadata["backme-link-target"])
+
+	metadata, err = s.s3Client.GetObjectMetadata(ctx, "pipe")
+	s.Require().NoError(err)
+	s.Equal("fifo", metadata.Metadata["backme-type"])
+}
+
+// TestArchiveBackup tests that archive mode uploads a single archive which can be restored
+func (s *E2ETestSuite) TestArchiveBackup() {
+	files := s.createTestFiles()
+
+	ctx := context.Background()
+	err := s.backup.BackupDirectory(ctx, &config.DirectoryConfig{
+		SourcePath: s.testDir,
+		Mode:       config.DirectoryModeArchive,
+	}, nil)
+	s.Require().NoError(err)
+
+	// Find the uploaded archive
+	objects, err := s.s3Client.ListObjects(ctx, filepath.Base(s.testDir)+"_")
+	s.Require().NoError(err)
+	s.Require().Len(objects, 1)
+	s.True(strings.HasSuffix(objects[0], ".tar.gz"))
+
+	// Restore it and verify the content
+	restoreDir, err := os.MkdirTemp("", "backme-restore-*")
+	s.Require().NoError(err)
+	defer os.RemoveAll(restoreDir)
+
+	err = s.backup.RestoreArchive(ctx, objects[0], restoreDir, "", nil)
+	s.Require().NoError(err)
+
+	for _, f := range files {
+		content, err := os.ReadFile(filepath.Join(restoreDir, f))
+		s.Require().NoError(err)
+		s.Equal("test content", string(content))
+	}
+}
+
+// TestSnapshotBackup tests that snapshots can be listed, diffed and restored
+func (s *E2ETestSuite) TestSnapshotBackup() {
+	s.createTestFiles()
+	dirCfg := &config.DirectoryConfig{
+		SourcePath: s.testDir,
+		Mode:       config.DirectoryModeSnapshot,
+	}
+
+	// Take a first snapshot
+	ctx := context.Background()
+	err := s.backup.BackupDirectory(ctx, dirCfg, nil)
+	s.Require().NoError(err)
+
+	// Modify the tree and take a second snapshot
+	time.Sleep(1 * time.Second) // Ensure a different snapshot key
+	s.Require().NoError(os.WriteFile(filepath.Join(s.testDir, "test1.txt"), []byte("changed content"), 0644))
+	s.Require().NoError(os.WriteFile(filepath.Join(s.testDir, "snapshot.txt"), []byte("new content"), 0644))
+	defer os.Remove(filepath.Join(s.testDir, "snapshot.txt"))
+
+	err = s.backup.BackupDirectory(ctx, dirCfg, nil)
+	s.Require().NoError(err)
+
+	snapshots, err := s.backup.ListSnapshots(ctx, filepath.Base(s.testDir), nil)
+	s.Require().NoError(err)
+	s.Require().Len(snapshots, 2)
+
+	// Verify the diff between both snapshots
+	changes, err := s.backup.DiffSnapshots(ctx, snapshots[0], snapshots[1], nil)
+	s.Require().NoError(err)
+	s.Contains(changes, backup.SnapshotChange{Path: "snapshot.txt", Change: "added"})
+	s.Contains(changes, backup.SnapshotChange{Path: "test1.txt", Change: "modified"})
+
+	// Restore the first snapshot and verify it has the old content
+	restoreDir, err := os.MkdirTemp("", "backme-restore-*")
+	s.Require().NoError(err)
+	defer os.RemoveAll(restoreDir)
+
+	err = s.backup.RestoreSnapshot(ctx, snapshots[0], restoreDir, nil)
+	s.Require().NoError(err)
+
+	content, err := os.ReadFile(filepath.Join(restoreDir, "test1.txt"))
+	s.Require().NoError(err)
+	s.Equal("test content", string(content))
+	s.NoFileExists(filepath.Join(restoreDir, "snapshot.txt"))
+}
+
+// TestDeduplicatedSnapshot tests that unchanged content is not uploaded again with dedup enabled
+func (s *E2ETestSuite) TestDeduplicatedSnapshot() {
+	files := s.createTestFiles()
+	dirCfg := &config.DirectoryConfig{
+		SourcePath: s.testDir,
+		Mode:       config.DirectoryModeSnapshot,
+		Dedup:      true,
+	}
+
+	ctx := context.Background()
+	err := s.backup.BackupDirectory(ctx, dirCfg, nil)
+	s.Require().NoError(err)
+
+	packs, err := s.s3Client.ListObjects(ctx, "chunks/packs/")
+	s.Require().NoError(err)
+	s.Require().NotEmpty(packs)
+
+	// A second snapshot of the same content must not add packs
+	time.Sleep(1 * time.Second) // Ensure a different snapshot key
+	err = s.backup.BackupDirectory(ctx, dirCfg, nil)
+	s.Require().NoError(err)
+
+	packsAfter, err := s.s3Client.ListObjects(ctx, "chunks/packs/")
+	s.Require().NoError(err)
+	s.Equal(len(packs), len(packsAfter))
+
+	snapshots, err := s.backup.ListSnapshots(ctx, filepath.Base(s.testDir), nil)
+	s.Require().NoError(err)
+	s.Require().NotEmpty(snapshots)
+
+	restoreDir, err := os.MkdirTemp("", "backme-restore-*")
+	s.Require().NoError(err)
+	defer os.RemoveAll(restoreDir)
+
+	err = s.backup.RestoreSnapshot(ctx, snapshots[len(snapshots)-1], restoreDir, nil)
+	s.Require().NoError(err)
+
+	for _, f := range files {
+		content, err := os.ReadFile(filepath.Join(restoreDir, f))
+		s.Require().NoError(err)
+		s.Equal("test content", string(content))
+	}
+}
+
+// TestFilesystemDestination tests backing up to a local directory selected per schedule
+func (s *E2ETestSuite) TestFilesystemDestination() {
+	files := s.createTestFiles()
+
+	destDir, err := os.MkdirTemp("", "backme-dest-*")
+	s.Require().NoError(err)
+	defer os.RemoveAll(destDir)
+
+	ctx := context.Background()
+	err = s.backup.BackupDirectory(ctx, &config.DirectoryConfig{SourcePath: s.testDir, Sync: true}, &config.AWSConfig{
+		Destination:     "file://" + destDir,
+		DirectoryPrefix: "files",
+	})
+	s.Require().NoError(err)
+
+	for _, f := range files {
+		content, err := os.ReadFile(filepath.Join(destDir, "files", f))
+		s.Require().NoError(err)
+		s.Equal("test content", string(content))
+	}
+}
+
+// TestSFTPDestination tests backing up a directory to an SFTP server
+func (s *E2ETestSuite) TestSFTPDestination() {
+	files := s.createTestFiles()
+	addr, knownHosts := startSFTPServer(s.T())
+
+	destDir, err := os.MkdirTemp("", "backme-sftp-*")
+	s.Require().NoError(err)
+	defer os.RemoveAll(destDir)
+
+	ctx := context.Background()
+	err = s.backup.BackupDirectory(ctx, &config.DirectoryConfig{SourcePath: s.testDir, Sync: true}, &config.AWSConfig{
+		Destination:     fmt.Sprintf("sftp://%s:%s@%s%s?known_hosts=%s", sftpUser, sftpPassword, addr, destDir, knownHosts),
+		DirectoryPrefix: "files",
+	})
+	s.Require().NoError(err)
+
+	for _, f := range files {
+		content, err := os.ReadFile(filepath.Join(destDir, "files", f))
+		s.Require().NoError(err)
+		s.Equal("test content", string(content))
+	}
+}
+
+// TestWatchDirectory tests that watch mode uploads changed files once the
+// directory has been quiet for the debounce interval and deletes removed ones
+func (s *E2ETestSuite) TestWatchDirectory() {
+	sourceDir, err := os.MkdirTemp("", "backme-watch-*")
+	s.Require().NoError(err)
+	defer os.RemoveAll(sourceDir)
+	s.Require().NoError(os.WriteFile(filepath.Join(sourceDir, "initial.txt"), []byte("initial"), 0644))
+
+	destDir, err := os.MkdirTemp("", "backme-dest-*")
+	s.Require().NoError(err)
+	defer os.RemoveAll(destDir)
+
+	debounce := time.Second
+	dirCfg := &config.DirectoryConfig{
+		SourcePath: sourceDir,
+		Mode:       config.DirectoryModeWatch,
+		Delete:     true,
+		Debounce:   debounce,
+	}
+	awsCfg := &config.AWSConfig{Destination: "file://" + destDir, DirectoryPrefix: "watch"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.backup.WatchDirectory(ctx, dirCfg, awsCfg, nil)
+	}()
+	defer func() {
+		cancel()
+		s.NoError(<-done)
+	}()
+
+	backedUp := func(name string) string {
+		content, err := os.ReadFile(filepath.Join(destDir, "watch", name))
+		if err != nil {
+			return ""
+		}
+		return string(content)
+	}
+
+	// The initial sync uploads files that existed before watching started
+	s.Eventually(func() bool { return backedUp("initial.txt") == "initial" }, 5*time.Second, 50*time.Millisecond)
+
+	// A new file is only uploaded after the debounce interval
+	s.Require().NoError(os.MkdirAll(filepath.Join(sourceDir, "subdir"), 0755))
+	s.Require().NoError(os.WriteFile(filepath.Join(sourceDir, "subdir", "new.txt"), []byte("new"), 0644))
+	s.Require().NoError(os.WriteFile(filepath.Join(sourceDir, "initial.txt"), []byte("changed"), 0644))
+	changed := time.Now()
+	time.Sleep(debounce / 2)
+	s.Empty(backedUp("subdir/new.txt"))
+	s.Equal("initial", backedUp("initial.txt"))
+
+	s.Eventually(func() bool {
+		return backedUp("subdir/new.txt") == "new" && backedUp("initial.txt") == "changed"
+	}, 5*time.Second, 50*time.Millisecond)
+	s.GreaterOrEqual(time.Since(changed), debounce)
+
+	// Removed files are deleted from the destination
+	s.Require().NoError(os.Remove(filepath.Join(sourceDir, "initial.txt")))
+	s.Eventually(func() bool {
+		_, err := os.Stat(filepath.Join(destDir, "watch", "initial.txt"))
+		return os.IsNotExist(err)
+	}, 5*time.Second, 50*time.Millisecond)
+	s.Equal("new", backedUp("subdir/new.txt"))
+}
+
+// TestMultipleDestinations tests that a backup is written to every destination
+// and that failed destinations are reported under either replication policy
+func (s *E2ETestSuite) TestMultipleDestinations() {
+	files := s.createTestFiles()
+
+	destDirs := make([]string, 2)
+	for i := range destDirs {
+		dir, err := os.MkdirTemp("", "backme-dest-*")
+		s.Require().NoError(err)
+		defer os.RemoveAll(dir)
+		destDirs[i] = dir
+	}
+
+	ctx := context.Background()
+	dirCfg := &config.DirectoryConfig{SourcePath: s.testDir, Mode: config.DirectoryModeArchive}
+	awsCfg := &config.AWSConfig{
+		Destinations:    []string{"file://" + destDirs[0], "file://" + destDirs[1]},
+		DirectoryPrefix: "archives",
+	}
+	s.Require().NoError(s.backup.BackupDirectory(ctx, dirCfg, awsCfg))
+
+	for _, dir := range destDirs {
+		archives, err := filepath.Glob(filepath.Join(dir, "archives", "*.tar.gz"))
+		s.Require().NoError(err)
+		s.Len(archives, 1)
+	}
+
+	// A destination that cannot be written to fails the backup unless the
+	// replication policy accepts partial success
+	blocked := filepath.Join(destDirs[1], "blocked")
+	s.Require().NoError(os.WriteFile(blocked, nil, 0644))
+	awsCfg.Destinations = []string{"file://" + destDirs[0], "file://" + blocked}
+	dirCfg = &config.DirectoryConfig{SourcePath: s.testDir}
+
+	err := s.backup.BackupDirectory(ctx, dirCfg, awsCfg)
+	var replicationErr *backup.ReplicationError
+	s.Require().ErrorAs(err, &replicationErr)
+	s.Require().Len(replicationErr.Results, 2)
+	s.NoError(replicationErr.Results[0].Err)
+	s.Error(replicationErr.Results[1].Err)
+
+	// With partial success the failed destination is still reported
+	awsCfg.ReplicationPolicy = config.ReplicationAny
+	stats := &history.Stats{}
+	s.Require().NoError(s.backup.BackupDirectory(history.WithStats(ctx, stats), dirCfg, awsCfg))
+	var run history.Run
+	stats.Fill(&run)
+	s.True(run.Partial())
+	s.Contains(run.FailedDestinations, "file://"+blocked)
+	for _, f := range files {
+		s.FileExists(filepath.Join(destDirs[0], "archives", f))
+	}
+}
+
+// TestUploadOptions tests that encryption, storage class, tags and metadata
+// are applied to uploaded objects
+func (s *E2ETestSuite) TestUploadOptions() {
+	cfg := *s.cfg
+	cfg.AWS.ServerSideEncryption = config.SSEAES256
+	cfg.AWS.StorageClass = "STANDARD_IA"
+	cfg.AWS.Tags = map[string]string{"env": "test"}
+	cfg.AWS.Metadata = map[string]string{"owner": "backme"}
+
+	client, err := s3.New(&cfg, &s3.Options{
+		Endpoint: "http://s3.localhost.localstack.cloud:4566",
+	})
+	s.Require().NoError(err)
+
+	ctx := context.Background()
+	s.Require().NoError(client.Upload(ctx, "options/test.txt", strings.NewReader("test content")))
+
+	info, err := client.GetObjectMetadata(ctx, "options/test.txt")
+	s.Require().NoError(err)
+	s.Equal("STANDARD_IA", info.StorageClass)
+	s.Equal(config.SSEAES256, info.Encryption)
+	s.Equal("backme", info.Metadata["owner"])
+
+	tags, err := client.GetObjectTags(ctx, "options/test.txt")
+	s.Require().NoError(err)
+	s.Equal(map[string]string{"env": "test"}, tags)
+}
+
+// TestRestoreAsOf tests that a files mode backup is restored as it was at a
+// point in time, including file modes and modification times, in a versioned
+// bucket of its own
+func (s *E2ETestSuite) TestRestoreAsOf() {
+	ctx := context.Background()
+	raw := s.rawS3Client()
+
+	cfg := *s.cfg
+	cfg.AWS.Bucket = s.testBucket + "-versions"
+	cfg.StateDir = s.T().TempDir()
+	client, err := s3.New(&cfg, &s3.Options{Endpoint: "http://s3.localhost.localstack.cloud:4566"})
+	s.Require().NoError(err)
+	s.Require().NoError(client.CreateBucket(ctx))
+	defer s.deleteVersionedBucket(raw, cfg.AWS.Bucket)
+	s.Require().NoError(client.EnableVersioning(ctx))
+	svc := backup.New(&cfg, client)
+
+	sourceDir := s.T().TempDir()
+	files := []string{"test1.txt", "test2.txt", "subdir/test3.txt"}
+	for _, f := range files {
+		path := filepath.Join(sourceDir, f)
+		s.Require().NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		s.Require().NoError(os.WriteFile(path, []byte("test content"), 0644))
+	}
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s.Require().NoError(os.Chmod(filepath.Join(sourceDir, files[2]), 0600))
+	s.Require().NoError(os.Chtimes(filepath.Join(sourceDir, files[2]), modTime, modTime))
+
+	// Objects of other backups in the bucket are not restored without a prefix
+	s.Require().NoError(client.Upload(ctx, "database/mydb.sql", strings.NewReader("dump")))
+
+	dirCfg := &config.DirectoryConfig{SourcePath: sourceDir, Sync: true, Delete: true}
+	s.Require().NoError(svc.BackupDirectory(ctx, dirCfg, nil))
+
+	// S3 timestamps have a resolution of one second
+	time.Sleep(1100 * time.Millisecond)
+	asOf := time.Now()
+	time.Sleep(1100 * time.Millisecond)
+
+	s.Require().NoError(os.WriteFile(filepath.Join(sourceDir, files[0]), []byte("changed content"), 0644))
+	s.Require().NoError(os.Remove(filepath.Join(sourceDir, files[1])))
+	s.Require().NoError(svc.BackupDirectory(ctx, dirCfg, nil))
+
+	restoreDir := s.T().TempDir()
+	s.Require().NoError(svc.RestoreFiles(ctx, "", restoreDir, asOf, nil))
+	for _, f := range files {
+		content, err := os.ReadFile(filepath.Join(restoreDir, f))
+		s.Require().NoError(err)
+		s.Equal("test content", string(content))
+	}
+	s.NoFileExists(filepath.Join(restoreDir, "database/mydb.sql"))
+
+	info, err := os.Stat(filepath.Join(restoreDir, files[2]))
+	s.Require().NoError(err)
+	s.Equal(os.FileMode(0600), info.Mode().Perm())
+	s.True(modTime.Equal(info.ModTime()))
+}
+
+// deleteVersionedBucket deletes every version in bucket and then the bucket
+func (s *E2ETestSuite) deleteVersionedBucket(raw *awss3.Client, bucket string) {
+	ctx := context.Background()
+	paginator := awss3.NewListObjectVersionsPaginator(raw, &awss3.ListObjectVersionsInput{Bucket: aws.String(bucket)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			s.T().Logf("Failed to list versions of %s: %v", bucket, err)
+			return
+		}
+
+		var ids []types.ObjectIdentifier
+		for _, v := range page.Versions {
+			ids = append(ids, types.ObjectIdentifier{Key: v.Key, VersionId: v.VersionId})
+		}
+		for _, m := range page.DeleteMarkers {
+			ids = append(ids, types.ObjectIdentifier{Key: m.Key, VersionId: m.VersionId})
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		_, err = raw.DeleteObjects(ctx, &awss3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &types.Delete{Objects: ids},
+		})
+		if err != nil {
+			s.T().Logf("Failed to delete versions of %s: %v", bucket, err)
+			return
+		}
+	}
+
+	if _, err := raw.DeleteBucket(ctx, &awss3.DeleteBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		s.T().Logf("Failed to delete bucket %s: %v", bucket, err)
+	}
+}
@@ -0,0 +1,154 @@
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/pkkulhari/backme/internal/s3"
+	"github.com/pkkulhari/backme/internal/state"
+	"github.com/pkkulhari/backme/internal/storage"
+)
+
+// partSize matches the part size the client uses for files below 156 GiB
+const partSize = 16 << 20
+
+// rawS3Client returns an AWS SDK client for the test bucket, used to set up
+// and inspect multipart uploads directly
+func (s *E2ETestSuite) rawS3Client() *awss3.Client {
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(),
+		awsconfig.WithRegion(s.cfg.AWS.Region),
+		awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(s.cfg.AWS.AccessKeyID, s.cfg.AWS.SecretAccessKey, "")),
+	)
+	s.Require().NoError(err)
+	return awss3.NewFromConfig(awsCfg, func(o *awss3.Options) {
+		o.BaseEndpoint = aws.String("http://s3.localhost.localstack.cloud:4566")
+	})
+}
+
+// pendingUploads returns the IDs of unfinished multipart uploads below prefix
+func (s *E2ETestSuite) pendingUploads(raw *awss3.Client, prefix string) []string {
+	result, err := raw.ListMultipartUploads(context.Background(), &awss3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.testBucket),
+		Prefix: aws.String(prefix),
+	})
+	s.Require().NoError(err)
+
+	var ids []string
+	for _, upload := range result.Uploads {
+		ids = append(ids, aws.ToString(upload.UploadId))
+	}
+	return ids
+}
+
+// TestResumeUpload tests that an interrupted upload of a large file is
+// continued from its recorded state instead of being started over
+func (s *E2ETestSuite) TestResumeUpload() {
+	ctx := context.Background()
+	raw := s.rawS3Client()
+
+	cfg := *s.cfg
+	cfg.StateDir = s.T().TempDir()
+	client, err := s3.New(&cfg, &s3.Options{Endpoint: "http://s3.localhost.localstack.cloud:4566"})
+	s.Require().NoError(err)
+
+	content := bytes.Repeat([]byte("backme"), (s3.MultipartThreshold+partSize)/6)
+	path := filepath.Join(s.T().TempDir(), "large.bin")
+	s.Require().NoError(os.WriteFile(path, content, 0644))
+	info, err := os.Stat(path)
+	s.Require().NoError(err)
+
+	// Start the upload and its first part like an earlier run that was interrupted
+	key := "resume/large.bin"
+	created, err := raw.CreateMultipartUpload(ctx, &awss3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.testBucket),
+		Key:    aws.String(key),
+	})
+	s.Require().NoError(err)
+	_, err = raw.UploadPart(ctx, &awss3.UploadPartInput{
+		Bucket:     aws.String(s.testBucket),
+		Key:        aws.String(key),
+		UploadId:   created.UploadId,
+		PartNumber: aws.Int32(1),
+		Body:       bytes.NewReader(content[:partSize]),
+	})
+	s.Require().NoError(err)
+
+	store, err := state.Open(cfg.StateDir)
+	s.Require().NoError(err)
+	stateName := state.Name("upload", s.testBucket, key, path, strconv.FormatInt(info.Size(), 10), info.ModTime().UTC().String(), "0")
+	s.Require().NoError(store.Save(stateName, map[string]any{
+		"upload_id": aws.ToString(created.UploadId),
+		"key":       key,
+		"part_size": partSize,
+	}))
+
+	file, err := os.Open(path)
+	s.Require().NoError(err)
+	defer file.Close()
+	s.Require().NoError(client.Upload(ctx, key, storage.ResumableFile{File: file}))
+
+	// The recorded upload was completed rather than a new one started
+	s.Empty(s.pendingUploads(raw, "resume/"))
+	found, err := store.Load(stateName, &map[string]any{})
+	s.Require().NoError(err)
+	s.False(found)
+
+	body, err := client.Download(ctx, key)
+	s.Require().NoError(err)
+	defer body.Close()
+	downloaded, err := io.ReadAll(body)
+	s.Require().NoError(err)
+	s.Equal(len(content), len(downloaded))
+	s.True(bytes.Equal(content, downloaded))
+}
+
+// TestAbortStaleUploads tests that unfinished uploads are aborted unless they
+// can still be resumed
+func (s *E2ETestSuite) TestAbortStaleUploads() {
+	ctx := context.Background()
+	raw := s.rawS3Client()
+
+	cfg := *s.cfg
+	cfg.StateDir = s.T().TempDir()
+	client, err := s3.New(&cfg, &s3.Options{Endpoint: "http://s3.localhost.localstack.cloud:4566"})
+	s.Require().NoError(err)
+
+	stale, err := raw.CreateMultipartUpload(ctx, &awss3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.testBucket),
+		Key:    aws.String("stale/dump.sql"),
+	})
+	s.Require().NoError(err)
+	resumable, err := raw.CreateMultipartUpload(ctx, &awss3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.testBucket),
+		Key:    aws.String("stale/file.bin"),
+	})
+	s.Require().NoError(err)
+	defer raw.AbortMultipartUpload(ctx, &awss3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.testBucket),
+		Key:      aws.String("stale/file.bin"),
+		UploadId: resumable.UploadId,
+	})
+
+	store, err := state.Open(cfg.StateDir)
+	s.Require().NoError(err)
+	s.Require().NoError(store.Save(state.Name("upload", "stale/file.bin"), map[string]any{
+		"upload_id": aws.ToString(resumable.UploadId),
+		"key":       "stale/file.bin",
+		"part_size": partSize,
+	}))
+
+	aborted, err := client.AbortStaleUploads(ctx, "stale/", 0)
+	s.Require().NoError(err)
+	s.Equal(1, aborted)
+	s.Equal([]string{aws.ToString(resumable.UploadId)}, s.pendingUploads(raw, "stale/"))
+	s.NotContains(s.pendingUploads(raw, "stale/"), aws.ToString(stale.UploadId))
+}
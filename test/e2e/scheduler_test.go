@@ -28,7 +28,7 @@ func (s *E2ETestSuite) TestSchedulerStart() {
 		},
 		func(ctx context.Context, cfg any) error {
 			// Direct directory backup
-			return s.backup.BackupDirectory(ctx, s.testDir, false, false, nil)
+			return s.backup.BackupDirectory(ctx, &config.DirectoryConfig{SourcePath: s.testDir}, nil)
 		},
 	)
 	s.Require().NoError(err)
@@ -98,8 +98,10 @@ func (s *E2ETestSuite) TestSchedulerWithCustomConfig() {
 				{
 					Name:       "custom-dir",
 					Expression: "@every 1s", // Run every second instead of every minute
-					SourcePath: customDir,
-					AWS:        nil, // Use default AWS config
+					DirectoryConfig: config.DirectoryConfig{
+						SourcePath: customDir,
+					},
+					AWS: nil, // Use default AWS config
 				},
 			},
 		},
@@ -131,7 +133,7 @@ func (s *E2ETestSuite) TestSchedulerWithCustomConfig() {
 			s.Equal(customDir, dirCfg.SourcePath)
 
 			// Execute backup
-			return s.backup.BackupDirectory(ctx, dirCfg.SourcePath, false, false, dirCfg.AWS)
+			return s.backup.BackupDirectory(ctx, &dirCfg.DirectoryConfig, dirCfg.AWS)
 		},
 	)
 	s.Require().NoError(err)